@@ -0,0 +1,250 @@
+package gogit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/nulab/go-git-http-xfer/githttpxfer"
+)
+
+const (
+	uploadPack  = "upload-pack"
+	receivePack = "receive-pack"
+)
+
+// New returns the backend that serves the bare repositories under rootPath without the git executable.
+func New(rootPath string) *Backend {
+	return NewWithResolver(githttpxfer.NewRootResolver(rootPath))
+}
+
+// NewWithResolver returns the backend that serves the bare repositories that the resolver locates.
+func NewWithResolver(resolver githttpxfer.RepoResolver) *Backend {
+	return &Backend{resolver}
+}
+
+type Backend struct {
+	resolver githttpxfer.RepoResolver
+}
+
+// GetAbsolutePath returns the absolute path of the repository with the RepoResolver.
+func (b *Backend) GetAbsolutePath(repoPath string) (string, error) {
+	return b.resolver.Resolve(repoPath)
+}
+
+func (b *Backend) Exists(repoPath string) bool {
+	absRepoPath, err := b.GetAbsolutePath(repoPath)
+	if err != nil {
+		return false
+	}
+	if _, err := os.Stat(absRepoPath); os.IsNotExist(err) {
+		return false
+	}
+	return true
+}
+
+func (b *Backend) GetRequestFileInfo(repoPath, filePath string) (*githttpxfer.RequestFileInfo, error) {
+	absRepoPath, err := b.GetAbsolutePath(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	absFilePath, err := githttpxfer.SecureJoin(absRepoPath, filePath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(absFilePath)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, &githttpxfer.UnsafePathError{Path: filePath, Reason: "the path is not a regular file"}
+	}
+	return &githttpxfer.RequestFileInfo{FileInfo: info, AbsolutePath: absFilePath}, nil
+}
+
+// SupportsProtocolV2 returns false. The clients fall back to the protocol v0.
+func (b *Backend) SupportsProtocolV2() bool {
+	return false
+}
+
+// CreateRepository creates the bare repository for githttpxfer.WithPushToCreate.
+// The template directory is not supported without the git executable.
+func (b *Backend) CreateRepository(ctx githttpxfer.Context, templateDir, defaultBranch string) (err error) {
+	if templateDir != "" {
+		return fmt.Errorf("the template directory is not supported: %s", templateDir)
+	}
+	absRepoPath, err := b.GetAbsolutePath(ctx.RepoPath())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(absRepoPath, 0755); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(absRepoPath)
+		}
+	}()
+
+	s, err := b.storage(ctx.RepoPath())
+	if err != nil {
+		return err
+	}
+	if _, err := git.Init(s, nil); err != nil {
+		return err
+	}
+	if defaultBranch == "" {
+		return nil
+	}
+	return s.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName(defaultBranch)))
+}
+
+func (b *Backend) storage(repoPath string) (*filesystem.Storage, error) {
+	absRepoPath, err := b.GetAbsolutePath(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	return filesystem.NewStorage(osfs.New(absRepoPath), cache.NewObjectLRUDefault()), nil
+}
+
+func (b *Backend) AdvertiseRefs(ctx githttpxfer.Context, service string, w io.Writer) error {
+	s, err := b.storage(ctx.RepoPath())
+	if err != nil {
+		return err
+	}
+	ep, err := transport.NewEndpoint("/")
+	if err != nil {
+		return err
+	}
+	srv := server.NewServer(server.MapLoader{ep.String(): s})
+
+	var ar *packp.AdvRefs
+	switch service {
+	case uploadPack:
+		session, err := srv.NewUploadPackSession(ep, nil)
+		if err != nil {
+			return err
+		}
+		if ar, err = session.AdvertisedReferencesContext(ctx.Request().Context()); err != nil {
+			return err
+		}
+		if err := ar.Capabilities.Set(capability.Shallow); err != nil {
+			return err
+		}
+		for name, h := range ar.References {
+			if tag, err := object.GetTag(s, h); err == nil {
+				ar.Peeled[name] = tag.Target
+			}
+		}
+	case receivePack:
+		session, err := srv.NewReceivePackSession(ep, nil)
+		if err != nil {
+			return err
+		}
+		if ar, err = session.AdvertisedReferencesContext(ctx.Request().Context()); err != nil {
+			return err
+		}
+		// The thin pack can not be stored without the git executable.
+		if err := ar.Capabilities.Set(capabilityNoThin); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported service: %s", service)
+	}
+	return ar.Encode(w)
+}
+
+const capabilityNoThin capability.Capability = "no-thin"
+
+// UpdateServerInfo writes info/refs and objects/info/packs like "git update-server-info".
+func (b *Backend) UpdateServerInfo(ctx githttpxfer.Context) error {
+	absRepoPath, err := b.GetAbsolutePath(ctx.RepoPath())
+	if err != nil {
+		return err
+	}
+	s, err := b.storage(ctx.RepoPath())
+	if err != nil {
+		return err
+	}
+
+	iter, err := s.IterReferences()
+	if err != nil {
+		return err
+	}
+	refs := []*plumbing.Reference{}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && ref.Name() != plumbing.HEAD {
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name() < refs[j].Name() })
+
+	infoRefs := &strings.Builder{}
+	for _, ref := range refs {
+		infoRefs.WriteString(ref.Hash().String() + "\t" + ref.Name().String() + "\n")
+		if tag, err := object.GetTag(s, ref.Hash()); err == nil {
+			infoRefs.WriteString(tag.Target.String() + "\t" + ref.Name().String() + "^{}\n")
+		}
+	}
+	if err := writeFile(path.Join(absRepoPath, "info", "refs"), infoRefs.String()); err != nil {
+		return err
+	}
+
+	packs, err := filepath.Glob(path.Join(absRepoPath, "objects", "pack", "pack-*.pack"))
+	if err != nil {
+		return err
+	}
+	infoPacks := &strings.Builder{}
+	for _, p := range packs {
+		infoPacks.WriteString("P " + filepath.Base(p) + "\n")
+	}
+	infoPacks.WriteString("\n")
+	return writeFile(path.Join(absRepoPath, "objects", "info", "packs"), infoPacks.String())
+}
+
+// writeFile replaces the file at once, so that a reader never sees the file half written.
+func writeFile(name string, content string) error {
+	if err := os.MkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(path.Dir(name), path.Base(name)+"_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	w.WriteString(content)
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
@@ -0,0 +1,166 @@
+package gogit_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/nulab/go-git-http-xfer/addon/backend/gogit"
+	"github.com/nulab/go-git-http-xfer/githttpxfer"
+)
+
+func execCmd(dir string, name string, arg ...string) ([]byte, error) {
+	c := exec.Command(name, arg...)
+	c.Dir = dir
+	return c.CombinedOutput()
+}
+
+// setupEndToEndTest starts the server with the backend, and returns the root of the repositories.
+func setupEndToEndTest(t *testing.T, opts ...githttpxfer.Option) (ghx *githttpxfer.GitHTTPXfer, ts *httptest.Server, gitRootPath string, ok bool) {
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Log("git is not found. so skip git e2e test.")
+		return nil, nil, "", false
+	}
+
+	gitRootPath, err := ioutil.TempDir("", "gogit")
+	if err != nil {
+		t.Errorf("Create Temp Dir error: %s", err.Error())
+		return nil, nil, "", false
+	}
+
+	ghx, err = githttpxfer.New(gitRootPath, "", append([]githttpxfer.Option{githttpxfer.WithBackend(gogit.New(gitRootPath))}, opts...)...)
+	if err != nil {
+		t.Errorf("GitHTTPXfer instance could not be created. %s", err.Error())
+		os.RemoveAll(gitRootPath)
+		return nil, nil, "", false
+	}
+	return ghx, httptest.NewServer(ghx), gitRootPath, true
+}
+
+func Test_End_To_End_it_should_succeed_clone_and_push_and_fetch_and_log(t *testing.T) {
+
+	_, ts, gitRootPath, ok := setupEndToEndTest(t)
+	if !ok {
+		return
+	}
+	defer os.RemoveAll(gitRootPath)
+	defer ts.Close()
+
+	if _, err := execCmd(gitRootPath, "git", "init", "--bare", "--shared", "e2e_test.git"); err != nil {
+		t.Errorf("execute command error: %s", err.Error())
+		return
+	}
+
+	remoteRepoURL := ts.URL + "/e2e_test.git"
+	destDirPathA := path.Join(gitRootPath, "test_a")
+	destDirPathB := path.Join(gitRootPath, "test_b")
+	destDirPathC := path.Join(gitRootPath, "test_c")
+
+	commands := []struct {
+		dir  string
+		args []string
+	}{
+		{args: []string{"clone", remoteRepoURL, destDirPathA}},
+		{args: []string{"clone", remoteRepoURL, destDirPathB}},
+		{dir: destDirPathA, args: []string{"-c", "user.name=John Smith", "-c", "user.email=js@example.com", "commit", "--allow-empty", "-m", "first commit"}},
+		{dir: destDirPathA, args: []string{"push", "-u", "origin", "HEAD:refs/heads/master"}},
+		{dir: destDirPathB, args: []string{"fetch"}},
+		{dir: destDirPathB, args: []string{"log", "--oneline", "origin/master", "-1"}},
+		{args: []string{"clone", "--depth=1", remoteRepoURL, destDirPathC}},
+	}
+
+	for _, c := range commands {
+		if output, err := execCmd(c.dir, "git", c.args...); err != nil {
+			t.Errorf("execute command error: git %s %s %s", strings.Join(c.args, " "), err.Error(), output)
+			return
+		}
+	}
+
+	absRepoPath := path.Join(gitRootPath, "e2e_test.git")
+	if _, err := execCmd(absRepoPath, "git", "gc"); err != nil {
+		t.Errorf("execute command error: %s", err.Error())
+		return
+	}
+	looseObject, err := exec.Command("git", "-C", absRepoPath, "hash-object", "-w", "--stdin").Output()
+	if err != nil {
+		t.Errorf("execute command error: %s", err.Error())
+		return
+	}
+	oid := strings.TrimSpace(string(looseObject))
+
+	tests := []struct {
+		description string
+		url         string
+	}{
+		{description: "it should serve info/refs of the dumb protocol", url: remoteRepoURL + "/info/refs"},
+		{description: "it should serve HEAD of the dumb protocol", url: remoteRepoURL + "/HEAD"},
+		{description: "it should serve the loose object of the dumb protocol", url: remoteRepoURL + "/objects/" + oid[:2] + "/" + oid[2:]},
+		{description: "it should serve objects/info/packs of the dumb protocol", url: remoteRepoURL + "/objects/info/packs"},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		res, err := http.Get(tc.url)
+		if err != nil {
+			t.Errorf("http.Get: %s", err.Error())
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("StatusCode is not %d . result: %d", http.StatusOK, res.StatusCode)
+		}
+	}
+}
+
+func Test_End_To_End_it_should_create_the_repository_on_the_first_push(t *testing.T) {
+
+	ghx, ts, gitRootPath, ok := setupEndToEndTest(t, githttpxfer.WithPushToCreate(githttpxfer.PushToCreate{
+		Authorize: func(ctx githttpxfer.Context) error {
+			if !strings.HasPrefix(ctx.RepoPath(), "/team/") {
+				return &githttpxfer.RejectionError{Message: "you can not create " + ctx.RepoPath()}
+			}
+			return nil
+		},
+		DefaultBranch: "main",
+	}))
+	if !ok {
+		return
+	}
+	defer os.RemoveAll(gitRootPath)
+	defer ts.Close()
+
+	workingDirPath := path.Join(gitRootPath, "work")
+	if _, err := execCmd("", "git", "init", workingDirPath); err != nil {
+		t.Errorf("execute command error: %s", err.Error())
+		return
+	}
+	if _, err := execCmd(workingDirPath, "git", "-c", "user.name=John Smith", "-c", "user.email=js@example.com", "commit", "--allow-empty", "-m", "first commit"); err != nil {
+		t.Errorf("execute command error: %s", err.Error())
+		return
+	}
+
+	if output, err := execCmd(workingDirPath, "git", "push", ts.URL+"/team/new.git", "HEAD:refs/heads/main"); err != nil {
+		t.Errorf("the push to create is failed. result: %s", output)
+		return
+	}
+	absRepoPath, _ := ghx.Git.GetAbsolutePath("/team/new.git")
+	if output, err := execCmd(absRepoPath, "git", "symbolic-ref", "HEAD"); err != nil || string(output) != "refs/heads/main\n" {
+		t.Errorf("HEAD is not refs/heads/main . result: %s", output)
+	}
+	if _, err := execCmd(absRepoPath, "git", "rev-parse", "--verify", "refs/heads/main"); err != nil {
+		t.Error("the pushed branch does not exist.")
+	}
+
+	if output, err := execCmd(workingDirPath, "git", "push", ts.URL+"/other/new.git", "HEAD:refs/heads/main"); err == nil {
+		t.Errorf("the push that is not authorized succeeds. result: %s", output)
+	}
+	if ghx.Git.Exists("/other/new.git") {
+		t.Error("the repository that is not authorized is created.")
+	}
+}
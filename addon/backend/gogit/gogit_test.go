@@ -0,0 +1,187 @@
+package gogit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/nulab/go-git-http-xfer/githttpxfer"
+)
+
+func setupRepository(t *testing.T) (rootPath string, ok bool) {
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Log("git is not found. so skip gogit test.")
+		return "", false
+	}
+
+	rootPath, err := ioutil.TempDir("", "gogit")
+	if err != nil {
+		t.Errorf("ioutil.TempDir error: %s", err.Error())
+		return "", false
+	}
+
+	workingDirPath := path.Join(rootPath, "work")
+	commands := [][]string{
+		{"init", "-q", "--bare", path.Join(rootPath, "test.git")},
+		{"init", "-q", workingDirPath},
+		{"-C", workingDirPath, "-c", "user.name=John Smith", "-c", "user.email=js@example.com", "commit", "-q", "--allow-empty", "-m", "first commit"},
+		{"-C", workingDirPath, "-c", "user.name=John Smith", "-c", "user.email=js@example.com", "tag", "-a", "v1", "-m", "v1"},
+		{"-C", workingDirPath, "push", "-q", path.Join(rootPath, "test.git"), "HEAD:refs/heads/master", "v1"},
+	}
+	for _, args := range commands {
+		if output, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Errorf("execute command error: %s %s", err.Error(), output)
+			return "", false
+		}
+	}
+	return rootPath, true
+}
+
+func newContext(repoPath string) githttpxfer.Context {
+	return githttpxfer.NewContext(httptest.NewRecorder(), httptest.NewRequest("GET", "/"+repoPath+"/info/refs", nil), repoPath, "/info/refs")
+}
+
+func Test_it_should_advertise_refs(t *testing.T) {
+
+	rootPath, ok := setupRepository(t)
+	if !ok {
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	b := New(rootPath)
+
+	tests := []struct {
+		description string
+		service     string
+		expected    []string
+	}{
+		{
+			description: "it should advertise refs of upload-pack",
+			service:     "upload-pack",
+			expected:    []string{"refs/heads/master", "refs/tags/v1^{}", "shallow"},
+		},
+		{
+			description: "it should advertise refs of receive-pack",
+			service:     "receive-pack",
+			expected:    []string{"refs/heads/master", "report-status", "no-thin"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		buf := &bytes.Buffer{}
+		if err := b.AdvertiseRefs(newContext("test.git"), tc.service, buf); err != nil {
+			t.Errorf("AdvertiseRefs error: %s", err.Error())
+			return
+		}
+		for _, e := range tc.expected {
+			if !strings.Contains(buf.String(), e) {
+				t.Errorf("advertisement does not contain %s . result: %s", e, buf.String())
+			}
+		}
+	}
+
+	if err := b.AdvertiseRefs(newContext("test.git"), "archive", &bytes.Buffer{}); err == nil {
+		t.Error("AdvertiseRefs of unknown service does not fail.")
+	}
+}
+
+func Test_it_should_update_server_info_like_git(t *testing.T) {
+
+	rootPath, ok := setupRepository(t)
+	if !ok {
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	absRepoPath := path.Join(rootPath, "test.git")
+	if output, err := exec.Command("git", "-C", absRepoPath, "update-server-info").CombinedOutput(); err != nil {
+		t.Errorf("execute command error: %s %s", err.Error(), output)
+		return
+	}
+	expected, _ := ioutil.ReadFile(path.Join(absRepoPath, "info", "refs"))
+	os.Remove(path.Join(absRepoPath, "info", "refs"))
+
+	if err := New(rootPath).UpdateServerInfo(newContext("test.git")); err != nil {
+		t.Errorf("UpdateServerInfo error: %s", err.Error())
+		return
+	}
+
+	result, err := ioutil.ReadFile(path.Join(absRepoPath, "info", "refs"))
+	if err != nil {
+		t.Errorf("info/refs is not written. error: %s", err.Error())
+		return
+	}
+	if string(result) != string(expected) {
+		t.Errorf("info/refs is not %s . result: %s", expected, result)
+	}
+}
+
+func Test_it_should_refuse_the_wants_that_are_not_served(t *testing.T) {
+
+	rootPath, ok := setupRepository(t)
+	if !ok {
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	absRepoPath := path.Join(rootPath, "test.git")
+	git := func(args ...string) string {
+		output, err := exec.Command("git", append([]string{"-C", absRepoPath, "-c", "user.name=John Smith", "-c", "user.email=js@example.com"}, args...)...).Output()
+		if err != nil {
+			t.Errorf("execute command error: %s", err.Error())
+		}
+		return strings.TrimSpace(string(output))
+	}
+	master := git("rev-parse", "refs/heads/master")
+	dangling := git("commit-tree", "refs/heads/master^{tree}", "-m", "dangling")
+
+	tests := []struct {
+		description string
+		req         *githttpxfer.UploadPackRequest
+		expected    string
+		err         bool
+	}{
+		{
+			description: "it should serve the want of the ref",
+			req:         &githttpxfer.UploadPackRequest{Wants: []string{master}, Done: true},
+			expected:    "NAK",
+		},
+		{
+			description: "it should refuse the want that is not reachable from the refs",
+			req:         &githttpxfer.UploadPackRequest{Wants: []string{dangling}, Done: true},
+			expected:    "ERR upload-pack: not our ref " + dangling,
+			err:         true,
+		},
+		{
+			description: "it should refuse the filter",
+			req:         &githttpxfer.UploadPackRequest{Wants: []string{master}, Filter: "blob:none", Done: true},
+			expected:    "ERR upload-pack: filtering capability not negotiated",
+			err:         true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		ctx := newContext("test.git")
+		ctx.SetUploadPackRequest(tc.req)
+		buf := &bytes.Buffer{}
+		err := New(rootPath).UploadPack(ctx, strings.NewReader(""), buf)
+		if (err != nil) != tc.err {
+			t.Errorf("error is not %t . result: %v", tc.err, err)
+		}
+		if !strings.Contains(buf.String(), tc.expected) {
+			t.Errorf("response does not contain %s . result: %q", tc.expected, buf.String())
+		}
+		if tc.err && strings.Contains(buf.String(), "PACK") {
+			t.Errorf("the pack is sent. result: %q", buf.String())
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package gogit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/nulab/go-git-http-xfer/githttpxfer"
+	"github.com/nulab/go-git-http-xfer/pktline"
+)
+
+// unpackLimit is the same as the default of "receive.unpackLimit".
+// The smaller packfile is stored as the loose objects.
+const unpackLimit = 100
+
+var errRefChanged = errors.New("failed to lock")
+
+// ReceivePack stores the packfile and updates the refs of the commands parsed by githttpxfer.
+// The ref is updated only if it still points to the old object.
+func (b *Backend) ReceivePack(ctx githttpxfer.Context, r io.Reader, w io.Writer) error {
+	req := ctx.ReceivePackRequest()
+	if req == nil {
+		return errors.New("the commands of receive-pack are not parsed")
+	}
+
+	// Skip the commands and the push options that precede the packfile.
+	pr := pktline.NewReader(r)
+	if err := skipUntilFlush(pr); err != nil {
+		return err
+	}
+	commands := []*githttpxfer.RefUpdateCommand{}
+	for _, c := range req.Commands {
+		if _, rejected := c.Rejected(); !rejected {
+			commands = append(commands, c)
+		}
+	}
+	if len(commands) > 0 && req.HasCapability("push-options") {
+		if err := skipUntilFlush(pr); err != nil {
+			return err
+		}
+	}
+
+	s, err := b.storage(ctx.RepoPath())
+	if err != nil {
+		return err
+	}
+	unpackErr := unpack(s, r)
+
+	statuses := make([]error, len(commands))
+	for i, c := range commands {
+		if unpackErr != nil {
+			statuses[i] = errors.New("unpacker error")
+			continue
+		}
+		statuses[i] = updateReference(s, c)
+	}
+
+	if !req.HasCapability("report-status") {
+		return unpackErr
+	}
+
+	pw := pktline.NewWriter(w)
+	if unpackErr != nil {
+		pw.WriteLine("unpack " + unpackErr.Error())
+	} else {
+		pw.WriteLine("unpack ok")
+	}
+	for i, c := range commands {
+		if statuses[i] != nil {
+			pw.WriteLine("ng " + c.RefName + " " + statuses[i].Error())
+		} else {
+			pw.WriteLine("ok " + c.RefName)
+		}
+	}
+	return pw.WriteFlush()
+}
+
+func skipUntilFlush(r *pktline.Reader) error {
+	for {
+		t, _, err := r.ReadPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if t == pktline.Flush {
+			return nil
+		}
+	}
+}
+
+// looseStorer hides storer.PackfileWriter, so that the objects are stored one by one.
+type looseStorer struct {
+	storer.Storer
+}
+
+func unpack(s storer.Storer, r io.Reader) error {
+	header := make([]byte, 12)
+	n, err := io.ReadFull(r, header)
+	if n == 0 && err == io.EOF {
+		// Only deletions are pushed.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(header[:4], []byte("PACK")) {
+		return packfile.ErrBadSignature
+	}
+
+	pack := io.MultiReader(bytes.NewReader(header), r)
+	if binary.BigEndian.Uint32(header[8:]) < unpackLimit {
+		return packfile.UpdateObjectStorage(looseStorer{s}, pack)
+	}
+	return packfile.UpdateObjectStorage(s, pack)
+}
+
+func updateReference(s storer.Storer, c *githttpxfer.RefUpdateCommand) error {
+	name := plumbing.ReferenceName(c.RefName)
+	current, err := s.Reference(name)
+	if err != nil && err != plumbing.ErrReferenceNotFound {
+		return err
+	}
+
+	if c.IsDelete() {
+		if current == nil || current.Hash().String() != c.OldID {
+			return errRefChanged
+		}
+		return s.RemoveReference(name)
+	}
+
+	newID := plumbing.NewHash(c.NewID)
+	if err := s.HasEncodedObject(newID); err != nil {
+		return errors.New("missing necessary objects")
+	}
+	ref := plumbing.NewHashReference(name, newID)
+
+	if c.IsCreate() {
+		if current != nil {
+			return errRefChanged
+		}
+		return s.SetReference(ref)
+	}
+	if current == nil || current.Hash().String() != c.OldID {
+		return errRefChanged
+	}
+	return s.CheckAndSetReference(ref, current)
+}
@@ -0,0 +1,78 @@
+package gogit
+
+import (
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/nulab/go-git-http-xfer/githttpxfer"
+)
+
+const zeroID = "0000000000000000000000000000000000000000"
+
+func Test_updateReference_should_check_the_old_id(t *testing.T) {
+
+	s := memory.NewStorage()
+	blob := s.NewEncodedObject()
+	blob.SetType(plumbing.BlobObject)
+	oldHash, _ := s.SetEncodedObject(blob)
+
+	tag := &object.Tag{Name: "v1", Target: oldHash, TargetType: plumbing.BlobObject}
+	o := s.NewEncodedObject()
+	tag.Encode(o)
+	newHash, _ := s.SetEncodedObject(o)
+
+	s.SetReference(plumbing.NewHashReference("refs/heads/master", oldHash))
+
+	tests := []struct {
+		description string
+		command     *githttpxfer.RefUpdateCommand
+		expected    string
+		fail        bool
+	}{
+		{
+			description: "it should not update the ref that has been changed",
+			command:     &githttpxfer.RefUpdateCommand{OldID: newHash.String(), NewID: oldHash.String(), RefName: "refs/heads/master"},
+			expected:    oldHash.String(),
+			fail:        true,
+		},
+		{
+			description: "it should not create the ref that exists",
+			command:     &githttpxfer.RefUpdateCommand{OldID: zeroID, NewID: newHash.String(), RefName: "refs/heads/master"},
+			expected:    oldHash.String(),
+			fail:        true,
+		},
+		{
+			description: "it should not update the ref to the missing object",
+			command:     &githttpxfer.RefUpdateCommand{OldID: oldHash.String(), NewID: "1111111111111111111111111111111111111111", RefName: "refs/heads/master"},
+			expected:    oldHash.String(),
+			fail:        true,
+		},
+		{
+			description: "it should update the ref",
+			command:     &githttpxfer.RefUpdateCommand{OldID: oldHash.String(), NewID: newHash.String(), RefName: "refs/heads/master"},
+			expected:    newHash.String(),
+		},
+		{
+			description: "it should delete the ref",
+			command:     &githttpxfer.RefUpdateCommand{OldID: newHash.String(), NewID: zeroID, RefName: "refs/heads/master"},
+			expected:    "",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		err := updateReference(s, tc.command)
+		if (err != nil) != tc.fail {
+			t.Errorf("error is not expected. result: %v", err)
+		}
+		result := ""
+		if ref, err := s.Reference("refs/heads/master"); err == nil {
+			result = ref.Hash().String()
+		}
+		if result != tc.expected {
+			t.Errorf("refs/heads/master is not %s . result: %s", tc.expected, result)
+		}
+	}
+}
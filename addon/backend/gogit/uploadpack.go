@@ -0,0 +1,340 @@
+package gogit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/revlist"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/nulab/go-git-http-xfer/githttpxfer"
+	"github.com/nulab/go-git-http-xfer/pktline"
+)
+
+// UploadPack answers the negotiation parsed by githttpxfer without multi_ack,
+// and sends the packfile without side-band once the client is done.
+// The wants must be reachable from the refs, and the filter of the partial clone is not supported,
+// so they are refused with the ERR packet like git does.
+func (b *Backend) UploadPack(ctx githttpxfer.Context, r io.Reader, w io.Writer) error {
+	req := ctx.UploadPackRequest()
+	if req == nil {
+		return errors.New("the negotiation of upload-pack is not parsed")
+	}
+	if req.IsProtocolV2() {
+		return errors.New("the protocol v2 is not supported")
+	}
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return err
+	}
+
+	s, err := b.storage(ctx.RepoPath())
+	if err != nil {
+		return err
+	}
+	pw := pktline.NewWriter(w)
+	wants := toHashes(req.Wants)
+
+	if req.Filter != "" {
+		pw.WriteError("upload-pack: filtering capability not negotiated")
+		return errors.New("the filter is not supported")
+	}
+	if unreachable, err := firstUnreachable(s, wants); err != nil {
+		return err
+	} else if unreachable != plumbing.ZeroHash {
+		pw.WriteError("upload-pack: not our ref " + unreachable.String())
+		return fmt.Errorf("the want is not reachable from the refs: %s", unreachable)
+	}
+
+	var shallowCommits []*object.Commit
+	if req.Depth > 0 || len(req.Shallows) > 0 {
+		if req.Depth > 0 {
+			commits, boundary, err := shallowHistory(s, wants, req.Depth)
+			if err != nil {
+				return err
+			}
+			shallowCommits = commits
+			if err := writeShallowInfo(pw, boundary, toHashes(req.Shallows)); err != nil {
+				return err
+			}
+		}
+		if err := pw.WriteFlush(); err != nil {
+			return err
+		}
+	}
+
+	commons := []plumbing.Hash{}
+	for _, have := range toHashes(req.Haves) {
+		if s.HasEncodedObject(have) == nil {
+			commons = append(commons, have)
+		}
+	}
+	if len(commons) > 0 {
+		if err := pw.WriteLine("ACK " + commons[0].String()); err != nil {
+			return err
+		}
+	}
+
+	if !req.Done {
+		if len(req.Haves) > 0 && len(commons) == 0 {
+			return pw.WriteLine("NAK")
+		}
+		return nil
+	}
+	if len(commons) == 0 {
+		if err := pw.WriteLine("NAK"); err != nil {
+			return err
+		}
+	}
+	if len(wants) == 0 {
+		return nil
+	}
+
+	ignore, err := revlist.Objects(s, commons, nil)
+	if err != nil {
+		return err
+	}
+
+	var objects []plumbing.Hash
+	if shallowCommits != nil {
+		objects, err = shallowObjects(s, wants, shallowCommits, ignore)
+	} else {
+		objects, err = revlist.Objects(s, wants, ignore)
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = packfile.NewEncoder(w, s, false).Encode(objects, 10)
+	return err
+}
+
+// firstUnreachable returns the first of wants that is neither the ref nor reachable from the refs,
+// or ZeroHash if all of them are. The commits are walked as git does for the stateless upload-pack.
+func firstUnreachable(s storer.Storer, wants []plumbing.Hash) (plumbing.Hash, error) {
+	iter, err := s.IterReferences()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	tips := map[plumbing.Hash]bool{}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		tips[ref.Hash()] = true
+		if tag, err := object.GetTag(s, ref.Hash()); err == nil {
+			tips[tag.Target] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	rest := []plumbing.Hash{}
+	for _, want := range wants {
+		if !tips[want] {
+			rest = append(rest, want)
+		}
+	}
+	if len(rest) == 0 {
+		return plumbing.ZeroHash, nil
+	}
+
+	reachable := map[plumbing.Hash]bool{}
+	queue := []plumbing.Hash{}
+	for h := range tips {
+		if c, err := peelToCommit(s, h); err == nil && c != nil && !reachable[c.Hash] {
+			reachable[c.Hash] = true
+			queue = append(queue, c.Hash)
+		}
+	}
+	for len(queue) > 0 {
+		c, err := object.GetCommit(s, queue[0])
+		queue = queue[1:]
+		if err == plumbing.ErrObjectNotFound {
+			// The parent of the shallow commit is missing.
+			continue
+		}
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		for _, parent := range c.ParentHashes {
+			if !reachable[parent] {
+				reachable[parent] = true
+				queue = append(queue, parent)
+			}
+		}
+	}
+	for _, want := range rest {
+		if !reachable[want] {
+			return want, nil
+		}
+	}
+	return plumbing.ZeroHash, nil
+}
+
+func toHashes(ids []string) []plumbing.Hash {
+	hashes := make([]plumbing.Hash, 0, len(ids))
+	for _, id := range ids {
+		hashes = append(hashes, plumbing.NewHash(id))
+	}
+	return hashes
+}
+
+// shallowHistory returns the commits within depth from wants,
+// and the boundary commits whose parents are cut off.
+func shallowHistory(s storer.EncodedObjectStorer, wants []plumbing.Hash, depth int) ([]*object.Commit, []plumbing.Hash, error) {
+	visited := map[plumbing.Hash]bool{}
+	commits := []*object.Commit{}
+	boundary := []plumbing.Hash{}
+
+	level := []plumbing.Hash{}
+	for _, want := range wants {
+		commit, err := peelToCommit(s, want)
+		if err != nil {
+			return nil, nil, err
+		}
+		if commit != nil {
+			level = append(level, commit.Hash)
+		}
+	}
+
+	for d := 1; d <= depth && len(level) > 0; d++ {
+		next := []plumbing.Hash{}
+		for _, h := range level {
+			if visited[h] {
+				continue
+			}
+			visited[h] = true
+			commit, err := object.GetCommit(s, h)
+			if err != nil {
+				return nil, nil, err
+			}
+			commits = append(commits, commit)
+			if d == depth {
+				if commit.NumParents() > 0 {
+					boundary = append(boundary, h)
+				}
+				continue
+			}
+			next = append(next, commit.ParentHashes...)
+		}
+		level = next
+	}
+	return commits, boundary, nil
+}
+
+// peelToCommit returns the commit that the object points to, or nil if it is not a commit.
+func peelToCommit(s storer.EncodedObjectStorer, h plumbing.Hash) (*object.Commit, error) {
+	for {
+		o, err := s.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return nil, err
+		}
+		switch o.Type() {
+		case plumbing.CommitObject:
+			return object.DecodeCommit(s, o)
+		case plumbing.TagObject:
+			tag, err := object.DecodeTag(s, o)
+			if err != nil {
+				return nil, err
+			}
+			h = tag.Target
+		default:
+			return nil, nil
+		}
+	}
+}
+
+func writeShallowInfo(pw *pktline.Writer, boundary []plumbing.Hash, clientShallows []plumbing.Hash) error {
+	isBoundary := map[plumbing.Hash]bool{}
+	for _, h := range boundary {
+		isBoundary[h] = true
+	}
+	isClientShallow := map[plumbing.Hash]bool{}
+	for _, h := range clientShallows {
+		isClientShallow[h] = true
+	}
+
+	for _, h := range boundary {
+		if !isClientShallow[h] {
+			if err := pw.WriteLine("shallow " + h.String()); err != nil {
+				return err
+			}
+		}
+	}
+	for _, h := range clientShallows {
+		if !isBoundary[h] {
+			if err := pw.WriteLine("unshallow " + h.String()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// shallowObjects returns the objects of the commits and the tags of wants, except for ignore.
+func shallowObjects(s storer.EncodedObjectStorer, wants []plumbing.Hash, commits []*object.Commit, ignore []plumbing.Hash) ([]plumbing.Hash, error) {
+	seen := map[plumbing.Hash]bool{}
+	for _, h := range ignore {
+		seen[h] = true
+	}
+	objects := []plumbing.Hash{}
+	add := func(h plumbing.Hash) bool {
+		if seen[h] {
+			return false
+		}
+		seen[h] = true
+		objects = append(objects, h)
+		return true
+	}
+
+	for _, want := range wants {
+		for {
+			tag, err := object.GetTag(s, want)
+			if err != nil {
+				break
+			}
+			add(want)
+			want = tag.Target
+		}
+	}
+
+	for _, commit := range commits {
+		if !add(commit.Hash) {
+			continue
+		}
+		if err := addTree(s, commit.TreeHash, add); err != nil {
+			return nil, err
+		}
+	}
+	return objects, nil
+}
+
+func addTree(s storer.EncodedObjectStorer, h plumbing.Hash, add func(plumbing.Hash) bool) error {
+	if !add(h) {
+		return nil
+	}
+	tree, err := object.GetTree(s, h)
+	if err != nil {
+		return err
+	}
+	for _, e := range tree.Entries {
+		switch e.Mode {
+		case filemode.Submodule:
+			continue
+		case filemode.Dir:
+			if err := addTree(s, e.Hash, add); err != nil {
+				return err
+			}
+		default:
+			add(e.Hash)
+		}
+	}
+	return nil
+}
@@ -1,7 +1,9 @@
 package archive
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"path"
 	"regexp"
@@ -22,11 +24,17 @@ var (
 		suffix := m[1]
 		repoPath := strings.Replace(u.Path, suffix, "", 1)
 		filePath := strings.Replace(u.Path, repoPath+"/", "", 1)
-		return &githttpxfer.Match{repoPath, filePath}
+		return &githttpxfer.Match{RepoPath: repoPath, FilePath: filePath}
 	}
 	Method = http.MethodGet
 )
 
+// The events of the archive requests. AfterArchive has Context.Result.
+const (
+	BeforeArchive githttpxfer.EventKey = "before-archive"
+	AfterArchive  githttpxfer.EventKey = "after-archive"
+)
+
 func New(ghx *githttpxfer.GitHTTPXfer) *gitHTTPXfer {
 	return &gitHTTPXfer{ghx}
 }
@@ -45,31 +53,65 @@ func (ghx *gitHTTPXfer) Archive(ctx githttpxfer.Context) {
 	ext := path.Ext(fileName)
 	format := strings.Replace(ext, ".", "", 1)
 
-	args := []string{"archive", "--format=" + format, "--prefix=" + repoName + "-" + tree + "/", tree}
-	cmd := ghx.Git.GitCommand(repoPath, args...)
-	cmd.Env = ctx.Env()
-
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		githttpxfer.RenderInternalServerError(res.Writer)
+	if !ghx.Emit(BeforeArchive, ctx) {
 		return
 	}
-	defer stdout.Close()
 
-	if err := cmd.Start(); err != nil {
-		githttpxfer.RenderInternalServerError(res.Writer)
+	release, ok := ghx.Admit(ctx, "archive")
+	if !ok {
 		return
 	}
+	defer release()
 
-	res.SetContentType("application/octet-stream")
-	res.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, fileName))
-	res.Header().Add("Content-Transfer-Encoding", "binary")
-
-	if _, err := res.Copy(stdout); err != nil {
+	args := []string{"archive", "--format=" + format, "--prefix=" + repoName + "-" + tree + "/", tree}
+	cmd, err := ghx.Git.GitCommand(repoPath, args...)
+	if err != nil {
+		ctx.Logger().Error("failed to create the command of archive", "error", err)
+		ghx.ReportError(ctx, githttpxfer.ErrorKindService, err)
 		githttpxfer.RenderInternalServerError(res.Writer)
 		return
 	}
-	if err := cmd.Wait(); err != nil {
-		githttpxfer.RenderInternalServerError(res.Writer)
+	cmd.Env = ctx.Env()
+	stderr := &githttpxfer.StderrExcerpt{}
+	cmd.Stderr = stderr
+
+	spanCtx, end := ghx.StartSpan(ctx, "githttpxfer.GitCommand", githttpxfer.Attribute{Key: githttpxfer.AttributeGitSubcommand, Value: "archive"})
+	w := &attachmentWriter{res: res, fileName: fileName}
+	err = ghx.RunService(ctx, "archive", nil, res.Writer, func(_ io.Reader, out io.Writer) error {
+		w.w = out
+		return ghx.Git.RunCommand(spanCtx, "archive", cmd, w)
+	})
+	ctx.Result().Stderr = stderr.String()
+	end(err)
+	defer ghx.Notify(AfterArchive, ctx)
+	if err != nil {
+		kind := githttpxfer.ErrorKindService
+		var timeoutErr *githttpxfer.TimeoutError
+		if errors.As(err, &timeoutErr) {
+			kind = githttpxfer.ErrorKindTimeout
+		}
+		ghx.ReportError(ctx, kind, err)
+		if !w.wrote {
+			githttpxfer.RenderInternalServerError(res.Writer)
+		}
+	}
+}
+
+// attachmentWriter sets the headers of the attachment before the first output,
+// so that the failure of git before the output is rendered without them.
+type attachmentWriter struct {
+	w        io.Writer
+	res      *githttpxfer.Response
+	fileName string
+	wrote    bool
+}
+
+func (a *attachmentWriter) Write(p []byte) (int, error) {
+	if !a.wrote {
+		a.wrote = true
+		a.res.SetContentType("application/octet-stream")
+		a.res.Header().Add("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, a.fileName))
+		a.res.Header().Add("Content-Transfer-Encoding", "binary")
 	}
+	return a.w.Write(p)
 }
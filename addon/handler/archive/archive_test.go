@@ -1,12 +1,15 @@
 package archive
 
 import (
-	"io/ioutil"
+	"errors"
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/nulab/go-git-http-xfer/githttpxfer"
 )
@@ -18,7 +21,15 @@ func Test_it_should_download_archive_repository(t *testing.T) {
 		return
 	}
 
-	ghx, err := githttpxfer.New("/data/git", "/usr/bin/git")
+	var mu sync.Mutex
+	subcommands := map[string]bool{}
+	factory := githttpxfer.DefaultCommandFactory("/usr/bin/git")
+	ghx, err := githttpxfer.New(t.TempDir(), "/usr/bin/git", githttpxfer.WithCommandFactory(func(absRepoPath, subcommand string, args ...string) *exec.Cmd {
+		mu.Lock()
+		defer mu.Unlock()
+		subcommands[subcommand] = true
+		return factory(absRepoPath, subcommand, args...)
+	}))
 	if err != nil {
 		t.Errorf("An instance could not be created. %s", err.Error())
 		return
@@ -30,6 +41,18 @@ func Test_it_should_download_archive_repository(t *testing.T) {
 		New(ghx).Archive,
 	))
 
+	var results []*githttpxfer.Result
+	ghx.Event.On(BeforeArchive, func(ctx githttpxfer.Context) {
+		if ctx.FilePath() == "archive/forbidden.zip" {
+			ctx.Reject("not allowed")
+		}
+	})
+	ghx.Event.On(AfterArchive, func(ctx githttpxfer.Context) {
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, ctx.Result())
+	})
+
 	ts := httptest.NewServer(ghx)
 	if ts == nil {
 		t.Error("test server is nil.")
@@ -37,7 +60,7 @@ func Test_it_should_download_archive_repository(t *testing.T) {
 	defer ts.Close()
 
 	repoName := "archive_test.git"
-	absRepoPath := ghx.Git.GetAbsolutePath(repoName)
+	absRepoPath, _ := ghx.Git.GetAbsolutePath(repoName)
 	os.Mkdir(absRepoPath, os.ModeDir)
 
 	if _, err := execCmd(absRepoPath, "git", "init", "--bare", "--shared"); err != nil {
@@ -47,9 +70,7 @@ func Test_it_should_download_archive_repository(t *testing.T) {
 
 	remoteRepoUrl := ts.URL + "/" + repoName
 
-	tempDir, _ := ioutil.TempDir("", "git-http-xfer")
-	dir := "archive_test"
-	destDir := path.Join(tempDir, dir)
+	destDir := path.Join(t.TempDir(), "archive_test")
 
 	if _, err := execCmd("", "git", "clone", remoteRepoUrl, destDir); err != nil {
 		t.Errorf("execute command error: %s", err.Error())
@@ -96,6 +117,82 @@ func Test_it_should_download_archive_repository(t *testing.T) {
 		return
 	}
 
+	if _, err := execCmd(destDir, "wget", "-O-", remoteRepoUrl+"/archive/forbidden.zip"); err == nil {
+		t.Error("the archive rejected by BeforeArchive is downloaded.")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !subcommands["archive"] {
+		t.Errorf("archive is not run by the command factory. result: %v", subcommands)
+	}
+	if len(results) != 2 {
+		t.Errorf("AfterArchive is not emitted 2 times. result: %d", len(results))
+		return
+	}
+	for _, result := range results {
+		if result.Service != "archive" || result.ExitCode != 0 || result.BytesOut == 0 {
+			t.Errorf("the result of the archive is not valid. result: %+v", result)
+		}
+	}
+
+}
+
+func Test_it_should_stop_archive_by_the_timeouts(t *testing.T) {
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Log("git is not found. so skip git archive test.")
+		return
+	}
+
+	gitRootPath := t.TempDir()
+	if _, err := execCmd(gitRootPath, "git", "init", "--bare", "foo.git"); err != nil {
+		t.Errorf("execute command error: %s", err.Error())
+		return
+	}
+
+	// The command ignores SIGTERM and never writes, like a hung git.
+	hanging := func(absRepoPath, subcommand string, args ...string) *exec.Cmd {
+		return exec.Command("sh", "-c", "trap '' TERM; sleep 30")
+	}
+	ghx, err := githttpxfer.New(gitRootPath, "/usr/bin/git",
+		githttpxfer.WithCommandFactory(hanging),
+		githttpxfer.WithTimeouts(githttpxfer.ServiceTimeouts{
+			Archive:   githttpxfer.Timeouts{Idle: 200 * time.Millisecond},
+			KillGrace: 100 * time.Millisecond,
+		}),
+	)
+	if err != nil {
+		t.Errorf("An instance could not be created. %s", err.Error())
+		return
+	}
+	ghx.Router.Add(githttpxfer.NewRoute(
+		Method,
+		Pattern,
+		New(ghx).Archive,
+	))
+
+	var result *githttpxfer.Result
+	ghx.Event.On(AfterArchive, func(ctx githttpxfer.Context) {
+		result = ctx.Result()
+	})
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	ghx.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/foo.git/archive/master.zip", nil))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the process is not killed after the grace period. elapsed: %s", elapsed)
+	}
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status code is not %d . result: %d", http.StatusInternalServerError, w.Code)
+	}
+	if w.Header().Get("Content-Disposition") != "" {
+		t.Errorf("Content-Disposition is not empty . result: %s", w.Header().Get("Content-Disposition"))
+	}
+	var timeoutErr *githttpxfer.TimeoutError
+	if result == nil || result.ErrorKind != githttpxfer.ErrorKindTimeout || !errors.As(result.Err, &timeoutErr) || !timeoutErr.Idle {
+		t.Errorf("the result is not the idle timeout of archive. result: %+v", result)
+	}
 }
 
 func execCmd(dir string, name string, arg ...string) ([]byte, error) {
@@ -0,0 +1,135 @@
+package lfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+
+	"github.com/nulab/go-git-http-xfer/githttpxfer"
+)
+
+var (
+	ErrObjectNotFound = errors.New("object does not exist")
+	ErrHashMismatch   = errors.New("content does not match the oid")
+	ErrSizeMismatch   = errors.New("content does not match the size")
+
+	oidRegexp = regexp.MustCompile("^[0-9a-f]{64}$")
+)
+
+// ContentStore stores the LFS objects of the repositories.
+type ContentStore interface {
+	// Size returns the size of the object, or ErrObjectNotFound.
+	Size(repoPath, oid string) (int64, error)
+	// Get returns the content of the object, or ErrObjectNotFound.
+	Get(repoPath, oid string) (io.ReadCloser, error)
+	// Put stores the content of the object. The content must match oid and size.
+	// size is negative if it is not known.
+	Put(repoPath, oid string, size int64, r io.Reader) error
+}
+
+func isValidOid(oid string) bool {
+	return oidRegexp.MatchString(oid)
+}
+
+// NewLocalContentStore returns the store that keeps the objects in "<rootPath>/<repoPath>/lfs/objects".
+// It is in the bare repository if rootPath is the root of the repositories.
+func NewLocalContentStore(rootPath string) *LocalContentStore {
+	return NewLocalContentStoreWithResolver(githttpxfer.NewRootResolver(rootPath))
+}
+
+// NewLocalContentStoreWithResolver returns the store that keeps the objects in "lfs/objects" of the repository that the resolver locates.
+func NewLocalContentStoreWithResolver(resolver githttpxfer.RepoResolver) *LocalContentStore {
+	return &LocalContentStore{resolver}
+}
+
+type LocalContentStore struct {
+	resolver githttpxfer.RepoResolver
+}
+
+func (s *LocalContentStore) objectPath(repoPath, oid string) (string, error) {
+	absRepoPath, err := s.resolver.Resolve(repoPath)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(absRepoPath, "lfs", "objects", oid[0:2], oid[2:4], oid), nil
+}
+
+func (s *LocalContentStore) Size(repoPath, oid string) (int64, error) {
+	if !isValidOid(oid) {
+		return 0, ErrObjectNotFound
+	}
+	objectPath, err := s.objectPath(repoPath, oid)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(objectPath)
+	if os.IsNotExist(err) {
+		return 0, ErrObjectNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *LocalContentStore) Get(repoPath, oid string) (io.ReadCloser, error) {
+	if !isValidOid(oid) {
+		return nil, ErrObjectNotFound
+	}
+	objectPath, err := s.objectPath(repoPath, oid)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(objectPath)
+	if os.IsNotExist(err) {
+		return nil, ErrObjectNotFound
+	}
+	return f, err
+}
+
+// Put streams the content to a temporary file while hashing it with sha256,
+// and moves the file to the object only if it matches.
+func (s *LocalContentStore) Put(repoPath, oid string, size int64, r io.Reader) error {
+	if !isValidOid(oid) {
+		return fmt.Errorf("invalid oid: %s", oid)
+	}
+	objectPath, err := s.objectPath(repoPath, oid)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(objectPath), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(path.Dir(objectPath), oid+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if size >= 0 && written != size {
+		return ErrSizeMismatch
+	}
+	if hex.EncodeToString(h.Sum(nil)) != oid {
+		return ErrHashMismatch
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), objectPath)
+}
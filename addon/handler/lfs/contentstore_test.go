@@ -0,0 +1,142 @@
+package lfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func oidOfContent(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func Test_LocalContentStore_should_put_and_get_object(t *testing.T) {
+
+	rootPath, err := ioutil.TempDir("", "lfs")
+	if err != nil {
+		t.Errorf("Create Temp Dir error: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	store := NewLocalContentStore(rootPath)
+	content := "large content"
+	oid := oidOfContent(content)
+
+	if _, err := store.Size("/foo.git", oid); err != ErrObjectNotFound {
+		t.Errorf("error is not %s . result: %v", ErrObjectNotFound, err)
+	}
+
+	if err := store.Put("/foo.git", oid, int64(len(content)), strings.NewReader(content)); err != nil {
+		t.Errorf("Put error: %s", err.Error())
+		return
+	}
+
+	if size, err := store.Size("/foo.git", oid); err != nil || size != int64(len(content)) {
+		t.Errorf("size is not %d . result: %d, error: %v", len(content), size, err)
+	}
+
+	r, err := store.Get("/foo.git", oid)
+	if err != nil {
+		t.Errorf("Get error: %s", err.Error())
+		return
+	}
+	defer r.Close()
+	if result, _ := ioutil.ReadAll(r); string(result) != content {
+		t.Errorf("content is not %s . result: %s", content, result)
+	}
+
+	if _, err := store.Size("/bar.git", oid); err != ErrObjectNotFound {
+		t.Errorf("the object of another repository is found. error: %v", err)
+	}
+}
+
+func Test_LocalContentStore_should_verify_object(t *testing.T) {
+
+	rootPath, err := ioutil.TempDir("", "lfs")
+	if err != nil {
+		t.Errorf("Create Temp Dir error: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	store := NewLocalContentStore(rootPath)
+	content := "large content"
+	oid := oidOfContent(content)
+
+	tests := []struct {
+		description string
+		oid         string
+		size        int64
+		content     string
+		expected    error
+	}{
+		{
+			description: "it should reject the content that does not match the oid",
+			oid:         oid,
+			size:        -1,
+			content:     "another content",
+			expected:    ErrHashMismatch,
+		},
+		{
+			description: "it should reject the content that does not match the size",
+			oid:         oid,
+			size:        1,
+			content:     content,
+			expected:    ErrSizeMismatch,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		if err := store.Put("/foo.git", tc.oid, tc.size, strings.NewReader(tc.content)); err != tc.expected {
+			t.Errorf("error is not %s . result: %v", tc.expected, err)
+		}
+		if _, err := store.Size("/foo.git", tc.oid); err != ErrObjectNotFound {
+			t.Errorf("the invalid content is stored. error: %v", err)
+		}
+	}
+
+	if err := store.Put("/foo.git", "../../../etc/passwd", -1, strings.NewReader(content)); err == nil {
+		t.Error("the invalid oid is accepted.")
+	}
+}
+
+func Test_LocalContentStore_should_not_put_object_outside_root(t *testing.T) {
+
+	rootPath, err := ioutil.TempDir("", "lfs")
+	if err != nil {
+		t.Errorf("Create Temp Dir error: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	store := NewLocalContentStore(rootPath + "/root")
+	content := "large content"
+	oid := oidOfContent(content)
+
+	tests := []struct {
+		description string
+		repoPath    string
+	}{
+		{description: "it should refuse the traversal", repoPath: "/../outside.git"},
+		{description: "it should refuse the root", repoPath: "/"},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		if err := store.Put(tc.repoPath, oid, int64(len(content)), strings.NewReader(content)); err == nil {
+			t.Error("the object is put outside the root.")
+		}
+		if _, err := store.Size(tc.repoPath, oid); err == nil || err == ErrObjectNotFound {
+			t.Errorf("the repository path is not refused. error: %v", err)
+		}
+	}
+	if _, err := os.Stat(rootPath + "/outside.git"); !os.IsNotExist(err) {
+		t.Error("the directory is created outside the root.")
+	}
+}
@@ -0,0 +1,264 @@
+package lfs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/nulab/go-git-http-xfer/githttpxfer"
+)
+
+const contentType = "application/vnd.git-lfs+json"
+
+var (
+	BatchPattern = func(u *url.URL) *githttpxfer.Match {
+		return matchSuffix(u.Path, "/info/lfs/objects/batch")
+	}
+	objectRegexp  = regexp.MustCompile(".*?(/info/lfs/objects/[0-9a-f]{64})$")
+	ObjectPattern = func(u *url.URL) *githttpxfer.Match {
+		m := objectRegexp.FindStringSubmatch(u.Path)
+		if m == nil {
+			return nil
+		}
+		return matchSuffix(u.Path, m[1])
+	}
+	VerifyPattern = func(u *url.URL) *githttpxfer.Match {
+		return matchSuffix(u.Path, "/info/lfs/verify")
+	}
+)
+
+func matchSuffix(path, suffix string) *githttpxfer.Match {
+	if !strings.HasSuffix(path, suffix) {
+		return nil
+	}
+	repoPath := strings.TrimSuffix(path, suffix)
+	filePath := strings.Replace(path, repoPath+"/", "", 1)
+	return &githttpxfer.Match{RepoPath: repoPath, FilePath: filePath}
+}
+
+// New returns the handlers of the Git LFS batch API and the basic transfer.
+// The objects are uploaded only if receive-pack is enabled, and downloaded only if upload-pack is enabled.
+func New(ghx *githttpxfer.GitHTTPXfer, store ContentStore) *gitHTTPXfer {
+	return &gitHTTPXfer{ghx, store}
+}
+
+type gitHTTPXfer struct {
+	*githttpxfer.GitHTTPXfer
+	store ContentStore
+}
+
+// AddRoutes adds the routes of the batch API and the basic transfer to the router.
+func (ghx *gitHTTPXfer) AddRoutes() {
+	ghx.Router.Add(githttpxfer.NewRoute(http.MethodPost, BatchPattern, ghx.Batch))
+	ghx.Router.Add(githttpxfer.NewRoute(http.MethodGet, ObjectPattern, ghx.Download))
+	ghx.Router.Add(githttpxfer.NewRoute(http.MethodPut, ObjectPattern, ghx.Upload))
+	ghx.Router.Add(githttpxfer.NewRoute(http.MethodPost, VerifyPattern, ghx.Verify))
+}
+
+type batchRequest struct {
+	Operation string       `json:"operation"`
+	Transfers []string     `json:"transfers,omitempty"`
+	Objects   []*lfsObject `json:"objects"`
+	HashAlgo  string       `json:"hash_algo,omitempty"`
+}
+
+type lfsObject struct {
+	Oid  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+type batchResponse struct {
+	Transfer string            `json:"transfer"`
+	Objects  []*objectResponse `json:"objects"`
+	HashAlgo string            `json:"hash_algo"`
+}
+
+type objectResponse struct {
+	Oid           string             `json:"oid"`
+	Size          int64              `json:"size"`
+	Authenticated bool               `json:"authenticated,omitempty"`
+	Actions       map[string]*action `json:"actions,omitempty"`
+	Error         *objectError       `json:"error,omitempty"`
+}
+
+type action struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type objectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (ghx *gitHTTPXfer) Batch(ctx githttpxfer.Context) {
+	res, req := ctx.Response(), ctx.Request()
+
+	br := &batchRequest{}
+	if err := json.NewDecoder(req.Body).Decode(br); err != nil {
+		renderError(res, http.StatusUnprocessableEntity, "invalid batch request")
+		return
+	}
+
+	rpc := ""
+	switch br.Operation {
+	case "download":
+		rpc = "upload-pack"
+	case "upload":
+		rpc = "receive-pack"
+	default:
+		renderError(res, http.StatusUnprocessableEntity, "unknown operation: "+br.Operation)
+		return
+	}
+	if !ghx.Git.HasAccess(req, rpc, false) {
+		renderError(res, http.StatusForbidden, "the "+br.Operation+" is not allowed")
+		return
+	}
+	if br.HashAlgo != "" && br.HashAlgo != "sha256" {
+		renderError(res, http.StatusConflict, "unsupported hash algorithm: "+br.HashAlgo)
+		return
+	}
+	if len(br.Transfers) > 0 && !contains(br.Transfers, "basic") {
+		renderError(res, http.StatusUnprocessableEntity, "only the basic transfer is supported")
+		return
+	}
+
+	header := map[string]string{}
+	if authorization := req.Header.Get("Authorization"); authorization != "" {
+		header["Authorization"] = authorization
+	}
+	baseURL := ghx.URL(req, ctx.RepoPath())
+
+	objects := []*objectResponse{}
+	for _, o := range br.Objects {
+		or := &objectResponse{Oid: o.Oid, Size: o.Size}
+		objects = append(objects, or)
+
+		if !isValidOid(o.Oid) || o.Size < 0 {
+			or.Error = &objectError{Code: http.StatusUnprocessableEntity, Message: "invalid object"}
+			continue
+		}
+
+		size, err := ghx.store.Size(ctx.RepoPath(), o.Oid)
+		if err != nil && err != ErrObjectNotFound {
+			or.Error = &objectError{Code: http.StatusInternalServerError, Message: err.Error()}
+			continue
+		}
+		exists := err == nil
+
+		href := baseURL + "/info/lfs/objects/" + o.Oid
+		switch {
+		case br.Operation == "download" && exists:
+			or.Size = size
+			or.Authenticated = true
+			or.Actions = map[string]*action{"download": {Href: href, Header: header}}
+		case br.Operation == "download":
+			or.Error = &objectError{Code: http.StatusNotFound, Message: ErrObjectNotFound.Error()}
+		case !exists || size != o.Size:
+			or.Authenticated = true
+			or.Actions = map[string]*action{
+				"upload": {Href: href, Header: header},
+				"verify": {Href: baseURL + "/info/lfs/verify", Header: header},
+			}
+		}
+		// The object that has been uploaded has no actions.
+	}
+
+	renderJSON(res, http.StatusOK, &batchResponse{Transfer: "basic", Objects: objects, HashAlgo: "sha256"})
+}
+
+func (ghx *gitHTTPXfer) Download(ctx githttpxfer.Context) {
+	res, req := ctx.Response(), ctx.Request()
+
+	if !ghx.Git.HasAccess(req, "upload-pack", false) {
+		renderError(res, http.StatusForbidden, "the download is not allowed")
+		return
+	}
+
+	r, err := ghx.store.Get(ctx.RepoPath(), oidOf(ctx))
+	if err == ErrObjectNotFound {
+		renderError(res, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		githttpxfer.RenderInternalServerError(res.Writer)
+		return
+	}
+	defer r.Close()
+
+	res.SetContentType("application/octet-stream")
+	res.WriteHeader(http.StatusOK)
+	res.Copy(r)
+}
+
+func (ghx *gitHTTPXfer) Upload(ctx githttpxfer.Context) {
+	res, req := ctx.Response(), ctx.Request()
+
+	if !ghx.Git.HasAccess(req, "receive-pack", false) {
+		renderError(res, http.StatusForbidden, "the upload is not allowed")
+		return
+	}
+
+	err := ghx.store.Put(ctx.RepoPath(), oidOf(ctx), req.ContentLength, req.Body)
+	switch err {
+	case nil:
+		res.WriteHeader(http.StatusOK)
+	case ErrHashMismatch, ErrSizeMismatch:
+		renderError(res, http.StatusUnprocessableEntity, err.Error())
+	default:
+		githttpxfer.RenderInternalServerError(res.Writer)
+	}
+}
+
+func (ghx *gitHTTPXfer) Verify(ctx githttpxfer.Context) {
+	res, req := ctx.Response(), ctx.Request()
+
+	if !ghx.Git.HasAccess(req, "receive-pack", false) {
+		renderError(res, http.StatusForbidden, "the upload is not allowed")
+		return
+	}
+
+	o := &lfsObject{}
+	if err := json.NewDecoder(req.Body).Decode(o); err != nil || !isValidOid(o.Oid) {
+		renderError(res, http.StatusUnprocessableEntity, "invalid object")
+		return
+	}
+
+	size, err := ghx.store.Size(ctx.RepoPath(), o.Oid)
+	switch {
+	case err == ErrObjectNotFound:
+		renderError(res, http.StatusNotFound, err.Error())
+	case err != nil:
+		githttpxfer.RenderInternalServerError(res.Writer)
+	case size != o.Size:
+		renderError(res, http.StatusUnprocessableEntity, ErrSizeMismatch.Error())
+	default:
+		res.SetContentType(contentType)
+		res.WriteHeader(http.StatusOK)
+	}
+}
+
+func oidOf(ctx githttpxfer.Context) string {
+	return strings.TrimPrefix(ctx.FilePath(), "info/lfs/objects/")
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func renderJSON(res *githttpxfer.Response, status int, v interface{}) {
+	res.SetContentType(contentType)
+	res.WriteHeader(status)
+	json.NewEncoder(res.Writer).Encode(v)
+}
+
+func renderError(res *githttpxfer.Response, status int, message string) {
+	renderJSON(res, status, map[string]string{"message": message})
+}
@@ -0,0 +1,184 @@
+package lfs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/nulab/go-git-http-xfer/githttpxfer"
+)
+
+func setupLFSTest(t *testing.T, opts ...githttpxfer.Option) (*httptest.Server, bool) {
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Log("git is not found. so skip git lfs test.")
+		return nil, false
+	}
+
+	ghx, err := githttpxfer.New("/data/git", "/usr/bin/git", opts...)
+	if err != nil {
+		t.Errorf("An instance could not be created. %s", err.Error())
+		return nil, false
+	}
+	New(ghx, NewLocalContentStore("/data/git")).AddRoutes()
+
+	absRepoPath, _ := ghx.Git.GetAbsolutePath("lfs_test.git")
+	os.RemoveAll(absRepoPath)
+	if output, err := exec.Command("git", "init", "--bare", absRepoPath).CombinedOutput(); err != nil {
+		t.Errorf("execute command error: %s %s", err.Error(), output)
+		return nil, false
+	}
+	return httptest.NewServer(ghx), true
+}
+
+func requestBatch(t *testing.T, url string, body string) (int, *batchResponse) {
+	req, _ := http.NewRequest(http.MethodPost, url+"/info/lfs/objects/batch", strings.NewReader(body))
+	req.Header.Set("Accept", contentType)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Basic Zm9vOmJhcg==")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("batch request error: %s", err.Error())
+		return 0, nil
+	}
+	defer res.Body.Close()
+	br := &batchResponse{}
+	json.NewDecoder(res.Body).Decode(br)
+	return res.StatusCode, br
+}
+
+func Test_it_should_upload_and_download_objects(t *testing.T) {
+
+	ts, ok := setupLFSTest(t)
+	if !ok {
+		return
+	}
+	defer ts.Close()
+
+	repoURL := ts.URL + "/lfs_test.git"
+	content := "large content"
+	oid := oidOfContent(content)
+	object := `{"oid":"` + oid + `","size":13}`
+
+	status, br := requestBatch(t, repoURL, `{"operation":"download","transfers":["basic"],"objects":[`+object+`]}`)
+	if status != http.StatusOK || br.Objects[0].Error == nil || br.Objects[0].Error.Code != http.StatusNotFound {
+		t.Errorf("the missing object is not reported. status: %d, result: %+v", status, br.Objects[0])
+		return
+	}
+
+	status, br = requestBatch(t, repoURL, `{"operation":"upload","transfers":["basic"],"objects":[`+object+`]}`)
+	if status != http.StatusOK || br.Transfer != "basic" {
+		t.Errorf("StatusCode is not 200. result: %d", status)
+		return
+	}
+	upload, verify := br.Objects[0].Actions["upload"], br.Objects[0].Actions["verify"]
+	if upload == nil || verify == nil {
+		t.Errorf("the upload actions are not returned. result: %+v", br.Objects[0])
+		return
+	}
+	if upload.Href != repoURL+"/info/lfs/objects/"+oid || upload.Header["Authorization"] != "Basic Zm9vOmJhcg==" {
+		t.Errorf("the upload action is not valid. result: %+v", upload)
+		return
+	}
+
+	req, _ := http.NewRequest(http.MethodPut, upload.Href, strings.NewReader("another content"))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil || res.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("the invalid content is accepted. error: %v", err)
+		return
+	}
+	res.Body.Close()
+
+	req, _ = http.NewRequest(http.MethodPut, upload.Href, strings.NewReader(content))
+	res, err = http.DefaultClient.Do(req)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Errorf("the content is not uploaded. error: %v", err)
+		return
+	}
+	res.Body.Close()
+
+	res, err = http.Post(verify.Href, contentType, strings.NewReader(object))
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Errorf("the object is not verified. error: %v", err)
+		return
+	}
+	res.Body.Close()
+
+	status, br = requestBatch(t, repoURL, `{"operation":"upload","objects":[`+object+`]}`)
+	if status != http.StatusOK || len(br.Objects[0].Actions) != 0 {
+		t.Errorf("the uploaded object has actions. result: %+v", br.Objects[0])
+		return
+	}
+
+	status, br = requestBatch(t, repoURL, `{"operation":"download","objects":[`+object+`]}`)
+	download := br.Objects[0].Actions["download"]
+	if status != http.StatusOK || download == nil {
+		t.Errorf("the download action is not returned. result: %+v", br.Objects[0])
+		return
+	}
+
+	res, err = http.Get(download.Href)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Errorf("the object is not downloaded. error: %v", err)
+		return
+	}
+	defer res.Body.Close()
+	if result, _ := ioutil.ReadAll(res.Body); string(result) != content {
+		t.Errorf("content is not %s . result: %s", content, result)
+	}
+}
+
+func Test_it_should_reject_batch_request(t *testing.T) {
+
+	ts, ok := setupLFSTest(t, githttpxfer.DisableReceivePack())
+	if !ok {
+		return
+	}
+	defer ts.Close()
+
+	repoURL := ts.URL + "/lfs_test.git"
+
+	tests := []struct {
+		description string
+		url         string
+		body        string
+		expected    int
+	}{
+		{
+			description: "it should reject the upload if receive-pack is disabled",
+			url:         repoURL,
+			body:        `{"operation":"upload","objects":[]}`,
+			expected:    http.StatusForbidden,
+		},
+		{
+			description: "it should reject the unknown operation",
+			url:         repoURL,
+			body:        `{"operation":"delete","objects":[]}`,
+			expected:    http.StatusUnprocessableEntity,
+		},
+		{
+			description: "it should reject the unsupported hash algorithm",
+			url:         repoURL,
+			body:        `{"operation":"download","objects":[],"hash_algo":"sha512"}`,
+			expected:    http.StatusConflict,
+		},
+		{
+			description: "it should reject the unknown repository",
+			url:         ts.URL + "/unknown.git",
+			body:        `{"operation":"download","objects":[]}`,
+			expected:    http.StatusNotFound,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		if status, _ := requestBatch(t, tc.url, tc.body); status != tc.expected {
+			t.Errorf("StatusCode is not %d . result: %d", tc.expected, status)
+		}
+	}
+}
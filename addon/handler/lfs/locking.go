@@ -0,0 +1,520 @@
+package lfs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nulab/go-git-http-xfer/githttpxfer"
+)
+
+const defaultLocksLimit = 100
+
+var (
+	LocksPattern = func(u *url.URL) *githttpxfer.Match {
+		return matchSuffix(u.Path, "/info/lfs/locks")
+	}
+	VerifyLocksPattern = func(u *url.URL) *githttpxfer.Match {
+		return matchSuffix(u.Path, "/info/lfs/locks/verify")
+	}
+	unlockRegexp  = regexp.MustCompile(".*?(/info/lfs/locks/[^/]+/unlock)$")
+	UnlockPattern = func(u *url.URL) *githttpxfer.Match {
+		m := unlockRegexp.FindStringSubmatch(u.Path)
+		if m == nil {
+			return nil
+		}
+		return matchSuffix(u.Path, m[1])
+	}
+)
+
+// OwnerFunc returns the name of the user who sends the request, or "" if the user is unknown.
+type OwnerFunc func(ctx githttpxfer.Context) string
+
+// BasicAuthOwner returns the user name of the basic authentication.
+func BasicAuthOwner(ctx githttpxfer.Context) string {
+	username, _, _ := ctx.Request().BasicAuth()
+	return username
+}
+
+// LockingOption configures the handlers of the locking API.
+type LockingOption func(*locking)
+
+// WithHooksDir sets the directory where the hooks to check the locks are written.
+// A temporary directory is created for the handlers by default.
+func WithHooksDir(dir string) LockingOption {
+	return func(l *locking) {
+		l.hooksDir = dir
+	}
+}
+
+// WithForceUnlock sets the function that returns true if the user may delete the lock of another user.
+// No one may do it by default.
+func WithForceUnlock(f func(ctx githttpxfer.Context) bool) LockingOption {
+	return func(l *locking) {
+		l.canForceUnlock = f
+	}
+}
+
+// NewLocking returns the handlers of the Git LFS file locking API.
+// The locks are listed if upload-pack is enabled, and changed if receive-pack is enabled.
+func NewLocking(ghx *githttpxfer.GitHTTPXfer, store LockStore, owner OwnerFunc, opts ...LockingOption) *locking {
+	if owner == nil {
+		owner = BasicAuthOwner
+	}
+	l := &locking{GitHTTPXfer: ghx, store: store, owner: owner}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+type locking struct {
+	*githttpxfer.GitHTTPXfer
+	store          LockStore
+	owner          OwnerFunc
+	canForceUnlock func(ctx githttpxfer.Context) bool
+
+	hooksMu  sync.Mutex
+	hooksDir string
+}
+
+// AddRoutes adds the routes of the locking API to the router.
+func (l *locking) AddRoutes() {
+	l.Router.Add(githttpxfer.NewRoute(http.MethodPost, LocksPattern, l.CreateLock))
+	l.Router.Add(githttpxfer.NewRoute(http.MethodGet, LocksPattern, l.ListLocks))
+	l.Router.Add(githttpxfer.NewRoute(http.MethodPost, VerifyLocksPattern, l.VerifyLocks))
+	l.Router.Add(githttpxfer.NewRoute(http.MethodPost, UnlockPattern, l.Unlock))
+}
+
+type createLockRequest struct {
+	Path string `json:"path"`
+}
+
+type lockResponse struct {
+	Lock    *Lock  `json:"lock"`
+	Message string `json:"message,omitempty"`
+}
+
+type listLocksResponse struct {
+	Locks      []*Lock `json:"locks"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+type verifyLocksRequest struct {
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+type verifyLocksResponse struct {
+	Ours       []*Lock `json:"ours"`
+	Theirs     []*Lock `json:"theirs"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+type unlockRequest struct {
+	Force bool `json:"force,omitempty"`
+}
+
+func (l *locking) CreateLock(ctx githttpxfer.Context) {
+	res, req := ctx.Response(), ctx.Request()
+
+	owner, ok := l.authorize(ctx, "receive-pack")
+	if !ok {
+		return
+	}
+
+	clr := &createLockRequest{}
+	if err := json.NewDecoder(req.Body).Decode(clr); err != nil || clr.Path == "" {
+		renderError(res, http.StatusUnprocessableEntity, "invalid lock request")
+		return
+	}
+
+	id, err := newLockID()
+	if err != nil {
+		githttpxfer.RenderInternalServerError(res.Writer)
+		return
+	}
+	lock := &Lock{ID: id, Path: clr.Path, LockedAt: time.Now().UTC().Truncate(time.Second), Owner: &LockOwner{Name: owner}}
+
+	lock, err = l.store.Create(ctx.RepoPath(), lock)
+	switch err {
+	case nil:
+		renderJSON(res, http.StatusCreated, &lockResponse{Lock: lock})
+	case ErrLockExists:
+		renderJSON(res, http.StatusConflict, &lockResponse{Lock: lock, Message: err.Error()})
+	default:
+		githttpxfer.RenderInternalServerError(res.Writer)
+	}
+}
+
+func (l *locking) ListLocks(ctx githttpxfer.Context) {
+	res, req := ctx.Response(), ctx.Request()
+
+	if !l.Git.HasAccess(req, "upload-pack", false) {
+		renderError(res, http.StatusForbidden, "the listing of the locks is not allowed")
+		return
+	}
+
+	query := req.URL.Query()
+	limit, err := parseLimit(query.Get("limit"))
+	if err != nil {
+		renderError(res, http.StatusBadRequest, "invalid limit")
+		return
+	}
+
+	locks, err := l.store.List(ctx.RepoPath())
+	if err != nil {
+		githttpxfer.RenderInternalServerError(res.Writer)
+		return
+	}
+
+	filtered := []*Lock{}
+	for _, lock := range locks {
+		if p := query.Get("path"); p != "" && lock.Path != p {
+			continue
+		}
+		if id := query.Get("id"); id != "" && lock.ID != id {
+			continue
+		}
+		filtered = append(filtered, lock)
+	}
+
+	page, next := paginate(filtered, query.Get("cursor"), limit)
+	renderJSON(res, http.StatusOK, &listLocksResponse{Locks: page, NextCursor: next})
+}
+
+func (l *locking) VerifyLocks(ctx githttpxfer.Context) {
+	res, req := ctx.Response(), ctx.Request()
+
+	owner, ok := l.authorize(ctx, "receive-pack")
+	if !ok {
+		return
+	}
+
+	vlr := &verifyLocksRequest{}
+	if err := json.NewDecoder(req.Body).Decode(vlr); err != nil || vlr.Limit < 0 {
+		renderError(res, http.StatusUnprocessableEntity, "invalid verify request")
+		return
+	}
+	limit := vlr.Limit
+	if limit == 0 {
+		limit = defaultLocksLimit
+	}
+
+	locks, err := l.store.List(ctx.RepoPath())
+	if err != nil {
+		githttpxfer.RenderInternalServerError(res.Writer)
+		return
+	}
+
+	page, next := paginate(locks, vlr.Cursor, limit)
+	vr := &verifyLocksResponse{Ours: []*Lock{}, Theirs: []*Lock{}, NextCursor: next}
+	for _, lock := range page {
+		if isOwner(lock, owner) {
+			vr.Ours = append(vr.Ours, lock)
+		} else {
+			vr.Theirs = append(vr.Theirs, lock)
+		}
+	}
+	renderJSON(res, http.StatusOK, vr)
+}
+
+func (l *locking) Unlock(ctx githttpxfer.Context) {
+	res, req := ctx.Response(), ctx.Request()
+
+	owner, ok := l.authorize(ctx, "receive-pack")
+	if !ok {
+		return
+	}
+
+	ur := &unlockRequest{}
+	if err := json.NewDecoder(req.Body).Decode(ur); err != nil {
+		renderError(res, http.StatusUnprocessableEntity, "invalid unlock request")
+		return
+	}
+
+	id := strings.TrimSuffix(strings.TrimPrefix(ctx.FilePath(), "info/lfs/locks/"), "/unlock")
+	locks, err := l.store.List(ctx.RepoPath())
+	if err != nil {
+		githttpxfer.RenderInternalServerError(res.Writer)
+		return
+	}
+	var lock *Lock
+	for _, v := range locks {
+		if v.ID == id {
+			lock = v
+		}
+	}
+	if lock == nil {
+		renderError(res, http.StatusNotFound, ErrLockNotFound.Error())
+		return
+	}
+	if !isOwner(lock, owner) && !(ur.Force && l.canForceUnlock != nil && l.canForceUnlock(ctx)) {
+		renderError(res, http.StatusForbidden, "the lock is owned by another user")
+		return
+	}
+
+	lock, err = l.store.Delete(ctx.RepoPath(), id)
+	switch err {
+	case nil:
+		renderJSON(res, http.StatusOK, &lockResponse{Lock: lock})
+	case ErrLockNotFound:
+		renderError(res, http.StatusNotFound, err.Error())
+	default:
+		githttpxfer.RenderInternalServerError(res.Writer)
+	}
+}
+
+// authorize renders the error and returns false if the user may not use the rpc, or the user is unknown.
+func (l *locking) authorize(ctx githttpxfer.Context, rpc string) (string, bool) {
+	res := ctx.Response()
+	if !l.Git.HasAccess(ctx.Request(), rpc, false) {
+		renderError(res, http.StatusForbidden, "the locking is not allowed")
+		return "", false
+	}
+	owner := l.owner(ctx)
+	if owner == "" {
+		res.Header().Set("Lfs-Authenticate", `Basic realm="Git LFS"`)
+		renderError(res, http.StatusUnauthorized, "the user is unknown")
+		return "", false
+	}
+	return owner, true
+}
+
+// RejectLockedPushes is the listener of BeforeReceivePack that rejects the pushes
+// which change the files locked by another user.
+//
+//	ghx.Event.On(githttpxfer.BeforeReceivePack, locking.RejectLockedPushes)
+//
+// The changed files are known only after git has received the objects,
+// so the check runs in a pre-receive hook that core.hooksPath points to.
+// The hook runs the hooks of the repository, or of core.hooksPath that is set already, after the check.
+// The push is rejected if the backend is not the git executable, because the hook can not run.
+func (l *locking) RejectLockedPushes(ctx githttpxfer.Context) {
+	locks, err := l.store.List(ctx.RepoPath())
+	if err != nil {
+		ctx.Reject("failed to read the locks")
+		return
+	}
+	owner := l.owner(ctx)
+	lockedPaths := []string{}
+	for _, lock := range locks {
+		if !isOwner(lock, owner) {
+			lockedPaths = append(lockedPaths, lock.Path)
+		}
+	}
+	if len(lockedPaths) == 0 {
+		return
+	}
+	if l.Backend != githttpxfer.Backend(l.Git) {
+		ctx.Reject("the locks can not be checked by the backend")
+		return
+	}
+
+	env := ctx.Env()
+	if env == nil {
+		env = os.Environ()
+	}
+	repoHooksPath, err := l.repoHooksPath(ctx, env)
+	if err != nil {
+		ctx.Reject("failed to check the locks")
+		return
+	}
+	hooksPath, err := l.preReceiveHooksPath()
+	if err != nil {
+		ctx.Reject("failed to check the locks")
+		return
+	}
+	if repoHooksPath == hooksPath {
+		repoHooksPath = ""
+	}
+	f, err := ioutil.TempFile("", "lfs-locked-paths-")
+	if err != nil {
+		ctx.Reject("failed to check the locks")
+		return
+	}
+	_, err = f.WriteString(strings.Join(lockedPaths, "\n") + "\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		ctx.Reject("failed to check the locks")
+		return
+	}
+	go func() {
+		<-ctx.Request().Context().Done()
+		os.Remove(f.Name())
+	}()
+
+	// The last GIT_CONFIG_PARAMETERS of env is used, and it has the config of env as well.
+	ctx.SetEnv(append(env[:len(env):len(env)],
+		githttpxfer.GitConfigParameters(env, []string{"core.hooksPath=" + hooksPath}),
+		lockedPathsEnv+"="+f.Name(),
+		repoHooksPathEnv+"="+repoHooksPath,
+	))
+}
+
+// repoHooksPath returns core.hooksPath that the repository uses without the hooks of the locks, or "" if it is not set.
+func (l *locking) repoHooksPath(ctx githttpxfer.Context, env []string) (string, error) {
+	cmd, err := l.Git.GitCommand(ctx.RepoPath(), "config", "--path", "--get", "core.hooksPath")
+	if err != nil {
+		return "", err
+	}
+	cmd.Env = env
+	output, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		// The key is not set.
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// preReceiveHooksPath returns the directory of the hooks. The hooks are written again
+// if any of them is missing, e.g. the temporary directory is cleaned up.
+func (l *locking) preReceiveHooksPath() (string, error) {
+	l.hooksMu.Lock()
+	defer l.hooksMu.Unlock()
+	if l.hooksDir == "" {
+		dir, err := ioutil.TempDir("", "lfs-hooks-")
+		if err != nil {
+			return "", err
+		}
+		l.hooksDir = dir
+	}
+	if hooksExist(l.hooksDir) {
+		return l.hooksDir, nil
+	}
+	if err := writeHooks(l.hooksDir); err != nil {
+		return "", err
+	}
+	return l.hooksDir, nil
+}
+
+const (
+	lockedPathsEnv   = "GITHTTPXFER_LFS_LOCKED_PATHS"
+	repoHooksPathEnv = "GITHTTPXFER_LFS_REPO_HOOKS_PATH"
+)
+
+// preReceiveHook lists the files changed by the new commits, and fails if any of them is locked.
+const preReceiveHook = `#!/bin/sh
+input=$(cat)
+status=0
+while read -r old new ref; do
+	case "$new" in
+	"" | *[!0]*) ;;
+	*) continue ;;
+	esac
+	[ -z "$new" ] && continue
+	locked=$(git rev-list "$new" --not --all |
+		git diff-tree --stdin -m -r --root --no-commit-id --name-only |
+		sort -u | grep -Fx -f "$` + lockedPathsEnv + `")
+	if [ -n "$locked" ]; then
+		printf '%s\n' "$locked" | sed 's/^/error: /; s/$/ is locked by another user./' >&2
+		status=1
+	fi
+done <<EOF
+$input
+EOF
+[ $status -eq 0 ] || exit $status
+
+hooks="${` + repoHooksPathEnv + `:-${GIT_DIR:-.}/hooks}"
+hook="$hooks/pre-receive"
+[ -x "$hook" ] || exit 0
+printf '%s\n' "$input" | "$hook"
+`
+
+// passThroughHook runs the hook of the repository that core.hooksPath hides.
+const passThroughHook = `#!/bin/sh
+hooks="${` + repoHooksPathEnv + `:-${GIT_DIR:-.}/hooks}"
+hook="$hooks/$(basename "$0")"
+[ -x "$hook" ] || exit 0
+exec "$hook" "$@"
+`
+
+var passThroughHooks = []string{"update", "post-receive", "post-update", "reference-transaction", "push-to-checkout"}
+
+// hooksExist returns true if the hooks of this version are in dir.
+func hooksExist(dir string) bool {
+	for _, name := range append([]string{"pre-receive"}, passThroughHooks...) {
+		hook := passThroughHook
+		if name == "pre-receive" {
+			hook = preReceiveHook
+		}
+		if b, err := ioutil.ReadFile(path.Join(dir, name)); err != nil || string(b) != hook {
+			return false
+		}
+	}
+	return true
+}
+
+func writeHooks(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "pre-receive"), []byte(preReceiveHook), 0755); err != nil {
+		return err
+	}
+	for _, name := range passThroughHooks {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(passThroughHook), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isOwner(lock *Lock, owner string) bool {
+	return lock.Owner != nil && lock.Owner.Name == owner
+}
+
+func newLockID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func parseLimit(s string) (int, error) {
+	if s == "" {
+		return defaultLocksLimit, nil
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit <= 0 {
+		return 0, strconv.ErrSyntax
+	}
+	return limit, nil
+}
+
+// paginate returns the locks from the cursor, which is the ID of the first lock of the page.
+func paginate(locks []*Lock, cursor string, limit int) ([]*Lock, string) {
+	start := 0
+	if cursor != "" {
+		start = len(locks)
+		for i, lock := range locks {
+			if lock.ID == cursor {
+				start = i
+				break
+			}
+		}
+	}
+	end := start + limit
+	if end >= len(locks) {
+		return locks[start:], ""
+	}
+	return locks[start:end], locks[end].ID
+}
@@ -0,0 +1,347 @@
+package lfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/nulab/go-git-http-xfer/githttpxfer"
+)
+
+func setupLockingTest(t *testing.T) (*httptest.Server, bool) {
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Log("git is not found. so skip git lfs locking test.")
+		return nil, false
+	}
+
+	ghx, err := githttpxfer.New("/data/git", "/usr/bin/git")
+	if err != nil {
+		t.Errorf("An instance could not be created. %s", err.Error())
+		return nil, false
+	}
+	locking := NewLocking(ghx, NewFileLockStore("/data/git"), func(ctx githttpxfer.Context) string {
+		return ctx.Request().Header.Get("X-User")
+	}, WithForceUnlock(func(ctx githttpxfer.Context) bool {
+		return ctx.Request().Header.Get("X-User") == "admin"
+	}))
+	locking.AddRoutes()
+	ghx.Event.On(githttpxfer.BeforeReceivePack, locking.RejectLockedPushes)
+
+	absRepoPath, _ := ghx.Git.GetAbsolutePath("locking_test.git")
+	os.RemoveAll(absRepoPath)
+	if output, err := exec.Command("git", "init", "--bare", absRepoPath).CombinedOutput(); err != nil {
+		t.Errorf("execute command error: %s %s", err.Error(), output)
+		return nil, false
+	}
+	return httptest.NewServer(ghx), true
+}
+
+func requestLocks(t *testing.T, method, url, user, body string, v interface{}) int {
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Accept", contentType)
+	req.Header.Set("Content-Type", contentType)
+	if user != "" {
+		req.Header.Set("X-User", user)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("locks request error: %s", err.Error())
+		return 0
+	}
+	defer res.Body.Close()
+	json.NewDecoder(res.Body).Decode(v)
+	return res.StatusCode
+}
+
+func Test_it_should_create_list_verify_and_unlock_locks(t *testing.T) {
+
+	ts, ok := setupLockingTest(t)
+	if !ok {
+		return
+	}
+	defer ts.Close()
+
+	locksURL := ts.URL + "/locking_test.git/info/lfs/locks"
+
+	if status := requestLocks(t, http.MethodPost, locksURL, "", `{"path":"a.bin"}`, nil); status != http.StatusUnauthorized {
+		t.Errorf("StatusCode is not %d . result: %d", http.StatusUnauthorized, status)
+		return
+	}
+
+	created := &lockResponse{}
+	if status := requestLocks(t, http.MethodPost, locksURL, "alice", `{"path":"a.bin"}`, created); status != http.StatusCreated {
+		t.Errorf("StatusCode is not %d . result: %d", http.StatusCreated, status)
+		return
+	}
+	if created.Lock.Path != "a.bin" || created.Lock.Owner.Name != "alice" {
+		t.Errorf("the lock is not valid. result: %+v", created.Lock)
+		return
+	}
+
+	conflict := &lockResponse{}
+	if status := requestLocks(t, http.MethodPost, locksURL, "bob", `{"path":"a.bin"}`, conflict); status != http.StatusConflict || conflict.Lock.ID != created.Lock.ID {
+		t.Errorf("the existing lock is not returned. status: %d, result: %+v", status, conflict.Lock)
+		return
+	}
+	requestLocks(t, http.MethodPost, locksURL, "bob", `{"path":"b.bin"}`, nil)
+
+	tests := []struct {
+		description string
+		query       string
+		expected    int
+	}{
+		{description: "all locks", query: "", expected: 2},
+		{description: "filtered by path", query: "?path=a.bin", expected: 1},
+		{description: "filtered by id", query: "?id=" + created.Lock.ID, expected: 1},
+		{description: "limited", query: "?limit=1", expected: 1},
+	}
+	for _, tc := range tests {
+		t.Log(tc.description)
+		list := &listLocksResponse{}
+		if status := requestLocks(t, http.MethodGet, locksURL+tc.query, "", "", list); status != http.StatusOK || len(list.Locks) != tc.expected {
+			t.Errorf("the number of the locks is not %d . status: %d, result: %d", tc.expected, status, len(list.Locks))
+		}
+	}
+
+	list := &listLocksResponse{}
+	requestLocks(t, http.MethodGet, locksURL+"?limit=1", "", "", list)
+	next := &listLocksResponse{}
+	requestLocks(t, http.MethodGet, locksURL+"?limit=1&cursor="+list.NextCursor, "", "", next)
+	if list.NextCursor == "" || len(next.Locks) != 1 || next.Locks[0].ID == list.Locks[0].ID || next.NextCursor != "" {
+		t.Errorf("the locks are not paginated. result: %+v %+v", list, next)
+		return
+	}
+
+	verified := &verifyLocksResponse{}
+	if status := requestLocks(t, http.MethodPost, locksURL+"/verify", "alice", `{}`, verified); status != http.StatusOK {
+		t.Errorf("StatusCode is not %d . result: %d", http.StatusOK, status)
+		return
+	}
+	if len(verified.Ours) != 1 || verified.Ours[0].Path != "a.bin" || len(verified.Theirs) != 1 || verified.Theirs[0].Path != "b.bin" {
+		t.Errorf("the locks are not verified. result: %+v", verified)
+		return
+	}
+
+	unlockURL := locksURL + "/" + created.Lock.ID + "/unlock"
+	if status := requestLocks(t, http.MethodPost, unlockURL, "bob", `{}`, nil); status != http.StatusForbidden {
+		t.Errorf("StatusCode is not %d . result: %d", http.StatusForbidden, status)
+		return
+	}
+	if status := requestLocks(t, http.MethodPost, unlockURL, "bob", `{"force":true}`, nil); status != http.StatusForbidden {
+		t.Errorf("StatusCode is not %d . result: %d", http.StatusForbidden, status)
+		return
+	}
+	unlocked := &lockResponse{}
+	if status := requestLocks(t, http.MethodPost, unlockURL, "admin", `{"force":true}`, unlocked); status != http.StatusOK || unlocked.Lock.ID != created.Lock.ID {
+		t.Errorf("the lock is not deleted. status: %d, result: %+v", status, unlocked.Lock)
+		return
+	}
+	if status := requestLocks(t, http.MethodPost, unlockURL, "alice", `{}`, nil); status != http.StatusNotFound {
+		t.Errorf("StatusCode is not %d . result: %d", http.StatusNotFound, status)
+	}
+}
+
+func Test_it_should_reject_push_that_changes_locked_file(t *testing.T) {
+
+	ts, ok := setupLockingTest(t)
+	if !ok {
+		return
+	}
+	defer ts.Close()
+
+	remoteURL := ts.URL + "/locking_test.git"
+	if status := requestLocks(t, http.MethodPost, remoteURL+"/info/lfs/locks", "alice", `{"path":"a.bin"}`, nil); status != http.StatusCreated {
+		t.Errorf("StatusCode is not %d . result: %d", http.StatusCreated, status)
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "locking")
+	if err != nil {
+		t.Errorf("temp dir could not be created. %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	git := func(user string, args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{
+			"-c", "user.name=" + user, "-c", "user.email=" + user + "@example.com",
+			"-c", "http.extraHeader=X-User: " + user,
+		}, args...)...)
+		cmd.Dir = dir
+		output, err := cmd.CombinedOutput()
+		return string(output), err
+	}
+	commit := func(user, file string) error {
+		if err := ioutil.WriteFile(path.Join(dir, file), []byte(user+file), 0644); err != nil {
+			return err
+		}
+		if output, err := git(user, "add", file); err != nil {
+			t.Log(output)
+			return err
+		}
+		_, err := git(user, "commit", "-m", file)
+		return err
+	}
+
+	if output, err := git("bob", "init", "."); err != nil {
+		t.Errorf("execute command error: %s %s", err.Error(), output)
+		return
+	}
+
+	tests := []struct {
+		description string
+		user        string
+		file        string
+		rejected    bool
+	}{
+		{description: "bob changes the file that is not locked", user: "bob", file: "b.bin", rejected: false},
+		{description: "bob changes the file that alice locks", user: "bob", file: "a.bin", rejected: true},
+		{description: "alice changes the file that alice locks", user: "alice", file: "a.bin", rejected: false},
+	}
+	for _, tc := range tests {
+		t.Log(tc.description)
+		if err := commit(tc.user, tc.file); err != nil {
+			t.Errorf("commit error: %s", err.Error())
+			return
+		}
+		output, err := git(tc.user, "push", remoteURL, "HEAD:refs/heads/master")
+		if rejected := err != nil; rejected != tc.rejected {
+			t.Errorf("rejected is not %t . result: %s", tc.rejected, output)
+			return
+		}
+		if tc.rejected && !strings.Contains(output, "a.bin is locked by another user.") {
+			t.Errorf("the locked file is not reported. result: %s", output)
+			return
+		}
+	}
+}
+
+func Test_it_should_write_the_hooks_again_if_they_are_removed(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "locking-hooks")
+	if err != nil {
+		t.Errorf("temp dir could not be created. %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	hooksDir := path.Join(dir, "hooks")
+	l := NewLocking(nil, nil, nil, WithHooksDir(hooksDir))
+
+	tests := []struct {
+		description string
+		remove      func() error
+	}{
+		{description: "the hooks are written to the hooks dir", remove: func() error { return nil }},
+		{description: "the removed hook is written again", remove: func() error { return os.Remove(path.Join(hooksDir, "pre-receive")) }},
+		{description: "the removed hooks dir is written again", remove: func() error { return os.RemoveAll(hooksDir) }},
+	}
+	for _, tc := range tests {
+		t.Log(tc.description)
+		if err := tc.remove(); err != nil {
+			t.Errorf("remove error: %s", err.Error())
+			return
+		}
+		result, err := l.preReceiveHooksPath()
+		if err != nil {
+			t.Errorf("preReceiveHooksPath error: %s", err.Error())
+			return
+		}
+		if result != hooksDir {
+			t.Errorf("hooksPath is not %s . result: %s", hooksDir, result)
+		}
+		if !hooksExist(hooksDir) {
+			t.Error("the hooks do not exist.")
+		}
+	}
+}
+
+// otherBackend is a backend that is not the git executable.
+type otherBackend struct {
+	githttpxfer.Backend
+}
+
+func Test_it_should_check_the_locks_with_the_hooks_path_of_the_repository(t *testing.T) {
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Log("git is not found. so skip git lfs locking test.")
+		return
+	}
+
+	gitRootPath := t.TempDir()
+	customHooksPath := path.Join(gitRootPath, "custom-hooks")
+	if err := os.MkdirAll(customHooksPath, 0755); err != nil {
+		t.Errorf("mkdir error: %s", err.Error())
+		return
+	}
+	if err := ioutil.WriteFile(path.Join(customHooksPath, "pre-receive"), []byte("#!/bin/sh\necho custom pre-receive >&2\n"), 0755); err != nil {
+		t.Errorf("write hook error: %s", err.Error())
+		return
+	}
+
+	tests := []struct {
+		description  string
+		otherBackend bool
+		expected     string
+		rejected     bool
+	}{
+		{description: "it should run the hook of core.hooksPath after the check", expected: "custom pre-receive", rejected: false},
+		{description: "it should reject the push if the backend is not the git executable", otherBackend: true, expected: "the locks can not be checked by the backend", rejected: true},
+	}
+	for i, tc := range tests {
+		t.Log(tc.description)
+
+		ghx, err := githttpxfer.New(gitRootPath, "/usr/bin/git")
+		if err != nil {
+			t.Errorf("An instance could not be created. %s", err.Error())
+			return
+		}
+		if tc.otherBackend {
+			ghx.Backend = otherBackend{ghx.Backend}
+		}
+		locking := NewLocking(ghx, NewFileLockStore(gitRootPath), func(ctx githttpxfer.Context) string {
+			return ctx.Request().Header.Get("X-User")
+		}, WithHooksDir(path.Join(gitRootPath, "lfs-hooks")))
+		locking.AddRoutes()
+		ghx.Event.On(githttpxfer.BeforeReceivePack, locking.RejectLockedPushes)
+		ts := httptest.NewServer(ghx)
+		defer ts.Close()
+
+		repoName := fmt.Sprintf("hooks_path_%d.git", i)
+		absRepoPath := path.Join(gitRootPath, repoName)
+		workingDirPath := path.Join(gitRootPath, fmt.Sprintf("work_%d", i))
+		commands := [][]string{
+			{"init", "-q", "--bare", absRepoPath},
+			{"-C", absRepoPath, "config", "core.hooksPath", customHooksPath},
+			{"init", "-q", workingDirPath},
+			{"-C", workingDirPath, "-c", "user.name=bob", "-c", "user.email=bob@example.com", "commit", "-q", "--allow-empty", "-m", "bob"},
+		}
+		for _, args := range commands {
+			if output, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+				t.Errorf("execute command error: %s %s", err.Error(), output)
+				return
+			}
+		}
+		remoteURL := ts.URL + "/" + repoName
+		if status := requestLocks(t, http.MethodPost, remoteURL+"/info/lfs/locks", "alice", `{"path":"a.bin"}`, nil); status != http.StatusCreated {
+			t.Errorf("StatusCode is not %d . result: %d", http.StatusCreated, status)
+			return
+		}
+
+		output, err := exec.Command("git", "-C", workingDirPath, "-c", "http.extraHeader=X-User: bob", "push", remoteURL, "HEAD:refs/heads/master").CombinedOutput()
+		if rejected := err != nil; rejected != tc.rejected {
+			t.Errorf("rejected is not %t . result: %s", tc.rejected, output)
+		}
+		if !strings.Contains(string(output), tc.expected) {
+			t.Errorf("output does not contain %s . result: %s", tc.expected, output)
+		}
+	}
+}
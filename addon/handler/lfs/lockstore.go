@@ -0,0 +1,156 @@
+package lfs
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nulab/go-git-http-xfer/githttpxfer"
+)
+
+var (
+	ErrLockExists   = errors.New("already created lock")
+	ErrLockNotFound = errors.New("lock does not exist")
+)
+
+// Lock is the lock of a file. The locks are not scoped by refs.
+type Lock struct {
+	ID       string     `json:"id"`
+	Path     string     `json:"path"`
+	LockedAt time.Time  `json:"locked_at"`
+	Owner    *LockOwner `json:"owner,omitempty"`
+}
+
+type LockOwner struct {
+	Name string `json:"name"`
+}
+
+// LockStore stores the locks of the repositories.
+type LockStore interface {
+	// Create stores the lock. It returns the existing lock and ErrLockExists if the path is locked.
+	Create(repoPath string, lock *Lock) (*Lock, error)
+	// List returns the locks ordered by their IDs.
+	List(repoPath string) ([]*Lock, error)
+	// Delete removes the lock and returns it, or returns ErrLockNotFound.
+	Delete(repoPath, id string) (*Lock, error)
+}
+
+// NewFileLockStore returns the store that keeps the locks in "<rootPath>/<repoPath>/lfs/locks.json".
+func NewFileLockStore(rootPath string) *FileLockStore {
+	return NewFileLockStoreWithResolver(githttpxfer.NewRootResolver(rootPath))
+}
+
+// NewFileLockStoreWithResolver returns the store that keeps the locks in "lfs/locks.json" of the repository that the resolver locates.
+func NewFileLockStoreWithResolver(resolver githttpxfer.RepoResolver) *FileLockStore {
+	return &FileLockStore{resolver: resolver}
+}
+
+type FileLockStore struct {
+	resolver githttpxfer.RepoResolver
+	mu       sync.Mutex
+}
+
+func (s *FileLockStore) filePath(repoPath string) (string, error) {
+	absRepoPath, err := s.resolver.Resolve(repoPath)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(absRepoPath, "lfs", "locks.json"), nil
+}
+
+func (s *FileLockStore) read(repoPath string) ([]*Lock, error) {
+	filePath, err := s.filePath(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return []*Lock{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	locks := []*Lock{}
+	if err := json.Unmarshal(b, &locks); err != nil {
+		return nil, err
+	}
+	return locks, nil
+}
+
+func (s *FileLockStore) write(repoPath string, locks []*Lock) error {
+	b, err := json.Marshal(locks)
+	if err != nil {
+		return err
+	}
+	filePath, err := s.filePath(repoPath)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(path.Dir(filePath), "locks-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filePath)
+}
+
+func (s *FileLockStore) Create(repoPath string, lock *Lock) (*Lock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	locks, err := s.read(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range locks {
+		if l.Path == lock.Path {
+			return l, ErrLockExists
+		}
+	}
+	locks = append(locks, lock)
+	sort.Slice(locks, func(i, j int) bool { return locks[i].ID < locks[j].ID })
+	if err := s.write(repoPath, locks); err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+func (s *FileLockStore) List(repoPath string) ([]*Lock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read(repoPath)
+}
+
+func (s *FileLockStore) Delete(repoPath, id string) (*Lock, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	locks, err := s.read(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	for i, l := range locks {
+		if l.ID == id {
+			if err := s.write(repoPath, append(locks[:i], locks[i+1:]...)); err != nil {
+				return nil, err
+			}
+			return l, nil
+		}
+	}
+	return nil, ErrLockNotFound
+}
@@ -0,0 +1,58 @@
+package lfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_FileLockStore_should_create_list_and_delete_locks(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "lockstore")
+	if err != nil {
+		t.Errorf("temp dir could not be created. %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	store := NewFileLockStore(dir)
+	repoPath := "/test.git"
+
+	lockA := &Lock{ID: "b", Path: "a.bin", LockedAt: time.Now().UTC(), Owner: &LockOwner{Name: "alice"}}
+	lockB := &Lock{ID: "a", Path: "b.bin", LockedAt: time.Now().UTC(), Owner: &LockOwner{Name: "bob"}}
+	for _, lock := range []*Lock{lockA, lockB} {
+		if _, err := store.Create(repoPath, lock); err != nil {
+			t.Errorf("the lock could not be created. %s", err.Error())
+			return
+		}
+	}
+
+	existing, err := store.Create(repoPath, &Lock{ID: "c", Path: "a.bin", Owner: &LockOwner{Name: "bob"}})
+	if err != ErrLockExists || existing.ID != "b" {
+		t.Errorf("the existing lock is not returned. error: %v", err)
+		return
+	}
+
+	locks, err := NewFileLockStore(dir).List(repoPath)
+	if err != nil || len(locks) != 2 {
+		t.Errorf("the locks are not listed. error: %v", err)
+		return
+	}
+	if locks[0].ID != "a" || locks[1].Path != "a.bin" || locks[1].Owner.Name != "alice" {
+		t.Errorf("the locks are not ordered by the ids. result: %+v %+v", locks[0], locks[1])
+		return
+	}
+
+	if _, err := store.Delete(repoPath, "b"); err != nil {
+		t.Errorf("the lock could not be deleted. %s", err.Error())
+		return
+	}
+	if _, err := store.Delete(repoPath, "b"); err != ErrLockNotFound {
+		t.Errorf("error is not %s . result: %v", ErrLockNotFound, err)
+		return
+	}
+	if locks, _ := store.List(repoPath); len(locks) != 1 || locks[0].ID != "a" {
+		t.Errorf("the lock is not deleted. result: %+v", locks)
+	}
+}
@@ -0,0 +1,226 @@
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nulab/go-git-http-xfer/githttpxfer"
+)
+
+// DefaultBuckets are the upper bounds in seconds of the histograms.
+var DefaultBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900}
+
+// New returns the Metrics that serves the metrics in the Prometheus text format.
+func New() *Metrics {
+	return NewWithBuckets(DefaultBuckets)
+}
+
+// NewWithBuckets is New with the buckets of the histograms.
+func NewWithBuckets(buckets []float64) *Metrics {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &Metrics{
+		requests:        newFamily("githttpxfer_requests_total", "The requests that have matched a route.", "counter", nil, "class"),
+		serviceStarted:  newFamily("githttpxfer_service_started_total", "The services that have started.", "counter", nil, "service"),
+		serviceFinished: newFamily("githttpxfer_service_finished_total", "The services that have finished by the exit code.", "counter", nil, "service", "exit_code"),
+		serviceDuration: newFamily("githttpxfer_service_duration_seconds", "The time that the services have run.", "histogram", buckets, "service"),
+		requestBytes:    newFamily("githttpxfer_request_bytes_total", "The bytes read from the request bodies.", "counter", nil, "class"),
+		responseBytes:   newFamily("githttpxfer_response_bytes_total", "The bytes written to the responses.", "counter", nil, "class"),
+		queueWait:       newFamily("githttpxfer_queue_wait_seconds", "The time that the requests have waited for a git process.", "histogram", buckets, "service", "admitted"),
+		queueDepth:      newFamily("githttpxfer_queue_depth", "The requests waiting for a git process.", "gauge", nil),
+		errors:          newFamily("githttpxfer_errors_total", "The failed requests by the kind.", "counter", nil, "kind"),
+	}
+}
+
+// Metrics implements githttpxfer.Metrics, and it is the http.Handler of the exposition.
+type Metrics struct {
+	mu sync.Mutex
+
+	requests        *family
+	serviceStarted  *family
+	serviceFinished *family
+	serviceDuration *family
+	requestBytes    *family
+	responseBytes   *family
+	queueWait       *family
+	queueDepth      *family
+	errors          *family
+}
+
+// class is the label of the request, which is "fetch", "push", "dumb" or "other".
+func class(ctx githttpxfer.Context) string {
+	if c := githttpxfer.ClassifyRequest(ctx); c != "" {
+		return c
+	}
+	return "other"
+}
+
+func (m *Metrics) RequestRouted(ctx githttpxfer.Context) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests.add(1, class(ctx))
+}
+
+func (m *Metrics) ServiceStarted(ctx githttpxfer.Context, service string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.serviceStarted.add(1, service)
+}
+
+func (m *Metrics) ServiceFinished(ctx githttpxfer.Context, service string, exitCode int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.serviceFinished.add(1, service, strconv.Itoa(exitCode))
+	m.serviceDuration.observe(elapsed.Seconds(), service)
+}
+
+func (m *Metrics) BytesTransferred(ctx githttpxfer.Context, read, written int64) {
+	c := class(ctx)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requestBytes.add(float64(read), c)
+	m.responseBytes.add(float64(written), c)
+}
+
+func (m *Metrics) QueueWaited(ctx githttpxfer.Context, service string, wait time.Duration, admitted bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queueWait.observe(wait.Seconds(), service, strconv.FormatBool(admitted))
+}
+
+func (m *Metrics) QueueDepth(depth int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queueDepth.set(float64(depth))
+}
+
+func (m *Metrics) Error(ctx githttpxfer.Context, kind string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors.add(1, kind)
+}
+
+func (m *Metrics) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	buf := &bytes.Buffer{}
+	m.mu.Lock()
+	for _, f := range []*family{
+		m.requests, m.serviceStarted, m.serviceFinished, m.serviceDuration,
+		m.requestBytes, m.responseBytes, m.queueWait, m.queueDepth, m.errors,
+	} {
+		f.write(buf)
+	}
+	m.mu.Unlock()
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	rw.Write(buf.Bytes())
+}
+
+// family is the metric with its series for each combination of the label values.
+type family struct {
+	name, help, typ string
+	labels          []string
+	buckets         []float64
+	series          map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// counts are the observations in each bucket, not cumulative.
+	counts []uint64
+	count  uint64
+}
+
+func newFamily(name, help, typ string, buckets []float64, labels ...string) *family {
+	return &family{name: name, help: help, typ: typ, labels: labels, buckets: buckets, series: map[string]*series{}}
+}
+
+func (f *family) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\x00")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: labelValues, counts: make([]uint64, len(f.buckets))}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) add(v float64, labelValues ...string) {
+	f.get(labelValues).value += v
+}
+
+func (f *family) set(v float64, labelValues ...string) {
+	f.get(labelValues).value = v
+}
+
+// observe adds the observation to the histogram. value is the sum of the observations.
+func (f *family) observe(v float64, labelValues ...string) {
+	s := f.get(labelValues)
+	s.value += v
+	s.count++
+	if i := sort.SearchFloat64s(f.buckets, v); i < len(f.buckets) {
+		s.counts[i]++
+	}
+}
+
+func (f *family) write(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+	if f.typ == "gauge" && len(f.labels) == 0 && len(f.series) == 0 {
+		fmt.Fprintf(buf, "%s 0\n", f.name)
+		return
+	}
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.series[key]
+		if f.typ != "histogram" {
+			fmt.Fprintf(buf, "%s%s %s\n", f.name, f.labelPairs(s.labelValues, ""), formatFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, le := range f.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, f.labelPairs(s.labelValues, formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", f.name, f.labelPairs(s.labelValues, "+Inf"), s.count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", f.name, f.labelPairs(s.labelValues, ""), formatFloat(s.value))
+		fmt.Fprintf(buf, "%s_count%s %d\n", f.name, f.labelPairs(s.labelValues, ""), s.count)
+	}
+}
+
+// labelPairs formats the labels, with the "le" label of the bucket if le is not empty.
+func (f *family) labelPairs(labelValues []string, le string) string {
+	pairs := make([]string, 0, len(f.labels)+1)
+	for i, label := range f.labels {
+		pairs = append(pairs, label+`="`+escapeLabelValue(labelValues[i])+`"`)
+	}
+	if le != "" {
+		pairs = append(pairs, `le="`+le+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,71 @@
+package prometheus
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nulab/go-git-http-xfer/githttpxfer"
+)
+
+func Test_Metrics_should_serve_the_text_format(t *testing.T) {
+
+	m := NewWithBuckets([]float64{1, 0.1})
+	fetch := githttpxfer.NewContext(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "http://example.com/foo.git/git-upload-pack", nil), "/foo.git", "")
+	lfs := githttpxfer.NewContext(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "http://example.com/foo.git/info/lfs/objects/batch", nil), "/foo.git", "")
+
+	m.RequestRouted(fetch)
+	m.RequestRouted(fetch)
+	m.RequestRouted(lfs)
+	m.ServiceStarted(fetch, "upload-pack")
+	m.ServiceFinished(fetch, "upload-pack", 0, 50*time.Millisecond)
+	m.ServiceFinished(fetch, "upload-pack", 128, 2*time.Second)
+	m.BytesTransferred(fetch, 100, 2048)
+	m.QueueWaited(fetch, "upload-pack", 500*time.Millisecond, true)
+	m.QueueDepth(3)
+	m.Error(fetch, `a"b`)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/metrics", nil))
+	if contentType := rec.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type is not the text format. result: %s", contentType)
+	}
+	body, _ := ioutil.ReadAll(rec.Body)
+	result := string(body)
+
+	tests := []struct {
+		description string
+		expected    string
+	}{
+		{description: "it should write the type", expected: "# TYPE githttpxfer_requests_total counter\n"},
+		{description: "it should count the requests by the class", expected: `githttpxfer_requests_total{class="fetch"} 2` + "\n"},
+		{description: "it should count the other requests", expected: `githttpxfer_requests_total{class="other"} 1` + "\n"},
+		{description: "it should count the exit codes", expected: `githttpxfer_service_finished_total{service="upload-pack",exit_code="128"} 1` + "\n"},
+		{description: "it should write the sorted buckets", expected: `githttpxfer_service_duration_seconds_bucket{service="upload-pack",le="0.1"} 1` + "\n" + `githttpxfer_service_duration_seconds_bucket{service="upload-pack",le="1"} 1` + "\n" + `githttpxfer_service_duration_seconds_bucket{service="upload-pack",le="+Inf"} 2` + "\n"},
+		{description: "it should write the sum of the histogram", expected: `githttpxfer_service_duration_seconds_sum{service="upload-pack"} 2.05` + "\n"},
+		{description: "it should write the count of the histogram", expected: `githttpxfer_service_duration_seconds_count{service="upload-pack"} 2` + "\n"},
+		{description: "it should count the bytes", expected: `githttpxfer_response_bytes_total{class="fetch"} 2048` + "\n"},
+		{description: "it should write the queue wait", expected: `githttpxfer_queue_wait_seconds_bucket{service="upload-pack",admitted="true",le="1"} 1` + "\n"},
+		{description: "it should write the gauge", expected: "githttpxfer_queue_depth 3\n"},
+		{description: "it should escape the label value", expected: `githttpxfer_errors_total{kind="a\"b"} 1` + "\n"},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		if !strings.Contains(result, tc.expected) {
+			t.Errorf("the exposition does not contain %q . result: %s", tc.expected, result)
+		}
+	}
+}
+
+func Test_Metrics_should_write_the_gauge_before_any_change(t *testing.T) {
+
+	rec := httptest.NewRecorder()
+	New().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/metrics", nil))
+	if expected := "githttpxfer_queue_depth 0\n"; !strings.Contains(rec.Body.String(), expected) {
+		t.Errorf("the exposition does not contain %q . result: %s", expected, rec.Body.String())
+	}
+}
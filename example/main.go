@@ -13,6 +13,7 @@ import (
 	"net/url"
 
 	"github.com/nulab/go-git-http-xfer/addon/handler/archive"
+	"github.com/nulab/go-git-http-xfer/addon/handler/lfs"
 	"github.com/nulab/go-git-http-xfer/githttpxfer"
 )
 
@@ -32,10 +33,25 @@ func main() {
 		// before run service rpc upload.
 	})
 
+	// You can add some addon handler. (git lfs file locking)
+	locking := lfs.NewLocking(ghx, lfs.NewFileLockStore("/data/git"), nil)
+	locking.AddRoutes()
+
 	ghx.Event.On(githttpxfer.BeforeReceivePack, func(ctx githttpxfer.Context) {
 		// before run service rpc receive.
 	})
 
+	// The listeners are called in the order they are added.
+	ghx.Event.On(githttpxfer.BeforeReceivePack, locking.RejectLockedPushes)
+
+	// The listener can stop the request with the status.
+	ghx.Event.Listen(githttpxfer.AfterMatchRouting, func(ctx githttpxfer.Context) error {
+		if strings.HasSuffix(ctx.RepoPath(), ".archived.git") && ctx.Request().Method != http.MethodGet {
+			return &githttpxfer.RejectionError{Status: http.StatusForbidden, Message: "the repository is archived"}
+		}
+		return nil
+	})
+
 	ghx.Event.On(githttpxfer.AfterMatchRouting, func(ctx githttpxfer.Context) {
 		// after match routing.
 	})
@@ -50,7 +66,7 @@ func main() {
 			}
 			repoPath := strings.Replace(u.Path, suffix, "", 1)
 			filePath := strings.Replace(u.Path, repoPath+"/", "", 1)
-			return &githttpxfer.Match{repoPath, filePath}
+			return &githttpxfer.Match{RepoPath: repoPath, FilePath: filePath}
 		},
 		func(ctx githttpxfer.Context) {
 			resp, req := ctx.Response(), ctx.Request()
@@ -68,6 +84,9 @@ func main() {
 		archive.New(ghx).Archive,
 	))
 
+	// You can add some addon handler. (git lfs)
+	lfs.New(ghx, lfs.NewLocalContentStore("/data/git")).AddRoutes()
+
 	// You can add some middleware.
 	chain := NewChain()
 	chain.Use(Logging)
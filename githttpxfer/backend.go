@@ -0,0 +1,21 @@
+package githttpxfer
+
+import "io"
+
+// Backend serves the repositories. The default backend runs the git executable.
+type Backend interface {
+	// Exists reports whether the repository exists.
+	Exists(repoPath string) bool
+	// GetRequestFileInfo returns the file in the repository for the dumb protocol.
+	GetRequestFileInfo(repoPath, filePath string) (*RequestFileInfo, error)
+	// UpdateServerInfo updates the files for the dumb protocol such as info/refs.
+	UpdateServerInfo(ctx Context) error
+	// AdvertiseRefs writes the ref advertisement of the service without the "# service=" preamble.
+	AdvertiseRefs(ctx Context, service string, w io.Writer) error
+	// UploadPack runs upload-pack in the stateless mode with r as the request and w as the response.
+	UploadPack(ctx Context, r io.Reader, w io.Writer) error
+	// ReceivePack runs receive-pack in the stateless mode with r as the request and w as the response.
+	ReceivePack(ctx Context, r io.Reader, w io.Writer) error
+	// SupportsProtocolV2 reports whether upload-pack speaks the protocol v2.
+	SupportsProtocolV2() bool
+}
@@ -0,0 +1,232 @@
+package githttpxfer
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/nulab/go-git-http-xfer/pktline"
+)
+
+const (
+	bundleDir = "bundles"
+	// bundlesToKeep keeps the previous bundle for the clients downloading it.
+	bundlesToKeep = 2
+)
+
+var (
+	getBundleFileRegexp = regexp.MustCompile(".*?(/bundles/bundle-[0-9]{20}-[0-9a-f]{40}\\.bundle)$")
+	getBundleFile       = func(u *url.URL) *Match {
+		return findStringSubmatch(u.Path, getBundleFileRegexp)
+	}
+	bundleFileRegexp = regexp.MustCompile(`^bundle-([0-9]{20})-[0-9a-f]{40}\.bundle$`)
+)
+
+// bundler creates the bundles one at a time for each repository.
+// The push during the creation makes the bundle created once more after it.
+type bundler struct {
+	mu      sync.Mutex
+	running map[string]bool
+	pending map[string]bool
+	// advertised is the bundle that was advertised last in each directory of the bundles, which is not deleted
+	// until the newer one is advertised, since the clients may still download it.
+	advertised map[string]string
+}
+
+func newBundler() *bundler {
+	return &bundler{running: map[string]bool{}, pending: map[string]bool{}, advertised: map[string]string{}}
+}
+
+// CreateBundle creates the bundle of all refs of the repository with "git bundle create".
+// It is called after every push with WithBundleURI(true), or it can be called on a schedule.
+func (ghx *GitHTTPXfer) CreateBundle(repoPath string) error {
+	absRepoPath, err := ghx.Git.GetAbsolutePath(repoPath)
+	if err != nil {
+		return err
+	}
+	absBundleDir := path.Join(absRepoPath, bundleDir)
+	if err := os.MkdirAll(absBundleDir, 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(absBundleDir, "tmp-*.bundle")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	cmd, err := ghx.Git.GitCommand(repoPath, "bundle", "create", "--quiet", tmp, "--all")
+	if err != nil {
+		return err
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create the bundle. %s %s", err.Error(), output)
+	}
+
+	b := ghx.bundler
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bundles, err := listBundles(absBundleDir)
+	if err != nil {
+		return err
+	}
+	seq := uint64(1)
+	if len(bundles) > 0 {
+		seq = bundleSeq(bundles[0]) + 1
+	}
+	name, err := bundleFileName(tmp, seq)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path.Join(absBundleDir, name)); err != nil {
+		return err
+	}
+
+	for i := bundlesToKeep - 1; i < len(bundles); i++ {
+		if bundles[i] != b.advertised[absBundleDir] {
+			os.Remove(bundles[i])
+		}
+	}
+	return nil
+}
+
+// bundleFileName names the bundle after the sequence number and its content.
+// The sequence orders the bundles, and the content lets the bundle be cached forever.
+func bundleFileName(filePath string, seq uint64) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("bundle-%020d-%s.bundle", seq, hex.EncodeToString(h.Sum(nil))), nil
+}
+
+// bundleSeq returns the sequence number in the file name of the bundle.
+func bundleSeq(filePath string) uint64 {
+	m := bundleFileRegexp.FindStringSubmatch(filepath.Base(filePath))
+	if m == nil {
+		return 0
+	}
+	seq, _ := strconv.ParseUint(m[1], 10, 64)
+	return seq
+}
+
+// listBundles returns the bundles from the newest, which has the largest sequence number.
+func listBundles(absBundleDir string) ([]string, error) {
+	files, err := filepath.Glob(path.Join(absBundleDir, "bundle-*.bundle"))
+	if err != nil {
+		return nil, err
+	}
+	bundles := []string{}
+	for _, f := range files {
+		if bundleFileRegexp.MatchString(filepath.Base(f)) {
+			bundles = append(bundles, f)
+		}
+	}
+	// The sequence numbers have the same width, so the names are sorted in the order of them.
+	sort.Sort(sort.Reverse(sort.StringSlice(bundles)))
+	return bundles, nil
+}
+
+// latestBundle returns the file name of the newest bundle of the repository, or empty if there is none.
+// The bundle is kept from the deletion until the newer one is advertised, if advertise is true.
+func (ghx *GitHTTPXfer) latestBundle(repoPath string, advertise bool) string {
+	absRepoPath, err := ghx.Git.GetAbsolutePath(repoPath)
+	if err != nil {
+		return ""
+	}
+	absBundleDir := path.Join(absRepoPath, bundleDir)
+	b := ghx.bundler
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bundles, err := listBundles(absBundleDir)
+	if err != nil || len(bundles) == 0 {
+		return ""
+	}
+	if advertise {
+		b.advertised[absBundleDir] = bundles[0]
+	}
+	return filepath.Base(bundles[0])
+}
+
+func (ghx *GitHTTPXfer) createBundleAfterPush(repoPath string) {
+	b := ghx.bundler
+	b.mu.Lock()
+	if b.running[repoPath] {
+		b.pending[repoPath] = true
+		b.mu.Unlock()
+		return
+	}
+	b.running[repoPath] = true
+	b.mu.Unlock()
+
+	go func() {
+		for {
+			if err := ghx.CreateBundle(repoPath); err != nil {
+				ghx.logger.Error("failed to create the bundle after push", "repo", repoPath, "error", err)
+			}
+			b.mu.Lock()
+			if !b.pending[repoPath] {
+				delete(b.running, repoPath)
+				b.mu.Unlock()
+				return
+			}
+			delete(b.pending, repoPath)
+			b.mu.Unlock()
+		}
+	}()
+}
+
+// advertiseBundleURI adds the bundle-uri capability to the capability advertisement of the protocol v2.
+func advertiseBundleURI(capabilities []byte) []byte {
+	flush := []byte("0000")
+	if !bytes.HasSuffix(capabilities, flush) {
+		return capabilities
+	}
+	n := len(capabilities) - len(flush)
+	buf := bytes.NewBuffer(capabilities[:n:n])
+	w := pktline.NewWriter(buf)
+	w.WriteLine("bundle-uri")
+	w.WriteFlush()
+	return buf.Bytes()
+}
+
+// serveBundleURI answers the bundle-uri command of the protocol v2 with the bundle list.
+func (ghx *GitHTTPXfer) serveBundleURI(ctx Context) {
+	res, req := ctx.Response(), ctx.Request()
+
+	res.SetContentType(fmt.Sprintf("application/x-git-%s-result", uploadPack))
+	res.WriteHeader(http.StatusOK)
+	w := res.PktWriter()
+	if name := ghx.latestBundle(ctx.RepoPath(), true); name != "" {
+		w.WriteLine("bundle.version=1")
+		w.WriteLine("bundle.mode=all")
+		w.WriteLine("bundle.latest.uri=" + ghx.URL(req, ctx.RepoPath()+"/"+bundleDir+"/"+name))
+	}
+	w.WriteFlush()
+}
+
+func (ghx *GitHTTPXfer) getBundleFile(ctx Context) {
+	ctx.Response().HdrCacheForever()
+	if err := ghx.sendFile("application/x-git-bundle", ctx); err != nil {
+		RenderNotFound(ctx.Response().Writer)
+	}
+}
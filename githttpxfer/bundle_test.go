@@ -0,0 +1,119 @@
+package githttpxfer
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+)
+
+func Test_AdvertiseBundleURI(t *testing.T) {
+
+	tests := []struct {
+		description  string
+		capabilities string
+		expected     string
+	}{
+		{
+			description:  "it should add bundle-uri before the flush",
+			capabilities: pktLine("version 2\n") + pktLine("ls-refs=unborn\n") + "0000",
+			expected:     pktLine("version 2\n") + pktLine("ls-refs=unborn\n") + pktLine("bundle-uri\n") + "0000",
+		},
+		{
+			description:  "it should not change the capabilities without the flush",
+			capabilities: pktLine("version 2\n"),
+			expected:     pktLine("version 2\n"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		if result := string(advertiseBundleURI([]byte(tc.capabilities))); tc.expected != result {
+			t.Errorf("capabilities is not %s . result: %s", tc.expected, result)
+		}
+	}
+}
+
+func Test_CreateBundle_should_keep_the_advertised_bundle(t *testing.T) {
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Log("git is not found. so skip bundle test.")
+		return
+	}
+
+	gitRootPath := t.TempDir()
+	workingDirPath := path.Join(gitRootPath, "work")
+	for _, args := range [][]string{
+		{"init", "-q", "--bare", path.Join(gitRootPath, "bundle_test.git")},
+		{"init", "-q", workingDirPath},
+		{"-C", workingDirPath, "-c", "user.name=John Smith", "-c", "user.email=js@example.com", "commit", "-q", "--allow-empty", "-m", "first commit"},
+		{"-C", workingDirPath, "push", "-q", path.Join(gitRootPath, "bundle_test.git"), "HEAD:refs/heads/master"},
+	} {
+		if output, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Errorf("execute command error: %s %s", err.Error(), output)
+			return
+		}
+	}
+
+	ghx, err := New(gitRootPath, "/usr/bin/git")
+	if err != nil {
+		t.Errorf("GitHTTPXfer instance could not be created. %s", err.Error())
+		return
+	}
+	absBundleDir := path.Join(gitRootPath, "bundle_test.git", bundleDir)
+	createBundles := func(n int) bool {
+		for i := 0; i < n; i++ {
+			if err := ghx.CreateBundle("/bundle_test.git"); err != nil {
+				t.Errorf("CreateBundle error: %s", err.Error())
+				return false
+			}
+		}
+		return true
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(path.Join(absBundleDir, name))
+		return err == nil
+	}
+
+	if !createBundles(1) {
+		return
+	}
+	advertised := ghx.latestBundle("/bundle_test.git", true)
+	// The bundles of the same content in the same tick are still ordered.
+	os.Chtimes(path.Join(absBundleDir, advertised), time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+	if !createBundles(3) {
+		return
+	}
+	newest := ghx.latestBundle("/bundle_test.git", false)
+	if newest == advertised {
+		t.Errorf("the newest bundle is not the one created last. result: %s", newest)
+		return
+	}
+
+	tests := []struct {
+		description string
+		name        string
+		expected    bool
+	}{
+		{description: "it should keep the advertised bundle", name: advertised, expected: true},
+		{description: "it should keep the newest bundle", name: newest, expected: true},
+	}
+	for _, tc := range tests {
+		t.Log(tc.description)
+		if result := exists(tc.name); result != tc.expected {
+			t.Errorf("exists is not %t . result: %t", tc.expected, result)
+		}
+	}
+	if bundles, _ := listBundles(absBundleDir); len(bundles) != bundlesToKeep+1 {
+		t.Errorf("the number of the bundles is not %d . result: %d", bundlesToKeep+1, len(bundles))
+	}
+
+	ghx.latestBundle("/bundle_test.git", true)
+	if !createBundles(1) {
+		return
+	}
+	if exists(advertised) {
+		t.Errorf("the bundle that is advertised before is not deleted. result: %s", advertised)
+	}
+}
@@ -0,0 +1,339 @@
+package githttpxfer
+
+import (
+	"bytes"
+	gocontext "context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadPackCoalescer shares one upload-pack among the identical requests in flight.
+// The output is spooled to a file, so that a request that joins late reads it from the beginning.
+type uploadPackCoalescer struct {
+	dir string
+
+	mu      sync.Mutex
+	flights map[string]*uploadPackFlight
+}
+
+func newUploadPackCoalescer(dir string) *uploadPackCoalescer {
+	return &uploadPackCoalescer{dir: dir, flights: map[string]*uploadPackFlight{}}
+}
+
+type uploadPackFlight struct {
+	coalescer *uploadPackCoalescer
+	key       string
+	spool     *os.File
+	cancel    gocontext.CancelFunc
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	started bool
+	size    int64
+	done    bool
+	err     error
+	result  *Result
+	waiters int
+}
+
+// errFlightAbandoned finishes the flight whose creator has gone before it was admitted.
+// The requests that have joined it join again, and one of them starts the new flight.
+var errFlightAbandoned = errors.New("the flight is abandoned before it starts")
+
+// join returns the flight of key. The caller that creates the flight must start it.
+func (c *uploadPackCoalescer) join(key string) (f *uploadPackFlight, created bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f, ok := c.flights[key]; ok {
+		f.mu.Lock()
+		f.waiters++
+		f.mu.Unlock()
+		return f, false, nil
+	}
+
+	spool, err := ioutil.TempFile(c.dir, "upload-pack-")
+	if err != nil {
+		return nil, false, err
+	}
+	// The spool is removed when it is closed.
+	os.Remove(spool.Name())
+
+	f = &uploadPackFlight{coalescer: c, key: key, spool: spool, waiters: 1}
+	f.cond = sync.NewCond(&f.mu)
+	c.flights[key] = f
+	return f, true, nil
+}
+
+// leave cancels the flight when no one waits for it anymore.
+func (f *uploadPackFlight) leave() {
+	f.coalescer.mu.Lock()
+	defer f.coalescer.mu.Unlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.waiters--
+	if f.waiters > 0 {
+		return
+	}
+	if f.done {
+		f.spool.Close()
+		return
+	}
+	delete(f.coalescer.flights, f.key)
+	f.cancel()
+}
+
+func (f *uploadPackFlight) Write(p []byte) (int, error) {
+	n, err := f.spool.Write(p)
+	f.mu.Lock()
+	f.size += int64(n)
+	f.cond.Broadcast()
+	f.mu.Unlock()
+	return n, err
+}
+
+func (f *uploadPackFlight) start() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.started = true
+	f.cond.Broadcast()
+}
+
+// abandoned waits until the flight starts or finishes, and returns true if it is abandoned.
+// It returns false when ctx is done, and copyTo returns the error of ctx.
+func (f *uploadPackFlight) abandoned(ctx gocontext.Context) bool {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.mu.Lock()
+			f.cond.Broadcast()
+			f.mu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for !f.started && !f.done && ctx.Err() == nil {
+		f.cond.Wait()
+	}
+	return f.done && f.err == errFlightAbandoned
+}
+
+func (f *uploadPackFlight) finish(err error) {
+	f.coalescer.mu.Lock()
+	defer f.coalescer.mu.Unlock()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.coalescer.flights[f.key] == f {
+		delete(f.coalescer.flights, f.key)
+	}
+	f.done = true
+	f.err = err
+	f.cond.Broadcast()
+	if f.waiters == 0 {
+		f.spool.Close()
+	}
+}
+
+// requestResult returns the result of upload-pack for each request that shares it.
+func (f *uploadPackFlight) requestResult(err error, bytesIn, bytesOut int64, duration time.Duration) *Result {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	result := &Result{Service: uploadPack}
+	if f.result != nil {
+		*result = *f.result
+	}
+	result.ExitCode = ExitCode(err)
+	result.BytesIn = bytesIn
+	result.BytesOut = bytesOut
+	result.Duration = duration
+	result.Err = err
+	return result
+}
+
+// copyTo copies the output to w as it is written, until the flight is done or ctx is done.
+func (f *uploadPackFlight) copyTo(ctx gocontext.Context, w io.Writer) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.mu.Lock()
+			f.cond.Broadcast()
+			f.mu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	buf := bufPool.Get().([]byte)
+	defer bufPool.Put(buf)
+
+	var offset int64
+	for {
+		f.mu.Lock()
+		for offset == f.size && !f.done && ctx.Err() == nil {
+			f.cond.Wait()
+		}
+		size, done, err := f.size, f.done, f.err
+		f.mu.Unlock()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if offset < size {
+			p := buf
+			if remaining := size - offset; remaining < int64(len(p)) {
+				p = p[:remaining]
+			}
+			n, err := f.spool.ReadAt(p, offset)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if _, err := w.Write(p[:n]); err != nil {
+				return err
+			}
+			offset += int64(n)
+			continue
+		}
+		if done {
+			return err
+		}
+	}
+}
+
+// flightResponseWriter is the response of the flight, which discards everything.
+// The output goes to the spool, and the flight must not touch the response of any request,
+// such as the deadlines that the watchdog sets, because it outlives the request that has created it.
+type flightResponseWriter struct {
+	header http.Header
+}
+
+func (w *flightResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *flightResponseWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w *flightResponseWriter) WriteHeader(statusCode int) {}
+
+// coalesceKey returns the hash of the repository, the environment and the request.
+// GIT_PROTOCOL and the config of upload-pack are included, because they change the output.
+// The environment is sorted, since upload-pack runs with the environment of the first request.
+func (ghx *GitHTTPXfer) coalesceKey(ctx Context, request []byte) string {
+	env := append([]string{}, ctx.Env()...)
+	sort.Strings(env)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", ctx.RepoPath(), ghx.gitProtocol(ctx, uploadPack), strings.Join(ghx.uploadPackConfig(ctx).gitConfig(), " "))
+	for _, kv := range env {
+		fmt.Fprintf(h, "%q\n", kv)
+	}
+	h.Write(request)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// serviceRPCUploadCoalesced runs upload-pack like serviceRPC, but shares it with the identical requests in flight.
+// upload-pack runs with the environment of the first request, and it is stopped when all the clients disconnect.
+func (ghx *GitHTTPXfer) serviceRPCUploadCoalesced(ctx Context, request []byte, copyOutput func(w io.Writer, stdout io.Reader) error) error {
+	ctx.SetEnv(ghx.commandEnv(ctx, uploadPack))
+	key := ghx.coalesceKey(ctx, request)
+
+	for {
+		f, created, err := ghx.coalescer.join(key)
+		if err != nil {
+			ctx.Logger().Error("failed to create the spool of upload-pack", "error", err)
+			RenderInternalServerError(ctx.Response().Writer)
+			return err
+		}
+		err = ghx.serveUploadPackFlight(ctx, f, created, request, copyOutput)
+		f.leave()
+		if err != errFlightAbandoned {
+			return err
+		}
+	}
+}
+
+// serveUploadPackFlight starts the flight if created, and copies the output of the flight to the response.
+// errFlightAbandoned is returned without the response if the flight that has been joined is abandoned.
+func (ghx *GitHTTPXfer) serveUploadPackFlight(ctx Context, f *uploadPackFlight, created bool, request []byte, copyOutput func(w io.Writer, stdout io.Reader) error) error {
+	res, req := ctx.Response(), ctx.Request()
+
+	if !created && f.abandoned(req.Context()) {
+		return errFlightAbandoned
+	}
+	if created {
+		release, refusal, ok := ghx.admit(ctx, uploadPack)
+		if !ok {
+			if refusal == nil {
+				// The client has gone while it waits. The requests that have joined start the flight again.
+				f.finish(errFlightAbandoned)
+				return errNotAdmitted
+			}
+			// The requests that have joined are refused with the same status.
+			refusal.render(res.Writer)
+			f.finish(refusal)
+			return errNotAdmitted
+		}
+		// The flight outlives the request that created it, so it has its own context and response.
+		flightCtx, cancel := gocontext.WithCancel(gocontext.Background())
+		f.cancel = cancel
+		fctx := NewContext(&flightResponseWriter{header: http.Header{}}, req.WithContext(flightCtx), ctx.RepoPath(), ctx.FilePath())
+		fctx.SetEnv(ctx.Env())
+		fctx.SetLogger(ctx.Logger())
+		fctx.SetUploadPackRequest(ctx.UploadPackRequest())
+		f.start()
+		go func() {
+			defer cancel()
+			defer release()
+			err := ghx.RunService(fctx, uploadPack, bytes.NewReader(request), f, func(r io.Reader, w io.Writer) error {
+				return ghx.Backend.UploadPack(fctx, r, w)
+			})
+			f.mu.Lock()
+			f.result = fctx.Result()
+			f.mu.Unlock()
+			f.finish(err)
+		}()
+	}
+
+	start := time.Now()
+	w := &rpcResponseWriter{res: res, rpc: uploadPack}
+	out := &countingWriter{w: w}
+	err := copyRPCOutput(out, copyOutput, func(w io.Writer) error {
+		return f.copyTo(req.Context(), w)
+	})
+	if refusal, ok := err.(*admissionRefusal); ok {
+		ghx.ReportError(ctx, ErrorKindNotAdmitted, refusal.err)
+		if !w.wroteHeader {
+			refusal.render(res.Writer)
+		}
+		return errNotAdmitted
+	}
+	ctx.SetResult(f.requestResult(err, int64(len(request)), out.n, time.Since(start)))
+	defer ghx.Event.notify(AfterUploadPack, ctx)
+	if err != nil {
+		ctx.Logger().Error("failed to run "+uploadPack, "error", err)
+		ghx.ReportError(ctx, serviceErrorKind(err), err)
+		if !w.wroteHeader {
+			RenderInternalServerError(res.Writer)
+		}
+		return err
+	}
+	w.writeHeader()
+	return nil
+}
@@ -0,0 +1,181 @@
+package githttpxfer
+
+import (
+	"bytes"
+	gocontext "context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_UploadPackCoalescer_should_fan_out_the_output(t *testing.T) {
+
+	c := newUploadPackCoalescer("")
+
+	f, created, err := c.join("key")
+	if err != nil || !created {
+		t.Errorf("the flight is not created. error: %v", err)
+		return
+	}
+	f.cancel = func() {}
+	f.Write([]byte("0008NAK\n"))
+
+	joined, created, err := c.join("key")
+	if err != nil || created || joined != f {
+		t.Errorf("the flight is not shared. error: %v", err)
+		return
+	}
+
+	results := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			buf := &bytes.Buffer{}
+			f.copyTo(gocontext.Background(), buf)
+			f.leave()
+			results <- buf.String()
+		}()
+	}
+
+	f.Write([]byte("PACK"))
+	f.finish(nil)
+
+	for i := 0; i < 2; i++ {
+		if result := <-results; result != "0008NAK\nPACK" {
+			t.Errorf("output is not 0008NAK\\nPACK . result: %q", result)
+		}
+	}
+
+	if _, created, _ := c.join("key"); !created {
+		t.Error("the finished flight is shared.")
+	}
+}
+
+func Test_UploadPackCoalescer_should_cancel_when_all_clients_leave(t *testing.T) {
+
+	c := newUploadPackCoalescer("")
+
+	f, _, err := c.join("key")
+	if err != nil {
+		t.Errorf("join error: %s", err.Error())
+		return
+	}
+	canceled := false
+	f.cancel = func() { canceled = true }
+	c.join("key")
+
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	copied := make(chan error, 1)
+	go func() {
+		copied <- f.copyTo(ctx, &bytes.Buffer{})
+	}()
+	cancel()
+
+	select {
+	case err := <-copied:
+		if err != gocontext.Canceled {
+			t.Errorf("error is not %s . result: %v", gocontext.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("copyTo does not return after the client disconnects.")
+		return
+	}
+
+	f.leave()
+	if canceled {
+		t.Error("the flight is canceled while a client waits.")
+	}
+	f.leave()
+	if !canceled {
+		t.Error("the flight is not canceled after all clients leave.")
+	}
+	if _, ok := c.flights["key"]; ok {
+		t.Error("the canceled flight remains.")
+	}
+}
+
+func Test_UploadPackCoalescer_should_hand_over_the_abandoned_flight(t *testing.T) {
+
+	tests := []struct {
+		description string
+		run         func(f *uploadPackFlight)
+		expected    bool
+	}{
+		{
+			description: "it should tell the joined request that the flight is abandoned",
+			run:         func(f *uploadPackFlight) { f.finish(errFlightAbandoned) },
+			expected:    true,
+		},
+		{
+			description: "it should not tell the joined request that the started flight is abandoned",
+			run:         func(f *uploadPackFlight) { f.start() },
+			expected:    false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		c := newUploadPackCoalescer("")
+		f, _, err := c.join("key")
+		if err != nil {
+			t.Errorf("join error: %s", err.Error())
+			return
+		}
+		f.cancel = func() {}
+		c.join("key")
+
+		abandoned := make(chan bool, 1)
+		go func() {
+			abandoned <- f.abandoned(gocontext.Background())
+		}()
+		tc.run(f)
+
+		select {
+		case result := <-abandoned:
+			if result != tc.expected {
+				t.Errorf("abandoned is not %t . result: %t", tc.expected, result)
+			}
+		case <-time.After(time.Second):
+			t.Error("abandoned does not return.")
+			return
+		}
+		if _, shared := c.flights["key"]; shared == tc.expected {
+			t.Errorf("the flight is shared is not %t . result: %t", !tc.expected, shared)
+		}
+		f.leave()
+		f.leave()
+	}
+}
+
+func Test_coalesceKey_should_include_the_environment(t *testing.T) {
+
+	ghx, err := New("/data/git", "/usr/bin/git")
+	if err != nil {
+		t.Errorf("An instance could not be created. %s", err.Error())
+		return
+	}
+
+	key := func(env ...string) string {
+		ctx := NewContext(httptest.NewRecorder(), httptest.NewRequest("POST", "/test.git/git-upload-pack", nil), "/test.git", "git-upload-pack")
+		ctx.SetEnv(env)
+		return ghx.coalesceKey(ctx, []byte("0000"))
+	}
+
+	tests := []struct {
+		description string
+		env         []string
+		same        bool
+	}{
+		{description: "it should share the same environment", env: []string{"A=1", "B=2"}, same: true},
+		{description: "it should share the environment in another order", env: []string{"B=2", "A=1"}, same: true},
+		{description: "it should not share another environment", env: []string{"A=1", "B=3"}},
+		{description: "it should not share the empty environment", env: nil},
+	}
+
+	expected := key("A=1", "B=2")
+	for _, tc := range tests {
+		t.Log(tc.description)
+		if same := key(tc.env...) == expected; same != tc.same {
+			t.Errorf("the key is not shared as %t . result: %t", tc.same, same)
+		}
+	}
+}
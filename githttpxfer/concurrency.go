@@ -0,0 +1,256 @@
+package githttpxfer
+
+import (
+	"container/list"
+	gocontext "context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ConcurrencyLimits limits the git processes that run at once. Zero means no limit.
+type ConcurrencyLimits struct {
+	Global  int
+	PerRepo int
+	// PerService limits the processes of the service such as "upload-pack", "receive-pack", "archive"
+	// and "update-server-info" of the dumb protocol.
+	PerService map[string]int
+
+	// QueueSize is the number of the requests that wait for a slot. The request is refused at once if it is zero.
+	QueueSize int
+	// QueueTimeout is the time that the request waits in the queue. Zero means until the client disconnects.
+	QueueTimeout time.Duration
+	// RetryAfter is sent with the refusal. It is one second if zero.
+	RetryAfter time.Duration
+
+	// OnQueueDepth is called with the number of the waiting requests whenever it changes.
+	OnQueueDepth func(depth int)
+}
+
+// errNotAdmitted is returned after Admit has refused the request.
+var errNotAdmitted = errors.New("the request is not admitted")
+
+// AdmissionError is the refusal of the request because the limit is saturated.
+type AdmissionError struct {
+	Service  string
+	RepoPath string
+	// Limit is "global", "repository" or "service".
+	Limit string
+	// QueueFull is false if the request timed out in the queue.
+	QueueFull bool
+}
+
+func (e *AdmissionError) Error() string {
+	reason := "timed out in the queue"
+	if e.QueueFull {
+		reason = "the queue is full"
+	}
+	return fmt.Sprintf("the %s limit of %s is saturated. %s. repository: %s", e.Limit, e.Service, reason, e.RepoPath)
+}
+
+func newLimiter(limits ConcurrencyLimits) *limiter {
+	return &limiter{
+		limits:   limits,
+		repos:    map[string]int{},
+		services: map[string]int{},
+		queue:    list.New(),
+	}
+}
+
+type limiter struct {
+	limits ConcurrencyLimits
+
+	mu       sync.Mutex
+	running  int
+	repos    map[string]int
+	services map[string]int
+	queue    *list.List
+}
+
+type waiter struct {
+	repoPath, service string
+	admitted          chan struct{}
+}
+
+// saturated returns the limit that the process would exceed, or "".
+// The repository limit comes first, because it is what the clients of the repository should back off from.
+func (l *limiter) saturated(repoPath, service string) string {
+	switch {
+	case l.limits.PerRepo > 0 && l.repos[repoPath] >= l.limits.PerRepo:
+		return "repository"
+	case l.limits.PerService[service] > 0 && l.services[service] >= l.limits.PerService[service]:
+		return "service"
+	case l.limits.Global > 0 && l.running >= l.limits.Global:
+		return "global"
+	}
+	return ""
+}
+
+func (l *limiter) start(repoPath, service string) {
+	l.running++
+	l.repos[repoPath]++
+	l.services[service]++
+}
+
+// acquire waits for the slot in the queue, and returns the function that releases it and the time waited in the queue.
+// The request that can run skips the queue, because the waiting ones are blocked by the limits that it does not hit.
+func (l *limiter) acquire(ctx gocontext.Context, repoPath, service string) (func(), time.Duration, error) {
+	l.mu.Lock()
+	limit := l.saturated(repoPath, service)
+	if limit == "" {
+		l.start(repoPath, service)
+		l.mu.Unlock()
+		return l.releaseFunc(repoPath, service), 0, nil
+	}
+	if l.queue.Len() >= l.limits.QueueSize {
+		l.mu.Unlock()
+		return nil, 0, &AdmissionError{Service: service, RepoPath: repoPath, Limit: limit, QueueFull: true}
+	}
+	queued := time.Now()
+	w := &waiter{repoPath: repoPath, service: service, admitted: make(chan struct{})}
+	e := l.queue.PushBack(w)
+	l.reportQueueDepth()
+	l.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if l.limits.QueueTimeout > 0 {
+		timer := time.NewTimer(l.limits.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case <-w.admitted:
+		return l.releaseFunc(repoPath, service), time.Since(queued), nil
+	case <-timeout:
+		err = &AdmissionError{Service: service, RepoPath: repoPath, Limit: limit}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-w.admitted:
+		// admitted just before giving up.
+		return l.releaseFunc(repoPath, service), time.Since(queued), nil
+	default:
+	}
+	l.queue.Remove(e)
+	l.reportQueueDepth()
+	return nil, time.Since(queued), err
+}
+
+func (l *limiter) releaseFunc(repoPath, service string) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { l.release(repoPath, service) })
+	}
+}
+
+// release frees the slot, and admits the waiting requests in order as long as the limits allow.
+func (l *limiter) release(repoPath, service string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.running--
+	if l.repos[repoPath]--; l.repos[repoPath] == 0 {
+		delete(l.repos, repoPath)
+	}
+	if l.services[service]--; l.services[service] == 0 {
+		delete(l.services, service)
+	}
+
+	admitted := false
+	for e := l.queue.Front(); e != nil; {
+		next := e.Next()
+		w := e.Value.(*waiter)
+		if l.saturated(w.repoPath, w.service) == "" {
+			l.start(w.repoPath, w.service)
+			l.queue.Remove(e)
+			close(w.admitted)
+			admitted = true
+		}
+		e = next
+	}
+	if admitted {
+		l.reportQueueDepth()
+	}
+}
+
+func (l *limiter) reportQueueDepth() {
+	if l.limits.OnQueueDepth != nil {
+		l.limits.OnQueueDepth(l.queue.Len())
+	}
+}
+
+// QueueDepth returns the number of the requests waiting for a git process.
+func (ghx *GitHTTPXfer) QueueDepth() int {
+	if ghx.limiter == nil {
+		return 0
+	}
+	ghx.limiter.mu.Lock()
+	defer ghx.limiter.mu.Unlock()
+	return ghx.limiter.queue.Len()
+}
+
+// Admit waits until the git process of the service may run in the repository, and returns the function to call after it exits.
+// If the limits are saturated, it renders "429 Too Many Requests" for the repository limit
+// or "503 Service Unavailable" for the others with Retry-After, and returns false.
+func (ghx *GitHTTPXfer) Admit(ctx Context, service string) (release func(), ok bool) {
+	release, refusal, ok := ghx.admit(ctx, service)
+	if refusal != nil {
+		refusal.render(ctx.Response().Writer)
+	}
+	return release, ok
+}
+
+// admissionRefusal is the status that is rendered for the request that Admit has refused.
+type admissionRefusal struct {
+	err        *AdmissionError
+	status     int
+	retryAfter time.Duration
+}
+
+func (r *admissionRefusal) Error() string {
+	return r.err.Error()
+}
+
+func (r *admissionRefusal) render(w http.ResponseWriter) {
+	RenderRetryAfter(w, r.status, r.retryAfter)
+}
+
+// admit is Admit without rendering. refusal is nil if the request is admitted or the client has disconnected.
+func (ghx *GitHTTPXfer) admit(ctx Context, service string) (release func(), refusal *admissionRefusal, ok bool) {
+	if ghx.limiter == nil {
+		return func() {}, nil, true
+	}
+	release, wait, err := ghx.limiter.acquire(ctx.Request().Context(), ctx.RepoPath(), service)
+	if wait > 0 {
+		ctx.Logger().Debug("the request has waited in the queue", "wait", wait, "admitted", err == nil)
+		ghx.metrics.QueueWaited(ctx, service, wait, err == nil)
+	}
+	if err == nil {
+		return release, nil, true
+	}
+	admissionErr, ok := err.(*AdmissionError)
+	if !ok {
+		// The client has disconnected.
+		return nil, nil, false
+	}
+	ctx.Logger().Warn("the request is refused", "error", admissionErr, "queue_depth", ghx.QueueDepth())
+	ghx.ReportError(ctx, ErrorKindNotAdmitted, admissionErr)
+
+	retryAfter := ghx.limiter.limits.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = time.Second
+	}
+	status := http.StatusServiceUnavailable
+	if admissionErr.Limit == "repository" {
+		status = http.StatusTooManyRequests
+	}
+	return nil, &admissionRefusal{err: admissionErr, status: status, retryAfter: retryAfter}, false
+}
@@ -0,0 +1,213 @@
+package githttpxfer
+
+import (
+	gocontext "context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_Limiter_should_queue_the_processes_over_the_limits(t *testing.T) {
+
+	depths := []int{}
+	var mu sync.Mutex
+	l := newLimiter(ConcurrencyLimits{
+		Global:     2,
+		PerRepo:    1,
+		PerService: map[string]int{"receive-pack": 1},
+		QueueSize:  1,
+		OnQueueDepth: func(depth int) {
+			mu.Lock()
+			defer mu.Unlock()
+			depths = append(depths, depth)
+		},
+	})
+	ctx := gocontext.Background()
+
+	releaseA, _, err := l.acquire(ctx, "/a.git", uploadPack)
+	if err != nil {
+		t.Errorf("the first process is not admitted. %s", err.Error())
+		return
+	}
+
+	admitted := make(chan func())
+	go func() {
+		release, _, err := l.acquire(ctx, "/a.git", uploadPack)
+		if err != nil {
+			t.Errorf("the queued process is not admitted. %s", err.Error())
+		}
+		admitted <- release
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	tests := []struct {
+		description string
+		repoPath    string
+		service     string
+		expected    *AdmissionError
+	}{
+		{
+			description: "it should refuse the process when the queue is full",
+			repoPath:    "/a.git",
+			service:     uploadPack,
+			expected:    &AdmissionError{Service: uploadPack, RepoPath: "/a.git", Limit: "repository", QueueFull: true},
+		},
+		{
+			description: "it should admit the process of another repository that skips the queue",
+			repoPath:    "/b.git",
+			service:     receivePack,
+		},
+		{
+			description: "it should refuse the process over the global limit",
+			repoPath:    "/c.git",
+			service:     uploadPack,
+			expected:    &AdmissionError{Service: uploadPack, RepoPath: "/c.git", Limit: "global", QueueFull: true},
+		},
+	}
+	releases := []func(){}
+	for _, tc := range tests {
+		t.Log(tc.description)
+		release, _, err := l.acquire(ctx, tc.repoPath, tc.service)
+		if tc.expected == nil {
+			if err != nil {
+				t.Errorf("the process is not admitted. %s", err.Error())
+				return
+			}
+			releases = append(releases, release)
+			continue
+		}
+		if admissionErr, ok := err.(*AdmissionError); !ok || *admissionErr != *tc.expected {
+			t.Errorf("error is not %v . result: %v", tc.expected, err)
+			return
+		}
+	}
+
+	releaseA()
+	release := <-admitted
+	release()
+	release() // released only once
+	for _, release := range releases {
+		release()
+	}
+
+	if l.running != 0 || len(l.repos) != 0 || len(l.services) != 0 || l.queue.Len() != 0 {
+		t.Errorf("the slots are not released. running: %d, repos: %v, services: %v", l.running, l.repos, l.services)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(depths) != 2 || depths[0] != 1 || depths[1] != 0 {
+		t.Errorf("the queue depths are not [1 0] . result: %v", depths)
+	}
+}
+
+func Test_Limiter_should_time_out_in_the_queue(t *testing.T) {
+
+	l := newLimiter(ConcurrencyLimits{Global: 1, QueueSize: 1, QueueTimeout: 50 * time.Millisecond})
+	release, _, _ := l.acquire(gocontext.Background(), "/a.git", uploadPack)
+	defer release()
+
+	_, _, err := l.acquire(gocontext.Background(), "/b.git", uploadPack)
+	if admissionErr, ok := err.(*AdmissionError); !ok || admissionErr.QueueFull || admissionErr.Limit != "global" {
+		t.Errorf("the request does not time out. result: %v", err)
+		return
+	}
+
+	ctx, cancel := gocontext.WithCancel(gocontext.Background())
+	cancel()
+	if _, _, err := l.acquire(ctx, "/b.git", uploadPack); err != gocontext.Canceled {
+		t.Errorf("error is not %v . result: %v", gocontext.Canceled, err)
+		return
+	}
+	if l.queue.Len() != 0 {
+		t.Errorf("the queue is not empty. result: %d", l.queue.Len())
+	}
+}
+
+func Test_Admit_should_render_retry_after(t *testing.T) {
+
+	ghx, err := New("/data/git", "/usr/bin/git", WithConcurrencyLimits(ConcurrencyLimits{Global: 2, PerRepo: 1, RetryAfter: 1500 * time.Millisecond}))
+	if err != nil {
+		t.Errorf("An instance could not be created. %s", err.Error())
+		return
+	}
+
+	newContext := func(repoPath string) (Context, *httptest.ResponseRecorder) {
+		rec := httptest.NewRecorder()
+		return NewContext(rec, httptest.NewRequest(http.MethodPost, "http://example.com"+repoPath+"/git-upload-pack", nil), repoPath, "git-upload-pack"), rec
+	}
+
+	ctx, _ := newContext("/a.git")
+	releaseA, ok := ghx.Admit(ctx, uploadPack)
+	if !ok {
+		t.Error("the first process is not admitted.")
+		return
+	}
+	defer releaseA()
+	ctx, _ = newContext("/b.git")
+	releaseB, ok := ghx.Admit(ctx, uploadPack)
+	if !ok {
+		t.Error("the second process is not admitted.")
+		return
+	}
+	defer releaseB()
+
+	tests := []struct {
+		description string
+		repoPath    string
+		expected    int
+	}{
+		{description: "it should render 429 for the repository limit", repoPath: "/a.git", expected: http.StatusTooManyRequests},
+		{description: "it should render 503 for the global limit", repoPath: "/c.git", expected: http.StatusServiceUnavailable},
+	}
+	for _, tc := range tests {
+		t.Log(tc.description)
+		ctx, rec := newContext(tc.repoPath)
+		if _, ok := ghx.Admit(ctx, uploadPack); ok {
+			t.Error("the process is admitted over the limit.")
+			return
+		}
+		if rec.Code != tc.expected || rec.Header().Get("Retry-After") != "2" {
+			t.Errorf("StatusCode is not %d . result: %d, Retry-After: %s", tc.expected, rec.Code, rec.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func Test_ServeHTTP_should_limit_the_ref_advertisement(t *testing.T) {
+
+	ghx, err := New("/data/git", "/usr/bin/git", WithConcurrencyLimits(ConcurrencyLimits{PerRepo: 1}))
+	if err != nil {
+		t.Errorf("An instance could not be created. %s", err.Error())
+		return
+	}
+
+	ctx := NewContext(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "http://example.com/test.git/git-upload-pack", nil), "/test.git", "git-upload-pack")
+	release, ok := ghx.Admit(ctx, uploadPack)
+	if !ok {
+		t.Error("the first process is not admitted.")
+		return
+	}
+
+	tests := []struct {
+		description string
+		url         string
+		expected    int
+	}{
+		{description: "it should refuse the advertisement over the limit", url: "http://example.com/test.git/info/refs?service=git-upload-pack", expected: http.StatusTooManyRequests},
+		{description: "it should refuse the info/refs of the dumb protocol over the limit", url: "http://example.com/test.git/info/refs", expected: http.StatusTooManyRequests},
+		{description: "it should advertise the refs after the release", url: "http://example.com/test.git/info/refs?service=git-upload-pack", expected: http.StatusOK},
+	}
+	for i, tc := range tests {
+		t.Log(tc.description)
+		rec := httptest.NewRecorder()
+		ghx.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if rec.Code != tc.expected {
+			t.Errorf("StatusCode is not %d . result: %d", tc.expected, rec.Code)
+		}
+		if release != nil && i == 1 {
+			release()
+			release = nil
+		}
+	}
+}
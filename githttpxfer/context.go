@@ -15,6 +15,16 @@ type (
 		SetFilePath(filePath string)
 		Env() []string
 		SetEnv(env []string)
+		Reject(message string)
+		Rejected() (message string, rejected bool)
+		ReceivePackRequest() *ReceivePackRequest
+		SetReceivePackRequest(r *ReceivePackRequest)
+		UploadPackRequest() *UploadPackRequest
+		SetUploadPackRequest(r *UploadPackRequest)
+		Logger() Logger
+		SetLogger(logger Logger)
+		Result() *Result
+		SetResult(r *Result)
 	}
 
 	context struct {
@@ -23,6 +33,13 @@ type (
 		repoPath string
 		filePath string
 		env      []string
+		rejected bool
+		message  string
+
+		receivePackRequest *ReceivePackRequest
+		uploadPackRequest  *UploadPackRequest
+		logger             Logger
+		result             *Result
 	}
 )
 
@@ -32,6 +49,7 @@ func NewContext(rw http.ResponseWriter, r *http.Request, repoPath string, filePa
 		request:  r,
 		repoPath: repoPath,
 		filePath: filePath,
+		logger:   &defaultLogger{},
 	}
 }
 
@@ -70,3 +88,49 @@ func (c *context) Env() []string {
 func (c *context) SetEnv(env []string) {
 	c.env = env
 }
+
+// Reject refuses the push or fetch. The message is shown to the user by the git client.
+func (c *context) Reject(message string) {
+	c.rejected = true
+	c.message = message
+}
+
+func (c *context) Rejected() (string, bool) {
+	return c.message, c.rejected
+}
+
+// ReceivePackRequest returns the parsed front of the receive-pack request. It is nil for the other routes.
+func (c *context) ReceivePackRequest() *ReceivePackRequest {
+	return c.receivePackRequest
+}
+
+func (c *context) SetReceivePackRequest(r *ReceivePackRequest) {
+	c.receivePackRequest = r
+}
+
+// UploadPackRequest returns the parsed negotiation of the upload-pack request. It is nil for the other routes.
+func (c *context) UploadPackRequest() *UploadPackRequest {
+	return c.uploadPackRequest
+}
+
+func (c *context) SetUploadPackRequest(r *UploadPackRequest) {
+	c.uploadPackRequest = r
+}
+
+// Logger returns the logger of the request, which has the fields such as the repository and the request ID.
+func (c *context) Logger() Logger {
+	return c.logger
+}
+
+func (c *context) SetLogger(logger Logger) {
+	c.logger = logger
+}
+
+// Result returns the outcome of the service. It is set after the service has run, or when the request fails.
+func (c *context) Result() *Result {
+	return c.result
+}
+
+func (c *context) SetResult(r *Result) {
+	c.result = r
+}
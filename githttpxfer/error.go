@@ -19,3 +19,44 @@ type MethodNotAllowedError struct {
 func (e *MethodNotAllowedError) Error() string {
 	return fmt.Sprintf("Method Not Allowed: Method %s, Path %s", e.Method, e.Path)
 }
+
+// BodyTooLargeError is the error of the request body that exceeds the limit.
+type BodyTooLargeError struct {
+	Limit        int64
+	Decompressed bool
+}
+
+func (e *BodyTooLargeError) Error() string {
+	if e.Decompressed {
+		return fmt.Sprintf("the decompressed request body exceeds the limit of %d bytes", e.Limit)
+	}
+	return fmt.Sprintf("the request body exceeds the limit of %d bytes", e.Limit)
+}
+
+// BufferTooLargeError is the error of the beginning of the request body that exceeds the limit to parse in memory.
+type BufferTooLargeError struct {
+	Limit int64
+}
+
+func (e *BufferTooLargeError) Error() string {
+	return fmt.Sprintf("the request exceeds the limit of %d bytes to parse", e.Limit)
+}
+
+// RepositoryNotFoundError is the error of RepoResolver for the repository that does not exist.
+type RepositoryNotFoundError struct {
+	RepoPath string
+}
+
+func (e *RepositoryNotFoundError) Error() string {
+	return fmt.Sprintf("Repository Not Found: Path %s", e.RepoPath)
+}
+
+// UnsafePathError is the error of the path that may escape from the root of the repositories or the repository.
+type UnsafePathError struct {
+	Path   string
+	Reason string
+}
+
+func (e *UnsafePathError) Error() string {
+	return fmt.Sprintf("Unsafe Path: Path %s, %s", e.Path, e.Reason)
+}
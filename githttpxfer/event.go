@@ -0,0 +1,144 @@
+package githttpxfer
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+)
+
+type EventKey string
+
+const (
+	BeforeUploadPack  EventKey = "before-upload-pack"
+	BeforeReceivePack EventKey = "before-receive-pack"
+	AfterMatchRouting EventKey = "after-match-routing"
+	// BeforeInfoRefs is emitted before the refs are advertised to the smart protocol.
+	BeforeInfoRefs EventKey = "before-info-refs"
+	// BeforeServeFile is emitted before the file of the repository is served to the dumb protocol.
+	BeforeServeFile EventKey = "before-serve-file"
+
+	// The After* events are emitted after the service has run, with Context.Result.
+	// Their listeners can not stop the request.
+	AfterUploadPack  EventKey = "after-upload-pack"
+	AfterReceivePack EventKey = "after-receive-pack"
+	// OnError is emitted when the request fails, with Result.Err and Result.ErrorKind.
+	OnError EventKey = "on-error"
+	// RepositoryCreated is emitted after the repository has been created by the first push. See WithPushToCreate.
+	RepositoryCreated EventKey = "repository-created"
+)
+
+// Listener is the listener that can stop the request by returning an error.
+// The request is stopped with the status and the message of RejectionError, or with "500 Internal Server Error" for the other errors.
+type Listener func(ctx Context) error
+
+func newEvent() *event {
+	return &event{listeners: map[EventKey][]Listener{}}
+}
+
+type event struct {
+	mu        sync.RWMutex
+	listeners map[EventKey][]Listener
+}
+
+// On adds the listener that is called after the listeners added before.
+func (e *event) On(evt EventKey, listener HandlerFunc) {
+	e.Listen(evt, func(ctx Context) error {
+		listener(ctx)
+		return nil
+	})
+}
+
+// Listen adds the listener that can stop the request. It is called after the listeners added before.
+func (e *event) Listen(evt EventKey, listener Listener) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// The slice is copied, so that emit can call the listeners without the lock.
+	listeners := e.listeners[evt]
+	e.listeners[evt] = append(listeners[:len(listeners):len(listeners)], listener)
+}
+
+// emit calls the listeners in order until one of them returns an error or rejects the request with Context.Reject.
+func (e *event) emit(evt EventKey, ctx Context) error {
+	e.mu.RLock()
+	listeners := e.listeners[evt]
+	e.mu.RUnlock()
+	for _, listener := range listeners {
+		if err := listener(ctx); err != nil {
+			return err
+		}
+		if _, rejected := ctx.Rejected(); rejected {
+			return nil
+		}
+	}
+	return nil
+}
+
+// notify calls all the listeners whatever they return.
+func (e *event) notify(evt EventKey, ctx Context) {
+	e.mu.RLock()
+	listeners := e.listeners[evt]
+	e.mu.RUnlock()
+	for _, listener := range listeners {
+		listener(ctx)
+	}
+}
+
+// RejectionError is returned by the listener to stop the request with the status and the message.
+// If Status is zero, the message is sent as the error of git, which the git client shows to the user,
+// for upload-pack and receive-pack, and with "403 Forbidden" for the others.
+type RejectionError struct {
+	Status  int
+	Message string
+}
+
+func (e *RejectionError) Error() string {
+	return "the request is rejected. " + e.Message
+}
+
+// emit calls the listeners, and renders the rejection or the error if one of them stops the request.
+// rpc is the service whose git error is rendered, or "" for the other routes.
+func (ghx *GitHTTPXfer) emit(evt EventKey, ctx Context, rpc string, sideband bool) bool {
+	err := ghx.Event.emit(evt, ctx)
+	if message, rejected := ctx.Rejected(); rejected && err == nil {
+		err = &RejectionError{Message: message}
+	}
+	if err == nil {
+		return true
+	}
+
+	ghx.renderStop(ctx, err, rpc, sideband, "the listener failed", "event", string(evt))
+	return false
+}
+
+// renderStop renders the rejection or the error of the listener or the callback that stops the request.
+// failure and keysAndValues are logged for the errors other than RejectionError.
+func (ghx *GitHTTPXfer) renderStop(ctx Context, err error, rpc string, sideband bool, failure string, keysAndValues ...interface{}) {
+	w := ctx.Response().Writer
+	var rejection *RejectionError
+	if !errors.As(err, &rejection) {
+		ctx.Logger().Error(failure, append(keysAndValues, "error", err)...)
+		ghx.ReportError(ctx, ErrorKindListener, err)
+		RenderInternalServerError(w)
+		return
+	}
+	ghx.ReportError(ctx, ErrorKindRejected, err)
+	switch {
+	case rejection.Status == 0 && rpc != "":
+		RenderGitError(w, rpc, rejection.Message, sideband)
+	case rejection.Status == 0:
+		http.Error(w, rejection.Message, http.StatusForbidden)
+	default:
+		http.Error(w, rejection.Message, rejection.Status)
+	}
+}
+
+// Emit calls the listeners of the event of the addon handler, and renders the rejection or the error if one of them stops the request.
+// It returns false if the request has been stopped.
+func (ghx *GitHTTPXfer) Emit(evt EventKey, ctx Context) bool {
+	return ghx.emit(evt, ctx, "", false)
+}
+
+// Notify calls all the listeners of the event of the addon handler, such as the After* event that can not stop the request.
+func (ghx *GitHTTPXfer) Notify(evt EventKey, ctx Context) {
+	ghx.Event.notify(evt, ctx)
+}
@@ -0,0 +1,286 @@
+package githttpxfer
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func Test_Event_should_call_the_listeners_in_order(t *testing.T) {
+
+	tests := []struct {
+		description string
+		listeners   []Listener
+		expected    string
+		expectedErr error
+	}{
+		{
+			description: "it should call all the listeners",
+			listeners: []Listener{
+				func(ctx Context) error { ctx.SetFilePath(ctx.FilePath() + "a"); return nil },
+				func(ctx Context) error { ctx.SetFilePath(ctx.FilePath() + "b"); return nil },
+			},
+			expected: "ab",
+		},
+		{
+			description: "it should stop at the error",
+			listeners: []Listener{
+				func(ctx Context) error { ctx.SetFilePath(ctx.FilePath() + "a"); return errors.New("stop") },
+				func(ctx Context) error { ctx.SetFilePath(ctx.FilePath() + "b"); return nil },
+			},
+			expected:    "a",
+			expectedErr: errors.New("stop"),
+		},
+		{
+			description: "it should stop at the rejection",
+			listeners: []Listener{
+				func(ctx Context) error { ctx.SetFilePath(ctx.FilePath() + "a"); ctx.Reject("stop"); return nil },
+				func(ctx Context) error { ctx.SetFilePath(ctx.FilePath() + "b"); return nil },
+			},
+			expected: "a",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		e := newEvent()
+		for _, listener := range tc.listeners {
+			e.Listen(BeforeReceivePack, listener)
+		}
+		e.On(AfterMatchRouting, func(ctx Context) { ctx.SetFilePath("other event") })
+		ctx := NewContext(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil), "", "")
+		err := e.emit(BeforeReceivePack, ctx)
+		if ctx.FilePath() != tc.expected {
+			t.Errorf("the listeners are not called as %s . result: %s", tc.expected, ctx.FilePath())
+		}
+		if (err == nil) != (tc.expectedErr == nil) || (err != nil && err.Error() != tc.expectedErr.Error()) {
+			t.Errorf("error is not %v . result: %v", tc.expectedErr, err)
+		}
+	}
+}
+
+func Test_Event_should_add_the_listeners_concurrently(t *testing.T) {
+
+	e := newEvent()
+	ctx := NewContext(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/", nil), "", "")
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			e.On(AfterMatchRouting, func(ctx Context) {})
+		}()
+		go func() {
+			defer wg.Done()
+			e.emit(AfterMatchRouting, ctx)
+		}()
+	}
+	wg.Wait()
+	if n := len(e.listeners[AfterMatchRouting]); n != 50 {
+		t.Errorf("the number of the listeners is not 50 . result: %d", n)
+	}
+}
+
+func Test_ServeHTTP_should_render_the_error_of_the_listener(t *testing.T) {
+
+	tests := []struct {
+		description  string
+		evt          EventKey
+		method       string
+		url          string
+		contentType  string
+		err          error
+		expected     int
+		expectedBody string
+	}{
+		{
+			description:  "it should render the status of the rejection",
+			evt:          AfterMatchRouting,
+			method:       http.MethodGet,
+			url:          "/test.git/info/refs?service=git-upload-pack",
+			err:          &RejectionError{Status: http.StatusUnauthorized, Message: "authentication required"},
+			expected:     http.StatusUnauthorized,
+			expectedBody: "authentication required",
+		},
+		{
+			description:  "it should render forbidden for the rejection without the status",
+			evt:          AfterMatchRouting,
+			method:       http.MethodGet,
+			url:          "/test.git/HEAD",
+			err:          &RejectionError{Message: "not allowed"},
+			expected:     http.StatusForbidden,
+			expectedBody: "not allowed",
+		},
+		{
+			description:  "it should render the git error for the rejection of upload-pack",
+			evt:          BeforeUploadPack,
+			method:       http.MethodPost,
+			url:          "/test.git/git-upload-pack",
+			contentType:  "application/x-git-upload-pack-request",
+			err:          &RejectionError{Message: "fetch is disabled"},
+			expected:     http.StatusOK,
+			expectedBody: "ERR fetch is disabled",
+		},
+		{
+			description: "it should render internal server error for the other errors",
+			evt:         AfterMatchRouting,
+			method:      http.MethodGet,
+			url:         "/test.git/HEAD",
+			err:         errors.New("failed to authenticate"),
+			expected:    http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		ghx, err := New("/data/git", "/usr/bin/git")
+		if err != nil {
+			t.Errorf("An instance could not be created. %s", err.Error())
+			return
+		}
+		called := false
+		listenerErr := tc.err
+		ghx.Event.Listen(tc.evt, func(ctx Context) error { return listenerErr })
+		ghx.Event.On(tc.evt, func(ctx Context) { called = true })
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(tc.method, "http://example.com"+tc.url, strings.NewReader("0000"))
+		req.Header.Set("Content-Type", tc.contentType)
+		ghx.ServeHTTP(rec, req)
+		if rec.Code != tc.expected {
+			t.Errorf("StatusCode is not %d . result: %d", tc.expected, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), tc.expectedBody) {
+			t.Errorf("Body does not contain %q . result: %s", tc.expectedBody, rec.Body.String())
+		}
+		if called {
+			t.Error("the listener after the error is called.")
+		}
+	}
+}
+
+func Test_ServeHTTP_should_emit_the_events_of_the_routes(t *testing.T) {
+
+	tests := []struct {
+		description string
+		evt         EventKey
+		method      string
+		url         string
+		expected    int
+	}{
+		{description: "it should emit BeforeInfoRefs for the advertisement", evt: BeforeInfoRefs, method: http.MethodGet, url: "/test.git/info/refs?service=git-upload-pack", expected: http.StatusForbidden},
+		{description: "it should emit BeforeServeFile for HEAD", evt: BeforeServeFile, method: http.MethodGet, url: "/test.git/HEAD", expected: http.StatusForbidden},
+		{description: "it should emit BeforeServeFile for info/refs of the dumb protocol", evt: BeforeServeFile, method: http.MethodGet, url: "/test.git/info/refs", expected: http.StatusForbidden},
+		{description: "it should not emit BeforeServeFile for the advertisement", evt: BeforeServeFile, method: http.MethodGet, url: "/test.git/info/refs?service=git-upload-pack", expected: http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		ghx, err := New("/data/git", "/usr/bin/git")
+		if err != nil {
+			t.Errorf("An instance could not be created. %s", err.Error())
+			return
+		}
+		ghx.Event.On(tc.evt, func(ctx Context) { ctx.Reject("not allowed") })
+
+		rec := httptest.NewRecorder()
+		ghx.ServeHTTP(rec, httptest.NewRequest(tc.method, "http://example.com"+tc.url, nil))
+		if rec.Code != tc.expected {
+			t.Errorf("StatusCode is not %d . result: %d", tc.expected, rec.Code)
+		}
+	}
+}
+
+func Test_ServeHTTP_should_not_update_the_server_info_if_the_file_is_rejected(t *testing.T) {
+
+	gitRootPath, err := ioutil.TempDir("", "githttpxfer")
+	if err != nil {
+		t.Errorf("Create Temp Dir error: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(gitRootPath)
+	if output, err := exec.Command("git", "init", "-q", "--bare", filepath.Join(gitRootPath, "test.git")).CombinedOutput(); err != nil {
+		t.Errorf("execute command error: %s %s", err.Error(), output)
+		return
+	}
+
+	ghx, err := New(gitRootPath, "/usr/bin/git")
+	if err != nil {
+		t.Errorf("An instance could not be created. %s", err.Error())
+		return
+	}
+	ghx.Event.On(BeforeServeFile, func(ctx Context) { ctx.Reject("not allowed") })
+
+	rec := httptest.NewRecorder()
+	ghx.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/test.git/info/refs", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("StatusCode is not %d . result: %d", http.StatusForbidden, rec.Code)
+	}
+	if _, err := os.Stat(filepath.Join(gitRootPath, "test.git", "info", "refs")); !os.IsNotExist(err) {
+		t.Errorf("the server info is updated for the rejected request. error: %v", err)
+	}
+}
+
+func Test_ServeHTTP_should_emit_the_result_of_upload_pack(t *testing.T) {
+
+	tests := []struct {
+		description    string
+		body           string
+		expectedCode   int
+		expectedStderr string
+		expectedKind   string
+	}{
+		{
+			description:  "it should have the result of the success",
+			body:         "0000",
+			expectedCode: 0,
+		},
+		{
+			description:    "it should have the exit code and the standard error of the failure",
+			body:           pktLine("want 1111111111111111111111111111111111111111\n") + "0000" + pktLine("done\n"),
+			expectedCode:   128,
+			expectedStderr: "not our ref",
+			expectedKind:   ErrorKindService,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		ghx, err := New("/data/git", "/usr/bin/git")
+		if err != nil {
+			t.Errorf("An instance could not be created. %s", err.Error())
+			return
+		}
+		var after, onError *Result
+		ghx.Event.On(AfterUploadPack, func(ctx Context) { after = ctx.Result() })
+		ghx.Event.On(OnError, func(ctx Context) { onError = ctx.Result() })
+
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/test.git/git-upload-pack", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+		ghx.ServeHTTP(httptest.NewRecorder(), req)
+
+		if after == nil {
+			t.Error("AfterUploadPack is not emitted.")
+			continue
+		}
+		if after.Service != uploadPack || after.ExitCode != tc.expectedCode || after.BytesIn != int64(len(tc.body)) || after.Duration <= 0 {
+			t.Errorf("the result is not valid. result: %+v", after)
+		}
+		if !strings.Contains(after.Stderr, tc.expectedStderr) {
+			t.Errorf("Stderr does not contain %q . result: %s", tc.expectedStderr, after.Stderr)
+		}
+		if tc.expectedKind == "" && onError != nil {
+			t.Errorf("OnError is emitted. result: %+v", onError)
+		}
+		if tc.expectedKind != "" && (onError == nil || onError.ErrorKind != tc.expectedKind || onError.Err == nil) {
+			t.Errorf("OnError is not emitted with %s . result: %+v", tc.expectedKind, onError)
+		}
+	}
+}
@@ -1,23 +1,38 @@
 package githttpxfer
 
 import (
+	"bytes"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/exec"
-	"path"
 	"syscall"
 )
 
 func newGit(rootPath string, binPath string, uploadPack bool, receivePack bool) *git {
-	return &git{rootPath, binPath, uploadPack, receivePack}
+	return &git{binPath: binPath, uploadPack: uploadPack, receivePack: receivePack, resolver: NewRootResolver(rootPath)}
 }
 
 type git struct {
-	rootPath    string
-	binPath     string
-	uploadPack  bool
-	receivePack bool
+	resolver       RepoResolver
+	binPath        string
+	uploadPack     bool
+	receivePack    bool
+	commandFactory CommandFactory
+	timeouts       ServiceTimeouts
+	tracer         Tracer
+}
+
+// CommandFactory returns the command that runs the git subcommand with args in the repository at absRepoPath.
+// It can run git under a sandbox or a custom launcher such as nice.
+type CommandFactory func(absRepoPath, subcommand string, args ...string) *exec.Cmd
+
+// DefaultCommandFactory returns the CommandFactory that runs the git executable at binPath.
+func DefaultCommandFactory(binPath string) CommandFactory {
+	return func(absRepoPath, subcommand string, args ...string) *exec.Cmd {
+		return exec.Command(binPath, append([]string{subcommand}, args...)...)
+	}
 }
 
 func (g *git) HasAccess(req *http.Request, rpc string, checkContentType bool) bool {
@@ -35,36 +50,285 @@ func (g *git) HasAccess(req *http.Request, rpc string, checkContentType bool) bo
 	return false
 }
 
-func (g *git) GetAbsolutePath(repoPath string) string {
-	return path.Join(g.rootPath, repoPath)
+// GetAbsolutePath returns the absolute path of the repository with the RepoResolver.
+func (g *git) GetAbsolutePath(repoPath string) (string, error) {
+	return g.resolver.Resolve(repoPath)
 }
 
 func (g *git) Exists(repoPath string) bool {
-	absRepoPath := g.GetAbsolutePath(repoPath)
+	absRepoPath, err := g.GetAbsolutePath(repoPath)
+	if err != nil {
+		return false
+	}
 	if _, err := os.Stat(absRepoPath); os.IsNotExist(err) {
 		return false
 	}
 	return true
 }
 
-func (g *git) GitCommand(repoPath string, args ...string) *exec.Cmd {
-	command := exec.Command(g.binPath, args...)
-	command.Dir = g.GetAbsolutePath(repoPath)
-	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	return command
+// GitCommand returns the command that runs git in the repository.
+// It fails if the repository can not be resolved, rather than running git in the working directory.
+func (g *git) GitCommand(repoPath string, args ...string) (*exec.Cmd, error) {
+	absRepoPath, err := g.GetAbsolutePath(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	factory := g.commandFactory
+	if factory == nil {
+		factory = DefaultCommandFactory(g.binPath)
+	}
+	command := factory(absRepoPath, args[0], args[1:]...)
+	if command.Dir == "" {
+		command.Dir = absRepoPath
+	}
+	// The process group is needed to clean up the processes that git starts.
+	// The session or the group that the factory has chosen is kept, since Setpgid fails together with Setsid.
+	if command.SysProcAttr == nil {
+		command.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	if !command.SysProcAttr.Setsid && !command.SysProcAttr.Setpgid {
+		command.SysProcAttr.Setpgid = true
+	}
+	return command, nil
 }
 
 func (g *git) GetRequestFileInfo(repoPath, filePath string) (*RequestFileInfo, error) {
-	absRepoPath := g.GetAbsolutePath(repoPath)
-	absFilePath := path.Join(absRepoPath, filePath)
+	absRepoPath, err := g.GetAbsolutePath(repoPath)
+	if err != nil {
+		return nil, err
+	}
+	absFilePath, err := SecureJoin(absRepoPath, filePath)
+	if err != nil {
+		return nil, err
+	}
 	info, err := os.Stat(absFilePath)
 	if err != nil {
 		return nil, err
 	}
+	if !info.Mode().IsRegular() {
+		return nil, &UnsafePathError{Path: filePath, Reason: "the path is not a regular file"}
+	}
 	return &RequestFileInfo{info, absFilePath}, nil
 }
 
+// CreateRepository creates the bare repository with "git init".
+func (g *git) CreateRepository(ctx Context, templateDir, defaultBranch string) (err error) {
+	ctx, end := traceContext(g.tracer, ctx, "githttpxfer.GitCommand", Attribute{AttributeGitSubcommand, "init"})
+	defer func() { end(err) }()
+	absRepoPath, err := g.GetAbsolutePath(ctx.RepoPath())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(absRepoPath, 0755); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(absRepoPath)
+		}
+	}()
+
+	args := []string{"init", "--bare"}
+	if templateDir != "" {
+		args = append(args, "--template="+templateDir)
+	}
+	cmd, err := g.GitCommand(ctx.RepoPath(), args...)
+	if err != nil {
+		return err
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git init: %w: %s", err, out)
+	}
+	if defaultBranch == "" {
+		return nil
+	}
+	// "git init --initial-branch" needs git 2.28, so HEAD is pointed to the branch afterwards.
+	cmd, err = g.GitCommand(ctx.RepoPath(), "symbolic-ref", "HEAD", "refs/heads/"+defaultBranch)
+	if err != nil {
+		return err
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("git symbolic-ref: %w: %s", err, out)
+	}
+	return nil
+}
+
 type RequestFileInfo struct {
 	os.FileInfo
 	AbsolutePath string
 }
+
+func (g *git) SupportsProtocolV2() bool {
+	return true
+}
+
+func (g *git) UpdateServerInfo(ctx Context) (err error) {
+	ctx, end := traceContext(g.tracer, ctx, "githttpxfer.GitCommand", Attribute{AttributeGitSubcommand, "update-server-info"})
+	defer func() { end(err) }()
+	cmd, err := g.GitCommand(ctx.RepoPath(), "update-server-info")
+	if err != nil {
+		return err
+	}
+	cmd.Env = ctx.Env()
+	_, err = cmd.Output()
+	return err
+}
+
+func (g *git) AdvertiseRefs(ctx Context, service string, w io.Writer) (err error) {
+	ctx, end := traceContext(g.tracer, ctx, "githttpxfer.GitCommand", Attribute{AttributeGitSubcommand, service}, Attribute{AttributeService, service})
+	defer func() { end(err) }()
+	args := []string{service, "--stateless-rpc", "--advertise-refs", "."}
+	cmd, err := g.GitCommand(ctx.RepoPath(), args...)
+	if err != nil {
+		return err
+	}
+	cmd.Env = ctx.Env()
+	refs := &bytes.Buffer{}
+	wd := g.newWatchdog(ctx, cmd, service)
+	cmd.Stdout = wd.writer(refs)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	wd.start(ctx)
+	err = cmd.Wait()
+	wd.stop()
+	if timeoutErr := wd.Err(); timeoutErr != nil {
+		return timeoutErr
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(refs.Bytes())
+	return err
+}
+
+func (g *git) UploadPack(ctx Context, r io.Reader, w io.Writer) error {
+	return g.serviceRPC(ctx, uploadPack, r, w)
+}
+
+func (g *git) ReceivePack(ctx Context, r io.Reader, w io.Writer) error {
+	return g.serviceRPC(ctx, receivePack, r, w)
+}
+
+func (g *git) serviceRPC(ctx Context, rpc string, r io.Reader, w io.Writer) (err error) {
+	ctx, end := traceContext(g.tracer, ctx, "githttpxfer.GitCommand", Attribute{AttributeGitSubcommand, rpc}, Attribute{AttributeService, rpc})
+	defer func() { end(err) }()
+	args := []string{rpc, "--stateless-rpc", "."}
+	cmd, err := g.GitCommand(ctx.RepoPath(), args...)
+	if err != nil {
+		return err
+	}
+	cmd.Env = ctx.Env()
+	stderr := &StderrExcerpt{}
+	if cmd.Stderr == nil {
+		cmd.Stderr = stderr
+	}
+	var wd *watchdog
+	defer func() {
+		cmd.Wait()
+		if result := ctx.Result(); result != nil {
+			result.Stderr = stderr.String()
+		}
+		if wd == nil {
+			return
+		}
+		wd.stop()
+		// The timeout is the cause of the failure to copy or of the exit by the signal.
+		if timeoutErr := wd.Err(); timeoutErr != nil {
+			err = timeoutErr
+		}
+	}()
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get pipe that will be connected to the command's standard input. %s", err.Error())
+	}
+	defer stdin.Close()
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get pipe that will be connected to the command's standard output. %s", err.Error())
+	}
+	defer stdout.Close()
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to starts the specified command. %s", err.Error())
+	}
+	wd = g.newWatchdog(ctx, cmd, rpc)
+	wd.start(ctx)
+
+	wd.setPhase(phaseReadingBody)
+	bufIn := bufPool.Get().([]byte)
+	defer bufPool.Put(bufIn)
+	_, endCopy := traceContext(g.tracer, ctx, "githttpxfer.copyRequestBody", Attribute{AttributeService, rpc})
+	_, err = io.CopyBuffer(stdin, wd.reader(r), bufIn)
+	endCopy(err)
+	if err != nil {
+		// git must not act on the partial request. e.g. the request body exceeds the limit.
+		go wd.terminate()
+		return fmt.Errorf("failed to write the request body to standard input. %w", err)
+	}
+	// "git-upload-pack" waits for the remaining input and it hangs,
+	// so must close it after completing the copy request body to standard input.
+	stdin.Close()
+
+	wd.setPhase(phaseWritingOutput)
+	bufOut := bufPool.Get().([]byte)
+	defer bufPool.Put(bufOut)
+	_, endCopy = traceContext(g.tracer, ctx, "githttpxfer.copyOutput", Attribute{AttributeService, rpc})
+	_, err = io.CopyBuffer(wd.writer(w), wd.reader(stdout), bufOut)
+	endCopy(err)
+	if err != nil {
+		return fmt.Errorf("failed to write the standard output to response. %s", err.Error())
+	}
+
+	wd.setPhase(phaseWaitingExit)
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("specified command fails to run or doesn't complete successfully. %w", err)
+	}
+	return nil
+}
+
+// RunCommand starts cmd and copies its standard output to w under the timeouts of service.
+// The process group of cmd is terminated when the request is done or the timeout expires,
+// and the error is TimeoutError if the timeout has expired.
+func (g *git) RunCommand(ctx Context, service string, cmd *exec.Cmd, w io.Writer) (err error) {
+	var wd *watchdog
+	defer func() {
+		cmd.Wait()
+		if wd == nil {
+			return
+		}
+		wd.stop()
+		if timeoutErr := wd.Err(); timeoutErr != nil {
+			err = timeoutErr
+		}
+	}()
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get pipe that will be connected to the command's standard output. %s", err.Error())
+	}
+	defer stdout.Close()
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to starts the specified command. %s", err.Error())
+	}
+	wd = g.newWatchdog(ctx, cmd, service)
+	wd.start(ctx)
+
+	buf := bufPool.Get().([]byte)
+	defer bufPool.Put(buf)
+	_, endCopy := traceContext(g.tracer, ctx, "githttpxfer.copyOutput", Attribute{AttributeService, service})
+	_, err = io.CopyBuffer(wd.writer(w), wd.reader(stdout), buf)
+	endCopy(err)
+	if err != nil {
+		return fmt.Errorf("failed to write the standard output to response. %s", err.Error())
+	}
+
+	wd.setPhase(phaseWaitingExit)
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("specified command fails to run or doesn't complete successfully. %w", err)
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"strings"
 	"testing"
 )
 
@@ -22,7 +23,7 @@ func Test_Git_getRequestFileInfo_should_return_RequestFileInfo(t *testing.T) {
 	repoPath := "foo"
 	filePath := "README.txt"
 
-	absRepoPath := git.GetAbsolutePath(repoPath)
+	absRepoPath, _ := git.GetAbsolutePath(repoPath)
 	os.Mkdir(absRepoPath, os.ModeDir)
 
 	touchCmd := exec.Command("touch", filePath)
@@ -74,7 +75,7 @@ func Test_Git_exists_should_return_true_if_exists_repository(t *testing.T) {
 	os.Mkdir(path.Join(gitRootPath, repoPath), os.ModeDir)
 
 	if !git.Exists(repoPath) {
-		t.Errorf("this repository is not exists. path: %s", git.GetAbsolutePath(repoPath))
+		t.Errorf("this repository is not exists. path: %s", path.Join(gitRootPath, repoPath))
 	}
 
 }
@@ -93,7 +94,7 @@ func Test_Git_exists_should_return_false_if_not_exists_repository(t *testing.T)
 	repoPath := "foo"
 
 	if git.Exists(repoPath) {
-		t.Errorf("this repository is exists. path: %s", git.GetAbsolutePath(repoPath))
+		t.Errorf("this repository is exists. path: %s", path.Join(gitRootPath, repoPath))
 	}
 
 }
@@ -111,9 +112,65 @@ func Test_Git_getAbsolutePath_should_return_absolute_path_of_git_repository(t *t
 
 	repoPath := "foo"
 	expectedPath := path.Join(gitRootPath, repoPath)
-	resultPath := git.GetAbsolutePath(repoPath)
+	resultPath, err := git.GetAbsolutePath(repoPath)
+	if err != nil {
+		t.Errorf("GetAbsolutePath error: %s", err.Error())
+		return
+	}
 	if expectedPath != resultPath {
 		t.Errorf("path is not %s . result: %s", expectedPath, resultPath)
 	}
 
 }
+
+func Test_Git_GitCommand_should_use_command_factory(t *testing.T) {
+
+	git := newGit("/data/git", "/usr/bin/git", true, true)
+
+	var calls []string
+	git.commandFactory = func(absRepoPath, subcommand string, args ...string) *exec.Cmd {
+		calls = append(calls, absRepoPath+" "+subcommand)
+		return exec.Command("nice", append([]string{"-n", "10", "/usr/bin/git", subcommand}, args...)...)
+	}
+
+	cmd, err := git.GitCommand("foo.git", "upload-pack", "--stateless-rpc", ".")
+	if err != nil {
+		t.Errorf("GitCommand error: %s", err.Error())
+		return
+	}
+
+	if len(calls) != 1 || calls[0] != "/data/git/foo.git upload-pack" {
+		t.Errorf("command factory is not called with the subcommand. result: %v", calls)
+	}
+	expectedArgs := "nice -n 10 /usr/bin/git upload-pack --stateless-rpc ."
+	if strings.Join(cmd.Args, " ") != expectedArgs {
+		t.Errorf("args is not %s . result: %v", expectedArgs, cmd.Args)
+	}
+	if cmd.Dir != "/data/git/foo.git" {
+		t.Errorf("dir is not /data/git/foo.git . result: %s", cmd.Dir)
+	}
+	if cmd.SysProcAttr == nil || !cmd.SysProcAttr.Setpgid {
+		t.Error("process group is not set.")
+	}
+
+}
+
+func Test_Git_GitCommand_should_fail_if_repository_can_not_be_resolved(t *testing.T) {
+
+	git := newGit("/data/git", "/usr/bin/git", true, true)
+
+	tests := []struct {
+		description string
+		repoPath    string
+	}{
+		{description: "it should fail for the root", repoPath: "/"},
+		{description: "it should fail for the traversal", repoPath: "/../etc"},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		if cmd, err := git.GitCommand(tc.repoPath, "upload-pack", "--stateless-rpc", "."); err == nil {
+			t.Errorf("the command is created in %s", cmd.Dir)
+		}
+	}
+}
@@ -1,15 +1,18 @@
 package githttpxfer
 
 import (
-	"compress/gzip"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -86,10 +89,34 @@ func findStringSubmatch(path string, prefix *regexp.Regexp) *Match {
 }
 
 type options struct {
-	uploadPack  bool
-	receivePack bool
-	dumbProto   bool
-	head        bool
+	uploadPack     bool
+	receivePack    bool
+	dumbProto      bool
+	head           bool
+	protocolV2     bool
+	protocolV2Func func(repoPath string) bool
+	commandFactory CommandFactory
+	backend        Backend
+	resolver       RepoResolver
+	pushToCreate   *PushToCreate
+
+	uploadPackConfig     UploadPackConfig
+	uploadPackConfigFunc func(repoPath string) UploadPackConfig
+	packCache            *PackCache
+	coalesce             bool
+	coalesceSpoolDir     string
+	bundleURI            bool
+	bundleAfterPush      bool
+	baseURL              string
+	forwardedProto       bool
+	bodyLimits           BodyLimits
+	bodyLimitsFunc       func(repoPath string) BodyLimits
+	concurrencyLimits    *ConcurrencyLimits
+	rateLimits           *RateLimits
+	timeouts             ServiceTimeouts
+	metrics              Metrics
+	tracer               Tracer
+	propagator           Propagator
 }
 
 type Option func(*options)
@@ -120,6 +147,167 @@ func WithoutDumbProtoExceptHead() Option {
 	}
 }
 
+// DisableProtocolV2 stops forwarding the "Git-Protocol: version=2" header to git,
+// so every client falls back to the protocol v0.
+func DisableProtocolV2() Option {
+	return func(o *options) {
+		o.protocolV2 = false
+	}
+}
+
+// WithProtocolV2Func decides per repository whether the protocol v2 may be used.
+// It is consulted only while the protocol v2 is not disabled.
+func WithProtocolV2Func(f func(repoPath string) bool) Option {
+	return func(o *options) {
+		o.protocolV2Func = f
+	}
+}
+
+// WithUploadPackConfig turns on the capabilities of upload-pack for all repositories.
+func WithUploadPackConfig(config UploadPackConfig) Option {
+	return func(o *options) {
+		o.uploadPackConfig = config
+	}
+}
+
+// WithUploadPackConfigFunc decides the capabilities of upload-pack for each repository.
+// It takes precedence over WithUploadPackConfig.
+func WithUploadPackConfigFunc(f func(repoPath string) UploadPackConfig) Option {
+	return func(o *options) {
+		o.uploadPackConfigFunc = f
+	}
+}
+
+// WithPackCache serves the repeated clones from the cache.
+func WithPackCache(cache *PackCache) Option {
+	return func(o *options) {
+		o.packCache = cache
+	}
+}
+
+// WithUploadPackCoalescing shares one upload-pack among the identical requests in flight.
+// The output is spooled to spoolDir, or the default directory for temporary files if it is empty.
+func WithUploadPackCoalescing(spoolDir string) Option {
+	return func(o *options) {
+		o.coalesce = true
+		o.coalesceSpoolDir = spoolDir
+	}
+}
+
+// WithBundleURI serves the bundles of the repositories, and advertises them with the bundle-uri command of the protocol v2.
+// The bundle is created after every push if createAfterPush is true. Otherwise call CreateBundle on a schedule.
+func WithBundleURI(createAfterPush bool) Option {
+	return func(o *options) {
+		o.bundleURI = true
+		o.bundleAfterPush = createAfterPush
+	}
+}
+
+// WithBaseURL sets the URL that the clients reach the server at, e.g. "https://git.example.com/prefix".
+// The URLs in the responses, such as the bundle list, start with it instead of the one of the request.
+func WithBaseURL(baseURL string) Option {
+	return func(o *options) {
+		o.baseURL = strings.TrimSuffix(baseURL, "/")
+	}
+}
+
+// WithForwardedProto takes the scheme of the URLs in the responses from X-Forwarded-Proto.
+// Use it only behind the reverse proxy that sets the header, since the clients can send any value.
+func WithForwardedProto() Option {
+	return func(o *options) {
+		o.forwardedProto = true
+	}
+}
+
+// WithBodyLimits limits the size of the request body of upload-pack and receive-pack for all repositories.
+// git is stopped when the body exceeds the limit, and the client gets the error.
+func WithBodyLimits(limits BodyLimits) Option {
+	return func(o *options) {
+		o.bodyLimits = limits
+	}
+}
+
+// WithBodyLimitsFunc decides the limits of the request body for each repository.
+// It takes precedence over WithBodyLimits.
+func WithBodyLimitsFunc(f func(repoPath string) BodyLimits) Option {
+	return func(o *options) {
+		o.bodyLimitsFunc = f
+	}
+}
+
+// WithConcurrencyLimits limits the git processes that run at once, and queues the requests over the limits.
+func WithConcurrencyLimits(limits ConcurrencyLimits) Option {
+	return func(o *options) {
+		o.concurrencyLimits = &limits
+	}
+}
+
+// WithRateLimits throttles the requests of each identity with the token buckets.
+func WithRateLimits(limits RateLimits) Option {
+	return func(o *options) {
+		o.rateLimits = &limits
+	}
+}
+
+// WithTimeouts stops the git processes of upload-pack, receive-pack and archive that run too long or stall.
+func WithTimeouts(timeouts ServiceTimeouts) Option {
+	return func(o *options) {
+		o.timeouts = timeouts
+	}
+}
+
+// WithMetrics reports the requests, the git processes and the errors to the metrics.
+func WithMetrics(metrics Metrics) Option {
+	return func(o *options) {
+		o.metrics = metrics
+	}
+}
+
+// WithTracer traces the requests, the runs of git and the copies of their input and output.
+// The trace context of the client is extracted with TraceContextPropagator unless WithPropagator is given.
+func WithTracer(tracer Tracer) Option {
+	return func(o *options) {
+		o.tracer = tracer
+	}
+}
+
+// WithPropagator extracts the trace context of the client with the propagator.
+// The tracer of OpenTelemetry needs the propagator of OpenTelemetry to find the span of the client.
+func WithPropagator(propagator Propagator) Option {
+	return func(o *options) {
+		o.propagator = propagator
+	}
+}
+
+// WithCommandFactory runs git with the command that the factory returns.
+func WithCommandFactory(factory CommandFactory) Option {
+	return func(o *options) {
+		o.commandFactory = factory
+	}
+}
+
+// WithRepoResolver resolves the repository paths of the URLs with the resolver instead of joining them to gitRootPath.
+func WithRepoResolver(resolver RepoResolver) Option {
+	return func(o *options) {
+		o.resolver = resolver
+	}
+}
+
+// WithPushToCreate creates the repository that does not exist when it is pushed for the first time,
+// if the Authorize callback of the config allows it.
+func WithPushToCreate(config PushToCreate) Option {
+	return func(o *options) {
+		o.pushToCreate = &config
+	}
+}
+
+// WithBackend serves the repositories with the backend instead of the git executable.
+func WithBackend(backend Backend) Option {
+	return func(o *options) {
+		o.backend = backend
+	}
+}
+
 func New(gitRootPath, gitBinPath string, opts ...Option) (*GitHTTPXfer, error) {
 
 	if gitRootPath == "" {
@@ -130,17 +318,72 @@ func New(gitRootPath, gitBinPath string, opts ...Option) (*GitHTTPXfer, error) {
 		gitRootPath = cwd
 	}
 
-	ghxOpts := &options{true, true, true, true}
+	ghxOpts := &options{
+		uploadPack:  true,
+		receivePack: true,
+		dumbProto:   true,
+		head:        true,
+		protocolV2:  true,
+	}
 
 	for _, opt := range opts {
 		opt(ghxOpts)
 	}
 
 	git := newGit(gitRootPath, gitBinPath, ghxOpts.uploadPack, ghxOpts.receivePack)
+	if ghxOpts.resolver != nil {
+		git.resolver = ghxOpts.resolver
+	}
+	git.commandFactory = ghxOpts.commandFactory
+	git.timeouts = ghxOpts.timeouts
+	git.tracer = ghxOpts.tracer
+	if ghxOpts.propagator == nil {
+		ghxOpts.propagator = TraceContextPropagator{}
+	}
 	router := newRouter()
 	event := newEvent()
 
-	ghx := &GitHTTPXfer{git, router, event, &defaultLogger{}}
+	var backend Backend = git
+	if ghxOpts.backend != nil {
+		backend = ghxOpts.backend
+	}
+	var metrics Metrics = nopMetrics{}
+	if ghxOpts.metrics != nil {
+		metrics = ghxOpts.metrics
+	}
+
+	ghx := &GitHTTPXfer{
+		Git:     git,
+		Backend: backend,
+		Router:  router,
+		Event:   event,
+		logger:  &defaultLogger{},
+		metrics: metrics,
+		options: ghxOpts,
+	}
+
+	if ghxOpts.concurrencyLimits != nil {
+		limits := *ghxOpts.concurrencyLimits
+		onQueueDepth := limits.OnQueueDepth
+		limits.OnQueueDepth = func(depth int) {
+			metrics.QueueDepth(depth)
+			if onQueueDepth != nil {
+				onQueueDepth(depth)
+			}
+		}
+		ghx.limiter = newLimiter(limits)
+	}
+	if ghxOpts.rateLimits != nil {
+		ghx.rateLimiter = newRateLimiter(*ghxOpts.rateLimits)
+	}
+	if ghxOpts.coalesce {
+		ghx.coalescer = newUploadPackCoalescer(ghxOpts.coalesceSpoolDir)
+	}
+	// CreateBundle can be called without WithBundleURI.
+	ghx.bundler = newBundler()
+	if ghxOpts.bundleURI {
+		ghx.Router.Add(NewRoute(http.MethodGet, getBundleFile, ghx.getBundleFile))
+	}
 
 	ghx.Router.Add(NewRoute(http.MethodPost, serviceRPCUpload, ghx.serviceRPCUpload))
 	ghx.Router.Add(NewRoute(http.MethodPost, serviceRPCReceive, ghx.serviceRPCReceive))
@@ -164,10 +407,28 @@ func New(gitRootPath, gitBinPath string, opts ...Option) (*GitHTTPXfer, error) {
 }
 
 type GitHTTPXfer struct {
-	Git    *git
-	Router *router
-	Event  *event
-	logger Logger
+	Git     *git
+	Backend Backend
+	Router  *router
+	Event   *event
+	logger  Logger
+	metrics Metrics
+	options *options
+
+	coalescer   *uploadPackCoalescer
+	bundler     *bundler
+	limiter     *limiter
+	rateLimiter *rateLimiter
+	createMu    sync.Mutex
+}
+
+// URL returns the URL of the path that the clients see. It starts with the base URL of WithBaseURL if it is set.
+// Otherwise it is built from the request, and the scheme is the one of X-Forwarded-Proto with WithForwardedProto.
+func (ghx *GitHTTPXfer) URL(req *http.Request, path string) string {
+	if ghx.options.baseURL != "" {
+		return ghx.options.baseURL + path
+	}
+	return getScheme(req, ghx.options.forwardedProto) + "://" + req.Host + path
 }
 
 func (ghx *GitHTTPXfer) SetLogger(logger Logger) {
@@ -175,7 +436,17 @@ func (ghx *GitHTTPXfer) SetLogger(logger Logger) {
 }
 
 func (ghx *GitHTTPXfer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	var span Span = nopSpan{}
+	if ghx.options.tracer != nil {
+		r = r.WithContext(ghx.options.propagator.Extract(r.Context(), r.Header))
+		r, span = startSpan(ghx.options.tracer, r, "githttpxfer.ServeHTTP",
+			Attribute{AttributeHTTPMethod, r.Method}, Attribute{AttributeURLPath, r.URL.Path})
+		defer span.End()
+	}
+
+	_, routingSpan := startSpan(ghx.options.tracer, r, "githttpxfer.matchRouting")
 	repoPath, filePath, handler, err := ghx.matchRouting(r.Method, r.URL)
+	routingSpan.End()
 	switch err.(type) {
 	case *URLNotFoundError:
 		RenderNotFound(rw)
@@ -185,11 +456,64 @@ func (ghx *GitHTTPXfer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := NewContext(rw, r, repoPath, filePath)
+	var ctx Context
+
+	if ghx.options.metrics != nil {
+		body := &countingBody{ReadCloser: r.Body}
+		r.Body = body
+		w := &countingResponseWriter{ResponseWriter: rw}
+		rw = w
+		defer func() {
+			ghx.metrics.BytesTransferred(ctx, atomic.LoadInt64(&body.n), atomic.LoadInt64(&w.n))
+		}()
+	}
 
-	ghx.Event.emit(AfterMatchRouting, ctx)
+	ctx = NewContext(rw, r, repoPath, filePath)
+	ctx.SetLogger(requestLogger(ghx.logger, r, repoPath))
+	span.SetAttributes(Attribute{AttributeRepo, repoPath}, Attribute{AttributeService, requestService(r)})
+	ghx.metrics.RequestRouted(ctx)
 
-	if !ghx.Git.Exists(ctx.RepoPath()) {
+	if err := checkRequestPaths(repoPath, filePath); err != nil {
+		ctx.Logger().Warn("the request path is refused", "error", err)
+		ghx.ReportError(ctx, ErrorKindUnsafePath, err)
+		RenderBadRequest(ctx.Response().Writer)
+		return
+	}
+
+	if !ghx.emit(AfterMatchRouting, ctx, "", false) {
+		return
+	}
+
+	if ghx.rateLimiter != nil && !ghx.rateLimiter.allow(ctx) {
+		ghx.ReportError(ctx, ErrorKindRateLimited, errRateLimited)
+		return
+	}
+
+	_, endExists := traceContext(ghx.options.tracer, ctx, "githttpxfer.Exists")
+	exists, err := ghx.exists(ctx.RepoPath())
+	endExists(err)
+	var unsafePath *UnsafePathError
+	if errors.As(err, &unsafePath) {
+		// The repository escapes from the root with a symlink. It is not disclosed to the client.
+		ctx.Logger().Warn("the repository path is refused", "error", err)
+		ghx.ReportError(ctx, ErrorKindUnsafePath, err)
+		RenderNotFound(ctx.Response().Writer)
+		return
+	}
+	if err != nil {
+		ctx.Logger().Error("failed to resolve the repository", "error", err)
+		ghx.ReportError(ctx, ErrorKindResolve, err)
+		RenderInternalServerError(ctx.Response().Writer)
+		return
+	}
+	if !exists && ghx.options.pushToCreate != nil && ghx.isFirstPush(ctx) {
+		created, ok := ghx.createRepository(ctx)
+		if !ok {
+			return
+		}
+		exists = created
+	}
+	if !exists {
 		RenderNotFound(ctx.Response().Writer)
 		return
 	}
@@ -197,6 +521,27 @@ func (ghx *GitHTTPXfer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	handler(ctx)
 }
 
+// checkRequestPaths refuses the paths of the URL that may escape from the root or the repository.
+func checkRequestPaths(repoPath, filePath string) error {
+	if _, err := CleanPath(repoPath); err != nil {
+		return err
+	}
+	_, err := CleanPath(filePath)
+	return err
+}
+
+// exists reports whether the repository exists. The error is the failure of the RepoResolver other than RepositoryNotFoundError.
+func (ghx *GitHTTPXfer) exists(repoPath string) (bool, error) {
+	if _, err := ghx.Git.GetAbsolutePath(repoPath); err != nil {
+		var notFound *RepositoryNotFoundError
+		if errors.As(err, &notFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return ghx.Backend.Exists(repoPath), nil
+}
+
 func (ghx *GitHTTPXfer) matchRouting(method string, u *url.URL) (repoPath string, filePath string, handler HandlerFunc, err error) {
 	match, route, err := ghx.Router.Match(method, u)
 
@@ -209,129 +554,286 @@ func (ghx *GitHTTPXfer) matchRouting(method string, u *url.URL) (repoPath string
 }
 
 const (
-	uploadPack  = "upload-pack"
-	receivePack = "receive-pack"
+	uploadPack       = "upload-pack"
+	receivePack      = "receive-pack"
+	updateServerInfo = "update-server-info"
+	archive          = "archive"
 )
 
 type HandlerFunc func(ctx Context)
 
-func newEvent() *event {
-	return &event{map[EventKey]HandlerFunc{}}
-}
-
-type EventKey string
-
-const (
-	BeforeUploadPack  EventKey = "before-upload-pack"
-	BeforeReceivePack EventKey = "before-receive-pack"
-	AfterMatchRouting EventKey = "after-match-routing"
-)
-
-type event struct {
-	listeners map[EventKey]HandlerFunc
-}
+func (ghx *GitHTTPXfer) serviceRPCUpload(ctx Context) {
+	res, req := ctx.Response(), ctx.Request()
 
-func (e *event) emit(evt EventKey, ctx Context) {
-	v, ok := e.listeners[evt]
-	if ok {
-		v(ctx)
+	if !ghx.Git.HasAccess(req, uploadPack, true) {
+		RenderNoAccess(res.Writer)
+		return
 	}
-}
 
-func (e *event) On(evt EventKey, listener HandlerFunc) {
-	e.listeners[evt] = listener
-}
-
-func (ghx *GitHTTPXfer) serviceRPCUpload(ctx Context) {
-	ghx.Event.emit(BeforeUploadPack, ctx)
-	ghx.serviceRPC(ctx, uploadPack)
-}
-
-func (ghx *GitHTTPXfer) serviceRPCReceive(ctx Context) {
-	ghx.Event.emit(BeforeReceivePack, ctx)
-	ghx.serviceRPC(ctx, receivePack)
-}
+	limit := ghx.bodyLimit(ctx, uploadPack)
+	body, err := getRequestBody(req, limit)
+	if tooLarge, ok := err.(*BodyTooLargeError); ok {
+		ghx.renderBodyTooLarge(ctx, uploadPack, tooLarge)
+		return
+	}
+	if err != nil {
+		ctx.Logger().Error("failed to create a reader reading the given reader", "error", err)
+		RenderInternalServerError(res.Writer)
+		return
+	}
+	defer body.Close()
 
-func (ghx *GitHTTPXfer) serviceRPC(ctx Context, rpc string) {
+	upr, err := parseUploadPackRequest(body, limit.Buffered)
+	if tooLarge := body.tooLarge(); tooLarge != nil {
+		ghx.renderBodyTooLarge(ctx, uploadPack, tooLarge)
+		return
+	}
+	var bufferTooLarge *BufferTooLargeError
+	if errors.As(err, &bufferTooLarge) {
+		ghx.renderBodyTooLarge(ctx, uploadPack, bufferTooLarge)
+		return
+	}
+	if err != nil {
+		ctx.Logger().Error("failed to parse the negotiation of upload-pack", "error", err)
+		ghx.ReportError(ctx, ErrorKindBadRequest, err)
+		RenderBadRequest(res.Writer)
+		return
+	}
+	ctx.SetUploadPackRequest(upr)
 
-	res, req, repoPath := ctx.Response(), ctx.Request(), ctx.RepoPath()
+	// upload-pack reads the response with pkt-line until the packfile, so the "ERR" packet is always understood.
+	if !ghx.emit(BeforeUploadPack, ctx, uploadPack, false) {
+		return
+	}
 
-	if !ghx.Git.HasAccess(req, rpc, true) {
-		RenderNoAccess(res.Writer)
+	if upr.Command == "bundle-uri" && ghx.options.bundleURI {
+		ghx.serveBundleURI(ctx)
 		return
 	}
 
-	var body io.ReadCloser
-	var err error
+	if ghx.options.packCache != nil && upr.IsClone() {
+		ghx.serviceRPCUploadWithPackCache(ctx, upr, body, limit.Buffered)
+		return
+	}
 
-	if req.Header.Get("Content-Encoding") == "gzip" {
-		body, err = gzip.NewReader(req.Body)
+	if ghx.coalescer != nil {
+		request, complete, err := readUploadPackRequest(upr, body, limit.Buffered)
+		if tooLarge := body.tooLarge(); tooLarge != nil {
+			ghx.renderBodyTooLarge(ctx, uploadPack, tooLarge)
+			return
+		}
 		if err != nil {
-			ghx.logger.Error("failed to create a reader reading the given reader. ", err.Error())
+			ctx.Logger().Error("failed to read the request body", "error", err)
 			RenderInternalServerError(res.Writer)
 			return
 		}
-	} else {
-		body = req.Body
+		if complete {
+			ghx.serviceRPCUploadCoalesced(ctx, request, nil)
+			return
+		}
+		ctx.Logger().Debug("the request is too large to share upload-pack", "limit", limit.Buffered)
+		ghx.serviceRPC(ctx, uploadPack, io.MultiReader(bytes.NewReader(request), body), nil)
+		return
 	}
-	defer body.Close()
 
-	args := []string{rpc, "--stateless-rpc", "."}
-	cmd := ghx.Git.GitCommand(repoPath, args...)
-	cmd.Env = ctx.Env()
-	defer cmd.Wait()
-	go func() {
-		<-req.Context().Done()
-		cleanUpProcessGroup(cmd)
-	}()
+	ghx.serviceRPC(ctx, uploadPack, io.MultiReader(bytes.NewReader(upr.consumed), body), nil)
+}
 
-	stdin, err := cmd.StdinPipe()
+// runUploadPack runs upload-pack with the whole request, sharing it with the identical requests if enabled.
+func (ghx *GitHTTPXfer) runUploadPack(ctx Context, request []byte, copyOutput func(w io.Writer, stdout io.Reader) error) error {
+	if ghx.coalescer != nil {
+		return ghx.serviceRPCUploadCoalesced(ctx, request, copyOutput)
+	}
+	return ghx.serviceRPC(ctx, uploadPack, bytes.NewReader(request), copyOutput)
+}
+
+// readUploadPackRequest reads the rest of the request body after the consumed bytes, up to limit bytes in total.
+// complete is false if the request exceeds limit. Then request is the beginning of it, and the rest is left in body.
+func readUploadPackRequest(upr *UploadPackRequest, body io.Reader, limit int64) (request []byte, complete bool, err error) {
+	if limit <= 0 {
+		limit = defaultBufferedLimit
+	}
+	rest, err := ioutil.ReadAll(io.LimitReader(body, limit-int64(len(upr.consumed))+1))
 	if err != nil {
-		ghx.logger.Error("failed to get pipe that will be connected to the command's standard input. ", err.Error())
-		RenderInternalServerError(res.Writer)
+		return nil, false, err
+	}
+	request = append(upr.consumed[:len(upr.consumed):len(upr.consumed)], rest...)
+	return request, int64(len(request)) <= limit, nil
+}
+
+func (ghx *GitHTTPXfer) serviceRPCReceive(ctx Context) {
+	res, req := ctx.Response(), ctx.Request()
+
+	if !ghx.Git.HasAccess(req, receivePack, true) {
+		RenderNoAccess(res.Writer)
 		return
 	}
-	defer stdin.Close()
 
-	stdout, err := cmd.StdoutPipe()
+	limit := ghx.bodyLimit(ctx, receivePack)
+	body, err := getRequestBody(req, limit)
+	if tooLarge, ok := err.(*BodyTooLargeError); ok {
+		ghx.renderBodyTooLarge(ctx, receivePack, tooLarge)
+		return
+	}
 	if err != nil {
-		ghx.logger.Error("failed to get pipe that will be connected to the command's standard output. ", err.Error())
+		ctx.Logger().Error("failed to create a reader reading the given reader", "error", err)
 		RenderInternalServerError(res.Writer)
 		return
 	}
-	defer stdout.Close()
+	defer body.Close()
 
-	err = cmd.Start()
+	rpr, err := parseReceivePackRequest(body, limit.Buffered)
+	if err == nil {
+		ctx.SetReceivePackRequest(rpr)
+	}
+	if tooLarge := body.tooLarge(); tooLarge != nil {
+		ghx.renderBodyTooLarge(ctx, receivePack, tooLarge)
+		return
+	}
+	var bufferTooLarge *BufferTooLargeError
+	if errors.As(err, &bufferTooLarge) {
+		ghx.renderBodyTooLarge(ctx, receivePack, bufferTooLarge)
+		return
+	}
 	if err != nil {
-		ghx.logger.Error("failed to starts the specified command. ", err.Error())
-		RenderInternalServerError(res.Writer)
+		ctx.Logger().Error("failed to parse the commands of receive-pack", "error", err)
+		ghx.ReportError(ctx, ErrorKindBadRequest, err)
+		RenderBadRequest(res.Writer)
 		return
 	}
 
-	bufIn := bufPool.Get().([]byte)
-	defer bufPool.Put(bufIn)
-	if _, err := io.CopyBuffer(stdin, body, bufIn); err != nil {
-		ghx.logger.Error("failed to write the request body to standard input. ", err.Error())
-		RenderInternalServerError(res.Writer)
+	if !ghx.emit(BeforeReceivePack, ctx, receivePack, rpr.usesSideband()) {
 		return
 	}
-	// "git-upload-pack" waits for the remaining input and it hangs,
-	// so must close it after completing the copy request body to standard input.
-	stdin.Close()
 
-	res.SetContentType(fmt.Sprintf("application/x-git-%s-result", rpc))
-	res.WriteHeader(http.StatusOK)
+	if rejected := rpr.rejectedCommands(); len(rejected) > 0 {
+		reason, _ := rejected[0].Rejected()
+		rejection := &RejectionError{Message: rejected[0].RefName + ": " + reason}
+		ghx.ReportError(ctx, ErrorKindRejected, rejection)
+		if !rpr.canRejectCommands() {
+			RenderGitError(res.Writer, receivePack, rejected[0].RefName+": "+reason, rpr.usesSideband())
+			return
+		}
+		rpr.rejectAtomically()
+		if len(rpr.rejectedCommands()) == len(rpr.Commands) {
+			// git does not run, and the report of the rejection is the output of the push.
+			res.SetContentType(fmt.Sprintf("application/x-git-%s-result", receivePack))
+			res.WriteHeader(http.StatusOK)
+			err := ghx.RunService(ctx, receivePack, nil, res.Writer, func(_ io.Reader, w io.Writer) error {
+				return rpr.writeReport(w)
+			})
+			if err != nil {
+				ctx.Logger().Error("failed to write the report to response", "error", err)
+			}
+			result := ctx.Result()
+			result.Err = rejection
+			result.ErrorKind = ErrorKindRejected
+			ghx.Event.notify(AfterReceivePack, ctx)
+			return
+		}
+	}
 
-	bufOut := bufPool.Get().([]byte)
-	defer bufPool.Put(bufOut)
-	if _, err := io.CopyBuffer(res.Writer, stdout, bufOut); err != nil {
-		ghx.logger.Error("failed to write the standard output to response. ", err.Error())
-		return
+	ghx.serviceRPC(ctx, receivePack, io.MultiReader(bytes.NewReader(rpr.encode()), body), rpr.copyReport)
+
+	// The refs may be updated even if receive-pack fails.
+	if ghx.options.packCache != nil {
+		ghx.options.packCache.Invalidate(ctx.RepoPath())
+	}
+	if ghx.options.bundleAfterPush {
+		ghx.createBundleAfterPush(ctx.RepoPath())
 	}
+}
 
-	if err = cmd.Wait(); err != nil {
-		ghx.logger.Error("specified command fails to run or doesn't complete successfully. ", err.Error())
+// serviceRPC runs the service of the backend with body as the request.
+// The output of the backend is written to the response with copyOutput if it is not nil.
+// The returned error has been logged and rendered already.
+func (ghx *GitHTTPXfer) serviceRPC(ctx Context, rpc string, body io.Reader, copyOutput func(w io.Writer, stdout io.Reader) error) error {
+
+	res := ctx.Response()
+	release, ok := ghx.Admit(ctx, rpc)
+	if !ok {
+		return errNotAdmitted
+	}
+	defer release()
+	ctx.SetEnv(ghx.commandEnv(ctx, rpc))
+
+	run := ghx.Backend.UploadPack
+	if rpc == receivePack {
+		run = ghx.Backend.ReceivePack
+	}
+
+	w := &rpcResponseWriter{res: res, rpc: rpc}
+	err := copyRPCOutput(w, copyOutput, func(w io.Writer) error {
+		return ghx.RunService(ctx, rpc, body, w, func(r io.Reader, w io.Writer) error {
+			return run(ctx, r, w)
+		})
+	})
+	defer ghx.Event.notify(afterEvent(rpc), ctx)
+	var tooLarge *BodyTooLargeError
+	if errors.As(err, &tooLarge) && !w.wroteHeader {
+		ghx.renderBodyTooLarge(ctx, rpc, tooLarge)
+		return err
 	}
+	if err != nil {
+		ctx.Logger().Error("failed to run "+rpc, "error", err)
+		ghx.ReportError(ctx, serviceErrorKind(err), err)
+		if !w.wroteHeader {
+			RenderInternalServerError(res.Writer)
+		}
+		return err
+	}
+	w.writeHeader()
+	return nil
+}
+
+// afterEvent returns the event emitted after the service.
+func afterEvent(rpc string) EventKey {
+	if rpc == receivePack {
+		return AfterReceivePack
+	}
+	return AfterUploadPack
+}
+
+// copyRPCOutput calls run with w, or with the pipe to copyOutput if it is not nil.
+func copyRPCOutput(w io.Writer, copyOutput func(w io.Writer, stdout io.Reader) error, run func(w io.Writer) error) error {
+	if copyOutput == nil {
+		return run(w)
+	}
+	pr, pw := io.Pipe()
+	copied := make(chan error, 1)
+	go func() {
+		err := copyOutput(w, pr)
+		pr.CloseWithError(err)
+		copied <- err
+	}()
+	err := run(pw)
+	pw.CloseWithError(err)
+	if copyErr := <-copied; err == nil {
+		err = copyErr
+	}
+	return err
+}
+
+// rpcResponseWriter writes the header of the service result just before the first output,
+// so that the failure before the output can be rendered as the internal server error.
+type rpcResponseWriter struct {
+	res         *Response
+	rpc         string
+	wroteHeader bool
+}
+
+func (w *rpcResponseWriter) writeHeader() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.res.SetContentType(fmt.Sprintf("application/x-git-%s-result", w.rpc))
+	w.res.WriteHeader(http.StatusOK)
+}
+
+func (w *rpcResponseWriter) Write(p []byte) (int, error) {
+	w.writeHeader()
+	return w.res.Write(p)
 }
 
 var bufPool = sync.Pool{
@@ -341,26 +843,45 @@ var bufPool = sync.Pool{
 }
 
 func (ghx *GitHTTPXfer) getInfoRefs(ctx Context) {
-	res, req, repoPath := ctx.Response(), ctx.Request(), ctx.RepoPath()
+	res, req := ctx.Response(), ctx.Request()
 
 	serviceName := getServiceType(req)
 	if !ghx.Git.HasAccess(req, serviceName, false) {
-		args := []string{"update-server-info"}
-		cmd := ghx.Git.GitCommand(repoPath, args...)
-		cmd.Env = ctx.Env()
-		cmd.Output()
+		// The event is emitted before git updates the files for the dumb protocol.
+		if !ghx.emit(BeforeServeFile, ctx, "", false) {
+			return
+		}
+		release, ok := ghx.Admit(ctx, updateServerInfo)
+		if !ok {
+			return
+		}
+		err := ghx.Backend.UpdateServerInfo(ctx)
+		release()
+		if err != nil {
+			ctx.Logger().Error("failed to update the info files", "error", err)
+		}
 		res.HdrNocache()
-		if err := ghx.sendFile("text/plain; charset=utf-8", ctx); err != nil {
+		if err := ghx.serveFile("text/plain; charset=utf-8", ctx); err != nil {
 			RenderNotFound(res.Writer)
 		}
 		return
 	}
 
-	args := []string{serviceName, "--stateless-rpc", "--advertise-refs", "."}
-	cmd := ghx.Git.GitCommand(repoPath, args...)
-	cmd.Env = ctx.Env()
-	refs, err := cmd.Output()
+	if !ghx.emit(BeforeInfoRefs, ctx, "", false) {
+		return
+	}
+
+	release, ok := ghx.Admit(ctx, serviceName)
+	if !ok {
+		return
+	}
+	ctx.SetEnv(ghx.commandEnv(ctx, serviceName))
+	refs := &bytes.Buffer{}
+	err := ghx.Backend.AdvertiseRefs(ctx, serviceName, refs)
+	release()
 	if err != nil {
+		ctx.Logger().Error("failed to advertise the refs", "error", err)
+		ghx.ReportError(ctx, serviceErrorKind(err), err)
 		RenderNotFound(ctx.Response().Writer)
 		return
 	}
@@ -368,9 +889,63 @@ func (ghx *GitHTTPXfer) getInfoRefs(ctx Context) {
 	res.HdrNocache()
 	res.SetContentType(fmt.Sprintf("application/x-git-%s-advertisement", serviceName))
 	res.WriteHeader(http.StatusOK)
-	res.PktWrite("# service=git-" + serviceName + "\n")
-	res.PktFlush()
-	res.Write(refs)
+	// The protocol v2 starts with the capability advertisement, not with the service preamble.
+	if !ghx.isProtocolV2(ctx, serviceName) {
+		res.PktWrite("# service=git-" + serviceName + "\n")
+		res.PktFlush()
+	} else if ghx.options.bundleURI && ghx.latestBundle(ctx.RepoPath(), false) != "" {
+		res.Write(advertiseBundleURI(refs.Bytes()))
+		return
+	}
+	res.Write(refs.Bytes())
+}
+
+// gitProtocol returns the value of the "Git-Protocol" header that may be passed to git.
+func (ghx *GitHTTPXfer) gitProtocol(ctx Context, rpc string) string {
+	if !ghx.options.protocolV2 || !ghx.Backend.SupportsProtocolV2() {
+		return ""
+	}
+	if f := ghx.options.protocolV2Func; f != nil && !f(ctx.RepoPath()) {
+		return ""
+	}
+	return getGitProtocol(ctx.Request())
+}
+
+// isProtocolV2 reports whether the request is served with the protocol v2.
+// Only upload-pack speaks the protocol v2, receive-pack always falls back to v0.
+func (ghx *GitHTTPXfer) isProtocolV2(ctx Context, rpc string) bool {
+	return rpc == uploadPack && hasProtocolVersion2(ghx.gitProtocol(ctx, rpc))
+}
+
+func (ghx *GitHTTPXfer) uploadPackConfig(ctx Context) UploadPackConfig {
+	if f := ghx.options.uploadPackConfigFunc; f != nil {
+		return f(ctx.RepoPath())
+	}
+	return ghx.options.uploadPackConfig
+}
+
+// commandEnv returns the environment of the git process.
+// It is ctx.Env() plus GIT_PROTOCOL and the config of upload-pack, which is merged into GIT_CONFIG_PARAMETERS of ctx.Env().
+func (ghx *GitHTTPXfer) commandEnv(ctx Context, rpc string) []string {
+	env := ctx.Env()
+	if env == nil {
+		env = os.Environ()
+	}
+
+	extra := []string{}
+	if protocol := ghx.gitProtocol(ctx, rpc); protocol != "" {
+		extra = append(extra, "GIT_PROTOCOL="+protocol)
+	}
+	if rpc == uploadPack {
+		if config := ghx.uploadPackConfig(ctx).gitConfig(); len(config) > 0 {
+			extra = append(extra, GitConfigParameters(env, config))
+		}
+	}
+
+	if len(extra) == 0 {
+		return ctx.Env()
+	}
+	return append(env[:len(env):len(env)], extra...)
 }
 
 func (ghx *GitHTTPXfer) getInfoPacks(ctx Context) {
@@ -410,8 +985,17 @@ func (ghx *GitHTTPXfer) getTextFile(ctx Context) {
 }
 
 func (ghx *GitHTTPXfer) sendFile(contentType string, ctx Context) error {
+	if !ghx.emit(BeforeServeFile, ctx, "", false) {
+		// The rejection has been rendered.
+		return nil
+	}
+	return ghx.serveFile(contentType, ctx)
+}
+
+// serveFile serves the file without emitting BeforeServeFile.
+func (ghx *GitHTTPXfer) serveFile(contentType string, ctx Context) error {
 	res, req, repoPath, filePath := ctx.Response(), ctx.Request(), ctx.RepoPath(), ctx.FilePath()
-	fileInfo, err := ghx.Git.GetRequestFileInfo(repoPath, filePath)
+	fileInfo, err := ghx.Backend.GetRequestFileInfo(repoPath, filePath)
 	if err != nil {
 		return err
 	}
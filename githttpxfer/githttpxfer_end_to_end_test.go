@@ -1,6 +1,8 @@
-package githttpxfer
+package githttpxfer_test
 
 import (
+	"crypto/rand"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -9,7 +11,12 @@ import (
 	"path"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/nulab/go-git-http-xfer/addon/metrics/prometheus"
+	"github.com/nulab/go-git-http-xfer/githttpxfer"
 )
 
 type EndToEndTestParams struct {
@@ -19,7 +26,7 @@ type EndToEndTestParams struct {
 	absRepoPath    string
 	remoteRepoURL  string
 	workingDirPath string // Ex: output destination of git clone.
-	ghx            *GitHTTPXfer
+	ghx            *githttpxfer.GitHTTPXfer
 	ts             *httptest.Server
 }
 
@@ -27,7 +34,7 @@ var (
 	endToEndTestParams *EndToEndTestParams
 )
 
-func setupEndToEndTest(t *testing.T) error {
+func setupEndToEndTest(t *testing.T, opts ...githttpxfer.Option) error {
 
 	_, err := exec.LookPath("git")
 	if err != nil {
@@ -37,30 +44,31 @@ func setupEndToEndTest(t *testing.T) error {
 
 	endToEndTestParams = new(EndToEndTestParams)
 
-	endToEndTestParams.gitRootPath = "/data/git"
+	// Every test has its own root, so that it does not depend on what the others have pushed.
+	endToEndTestParams.gitRootPath = t.TempDir()
 	endToEndTestParams.gitBinPath = "/usr/bin/git"
 	endToEndTestParams.repoName = "e2e_test.git"
 
-	ghx, err := New(endToEndTestParams.gitRootPath, endToEndTestParams.gitBinPath)
+	ghx, err := githttpxfer.New(endToEndTestParams.gitRootPath, endToEndTestParams.gitBinPath, opts...)
 	if err != nil {
 		t.Errorf("GitHTTPXfer instance could not be created. %s", err.Error())
 		return err
 	}
 
 	endToEndTestParams.ghx = ghx
-	endToEndTestParams.ghx.Event.On(BeforeUploadPack, func(ctx Context) {
+	endToEndTestParams.ghx.Event.On(githttpxfer.BeforeUploadPack, func(ctx githttpxfer.Context) {
 		t.Log("prepare run service rpc upload.")
 	})
-	endToEndTestParams.ghx.Event.On(BeforeReceivePack, func(ctx Context) {
+	endToEndTestParams.ghx.Event.On(githttpxfer.BeforeReceivePack, func(ctx githttpxfer.Context) {
 		t.Log("prepare run service rpc receive.")
 	})
-	endToEndTestParams.ghx.Event.On(AfterMatchRouting, func(ctx Context) {
+	endToEndTestParams.ghx.Event.On(githttpxfer.AfterMatchRouting, func(ctx githttpxfer.Context) {
 		t.Log("after match routing.")
 	})
 
 	endToEndTestParams.ts = httptest.NewServer(endToEndTestParams.ghx)
 
-	endToEndTestParams.absRepoPath = endToEndTestParams.ghx.Git.GetAbsolutePath(endToEndTestParams.repoName)
+	endToEndTestParams.absRepoPath, _ = endToEndTestParams.ghx.Git.GetAbsolutePath(endToEndTestParams.repoName)
 	os.Mkdir(endToEndTestParams.absRepoPath, os.ModeDir)
 
 	if _, err := execCmd(endToEndTestParams.absRepoPath, "git", "init", "--bare", "--shared"); err != nil {
@@ -69,8 +77,24 @@ func setupEndToEndTest(t *testing.T) error {
 	}
 
 	endToEndTestParams.remoteRepoURL = endToEndTestParams.ts.URL + "/" + endToEndTestParams.repoName
-	tempDir, _ := ioutil.TempDir("", "githttpxfer")
-	endToEndTestParams.workingDirPath = tempDir
+	endToEndTestParams.workingDirPath = t.TempDir()
+	return nil
+}
+
+// pushEndToEndTestCommit pushes a commit to master of the repository of the test.
+func pushEndToEndTestCommit(t *testing.T) error {
+	srcDirPath := path.Join(endToEndTestParams.workingDirPath, "test_src")
+	commands := [][]string{
+		{"init", srcDirPath},
+		{"-C", srcDirPath, "-c", "user.name=John Smith", "-c", "user.email=js@example.com", "commit", "--allow-empty", "-m", "first commit"},
+		{"-C", srcDirPath, "push", endToEndTestParams.remoteRepoURL, "HEAD:refs/heads/master"},
+	}
+	for _, args := range commands {
+		if output, err := execCmd("", "git", args...); err != nil {
+			t.Errorf("execute command error: %s %s", err.Error(), output)
+			return err
+		}
+	}
 	return nil
 }
 
@@ -154,7 +178,6 @@ func Test_End_To_End_it_should_succeed_clone_and_push_and_fetch_and_log(t *testi
 		t.Errorf("execute command error: %s", err.Error())
 		return
 	}
-
 }
 
 func Test_End_To_End_it_should_succeed_request_to_get_info_refs(t *testing.T) {
@@ -181,7 +204,6 @@ func Test_End_To_End_it_should_succeed_request_to_get_info_refs(t *testing.T) {
 		t.Errorf("ioutil.ReadAll error: %s", err.Error())
 		return
 	}
-
 }
 
 func Test_End_To_End_it_should_succeed_request_to_get_HEAD(t *testing.T) {
@@ -217,6 +239,10 @@ func Test_End_To_End_it_should_succeed_request_to_loose_objects(t *testing.T) {
 	}
 	defer teardownEndToEndTest()
 
+	if err := pushEndToEndTestCommit(t); err != nil {
+		return
+	}
+
 	res, err := http.Get(endToEndTestParams.remoteRepoURL + "/info/refs")
 	if err != nil {
 		t.Errorf("http.Get: %s", err.Error())
@@ -254,7 +280,6 @@ func Test_End_To_End_it_should_succeed_request_to_loose_objects(t *testing.T) {
 		t.Errorf("StatusCode is not 200. result: %d", res.StatusCode)
 		return
 	}
-
 }
 
 // TODO Should succeed but check if not 404. Rename the test
@@ -265,6 +290,10 @@ func Test_End_To_End_it_should_succeed_request_to_get_info_packs(t *testing.T) {
 	}
 	defer teardownEndToEndTest()
 
+	if err := pushEndToEndTestCommit(t); err != nil {
+		return
+	}
+
 	if _, err := execCmd(endToEndTestParams.absRepoPath, "git", "gc"); err != nil {
 		t.Errorf("execute command error: %s", err.Error())
 		return
@@ -331,5 +360,937 @@ func Test_End_To_End_it_should_succeed_request_to_get_info_packs(t *testing.T) {
 		t.Errorf("StatusCode is not 404. result: %d", res.StatusCode)
 		return
 	}
+}
+
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+func pushFirstCommit(t *testing.T, destDirPath string) error {
+
+	if _, err := execCmd("", "git", "clone", endToEndTestParams.remoteRepoURL, destDirPath); err != nil {
+		t.Errorf("execute command error: %s", err.Error())
+		return err
+	}
+
+	if _, err := execCmd(destDirPath, "git", "commit", "--allow-empty", "-m", "first commit"); err != nil {
+		t.Errorf("execute command error: %s", err.Error())
+		return err
+	}
+
+	if _, err := execCmd(destDirPath, "git", "push", "-u", "origin", "master"); err != nil {
+		t.Errorf("execute command error: %s", err.Error())
+		return err
+	}
+	return nil
+}
+
+func requestInfoRefsWithProtocolV2() (string, error) {
+	req, err := http.NewRequest(http.MethodGet, endToEndTestParams.remoteRepoURL+"/info/refs?service=git-upload-pack", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Git-Protocol", "version=2")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("StatusCode is not 200. result: %d", res.StatusCode)
+	}
+
+	bodyBytes, err := ioutil.ReadAll(res.Body)
+	return string(bodyBytes), err
+}
+
+func requestUploadPackWithProtocolV2(body string) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, endToEndTestParams.remoteRepoURL+"/git-upload-pack", strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-git-upload-pack-request")
+	req.Header.Set("Git-Protocol", "version=2")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("StatusCode is not 200. result: %d", res.StatusCode)
+	}
+
+	bodyBytes, err := ioutil.ReadAll(res.Body)
+	return string(bodyBytes), err
+}
+
+func Test_End_To_End_it_should_succeed_ls_refs_and_fetch_with_protocol_v2(t *testing.T) {
+
+	if err := setupEndToEndTest(t); err != nil {
+		return
+	}
+	defer teardownEndToEndTest()
+
+	destDirPath := path.Join(endToEndTestParams.workingDirPath, "test_protocol_v2")
+	if err := pushFirstCommit(t, destDirPath); err != nil {
+		return
+	}
+
+	advertisement, err := requestInfoRefsWithProtocolV2()
+	if err != nil {
+		t.Errorf("info/refs error: %s", err.Error())
+		return
+	}
+
+	if !strings.HasPrefix(advertisement, pktLine("version 2\n")) {
+		t.Errorf("advertisement is not protocol v2. result: %s", advertisement)
+		return
+	}
+
+	if strings.Contains(advertisement, "# service=") {
+		t.Errorf("advertisement contains the service preamble. result: %s", advertisement)
+		return
+	}
+
+	lsRefs, err := requestUploadPackWithProtocolV2(pktLine("command=ls-refs\n") + "0001" + pktLine("peel\n") + "0000")
+	if err != nil {
+		t.Errorf("ls-refs error: %s", err.Error())
+		return
+	}
 
+	m := regexp.MustCompile("([0-9a-f]{40}) refs/heads/master").FindStringSubmatch(lsRefs)
+	if m == nil {
+		t.Errorf("ls-refs does not contain refs/heads/master. result: %s", lsRefs)
+		return
+	}
+
+	fetch, err := requestUploadPackWithProtocolV2(pktLine("command=fetch\n") + "0001" + pktLine("want "+m[1]+"\n") + pktLine("done\n") + "0000")
+	if err != nil {
+		t.Errorf("fetch error: %s", err.Error())
+		return
+	}
+
+	if !strings.Contains(fetch, pktLine("packfile\n")) {
+		t.Errorf("fetch does not contain the packfile section. result: %q", fetch)
+		return
+	}
+
+	if _, err := execCmd(destDirPath, "git", "-c", "protocol.version=2", "fetch"); err != nil {
+		t.Errorf("execute command error: %s", err.Error())
+		return
+	}
+
+}
+
+func Test_End_To_End_it_should_fall_back_to_protocol_v0_if_protocol_v2_is_disabled(t *testing.T) {
+
+	tests := []struct {
+		description string
+		option      githttpxfer.Option
+	}{
+		{
+			description: "it should fall back if protocol v2 is disabled",
+			option:      githttpxfer.DisableProtocolV2(),
+		},
+		{
+			description: "it should fall back if protocol v2 is disabled for the repository",
+			option: githttpxfer.WithProtocolV2Func(func(repoPath string) bool {
+				return repoPath != "/"+endToEndTestParams.repoName
+			}),
+		},
+	}
+
+	for _, tc := range tests {
+
+		t.Log(tc.description)
+
+		if err := setupEndToEndTest(t, tc.option); err != nil {
+			return
+		}
+
+		advertisement, err := requestInfoRefsWithProtocolV2()
+		teardownEndToEndTest()
+		if err != nil {
+			t.Errorf("info/refs error: %s", err.Error())
+			return
+		}
+
+		if !strings.HasPrefix(advertisement, pktLine("# service=git-upload-pack\n")+"0000") {
+			t.Errorf("advertisement is not protocol v0. result: %s", advertisement)
+			return
+		}
+	}
+
+}
+
+func Test_End_To_End_it_should_show_the_rejection_message_to_the_git_client(t *testing.T) {
+
+	if err := setupEndToEndTest(t); err != nil {
+		return
+	}
+	defer teardownEndToEndTest()
+
+	destDirPath := path.Join(endToEndTestParams.workingDirPath, "test_reject")
+	if err := pushFirstCommit(t, destDirPath); err != nil {
+		return
+	}
+
+	endToEndTestParams.ghx.Event.On(githttpxfer.BeforeReceivePack, func(ctx githttpxfer.Context) {
+		ctx.Reject("branch master is protected")
+	})
+	endToEndTestParams.ghx.Event.On(githttpxfer.BeforeUploadPack, func(ctx githttpxfer.Context) {
+		ctx.Reject("quota exceeded")
+	})
+
+	if _, err := execCmd(destDirPath, "git", "commit", "--allow-empty", "-m", "second commit"); err != nil {
+		t.Errorf("execute command error: %s", err.Error())
+		return
+	}
+
+	tests := []struct {
+		description     string
+		args            []string
+		expectedMessage string
+	}{
+		{
+			description:     "it should show the rejection message of push",
+			args:            []string{"push", "origin", "master"},
+			expectedMessage: "branch master is protected",
+		},
+		{
+			description:     "it should show the rejection message of push without side-band",
+			args:            []string{"-c", "sendpack.sideband=false", "push", "origin", "master"},
+			expectedMessage: "branch master is protected",
+		},
+		{
+			description:     "it should show the rejection message of fetch",
+			args:            []string{"fetch", "origin"},
+			expectedMessage: "quota exceeded",
+		},
+		{
+			description:     "it should show the rejection message of clone with protocol v0",
+			args:            []string{"-c", "protocol.version=0", "clone", endToEndTestParams.remoteRepoURL, path.Join(endToEndTestParams.workingDirPath, "test_reject_v0")},
+			expectedMessage: "quota exceeded",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		output, err := execCmd(destDirPath, "git", tc.args...)
+		if err == nil {
+			t.Errorf("git %s succeeded.", strings.Join(tc.args, " "))
+			return
+		}
+		if !strings.Contains(string(output), tc.expectedMessage) {
+			t.Errorf("output does not contain %q . result: %s", tc.expectedMessage, output)
+			return
+		}
+	}
+
+}
+
+func Test_End_To_End_it_should_reject_ref_updates_one_by_one(t *testing.T) {
+
+	if err := setupEndToEndTest(t); err != nil {
+		return
+	}
+	defer teardownEndToEndTest()
+
+	destDirPath := path.Join(endToEndTestParams.workingDirPath, "test_reject_ref")
+	if err := pushFirstCommit(t, destDirPath); err != nil {
+		return
+	}
+
+	var refNames []string
+	endToEndTestParams.ghx.Event.On(githttpxfer.BeforeReceivePack, func(ctx githttpxfer.Context) {
+		for _, c := range ctx.ReceivePackRequest().Commands {
+			refNames = append(refNames, c.RefName)
+			if c.RefName == "refs/heads/master" {
+				c.Reject("branch master is protected")
+			}
+		}
+	})
+
+	if _, err := execCmd(destDirPath, "git", "commit", "--allow-empty", "-m", "second commit"); err != nil {
+		t.Errorf("execute command error: %s", err.Error())
+		return
+	}
+
+	tests := []struct {
+		description string
+		args        []string
+		branch      string
+	}{
+		{
+			description: "it should reject master and accept feature",
+			args:        []string{"push", "origin", "master", "master:feature"},
+			branch:      "feature",
+		},
+		{
+			description: "it should reject master and accept feature without side-band",
+			args:        []string{"-c", "sendpack.sideband=false", "push", "origin", "master", "master:feature2"},
+			branch:      "feature2",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+
+		refNames = nil
+		output, err := execCmd(destDirPath, "git", tc.args...)
+		if err == nil {
+			t.Errorf("git push succeeded. output: %s", output)
+			return
+		}
+
+		if !strings.Contains(string(output), "[remote rejected] master -> master (branch master is protected)") {
+			t.Errorf("output does not contain the rejection of master. result: %s", output)
+			return
+		}
+
+		if len(refNames) != 2 || refNames[0] != "refs/heads/master" || refNames[1] != "refs/heads/"+tc.branch {
+			t.Errorf("ref names are not parsed. result: %v", refNames)
+			return
+		}
+
+		if _, err := execCmd(endToEndTestParams.absRepoPath, "git", "rev-parse", "--verify", "refs/heads/"+tc.branch); err != nil {
+			t.Errorf("%s is not pushed. error: %s", tc.branch, err.Error())
+			return
+		}
+	}
+
+	var result *githttpxfer.Result
+	endToEndTestParams.ghx.Event.On(githttpxfer.AfterReceivePack, func(ctx githttpxfer.Context) {
+		result = ctx.Result()
+	})
+
+	output, err := execCmd(destDirPath, "git", "push", "origin", "master")
+	if err == nil {
+		t.Errorf("git push succeeded. output: %s", output)
+		return
+	}
+
+	if !strings.Contains(string(output), "[remote rejected] master -> master (branch master is protected)") {
+		t.Errorf("output does not contain the rejection of master. result: %s", output)
+		return
+	}
+
+	if result == nil || result.Service != "receive-pack" || result.ErrorKind != githttpxfer.ErrorKindRejected || result.BytesOut == 0 {
+		t.Errorf("AfterReceivePack is not emitted with the result of the rejected push. result: %+v", result)
+	}
+
+}
+
+func Test_End_To_End_it_should_parse_the_negotiation_of_upload_pack(t *testing.T) {
+
+	if err := setupEndToEndTest(t); err != nil {
+		return
+	}
+	defer teardownEndToEndTest()
+
+	destDirPath := path.Join(endToEndTestParams.workingDirPath, "test_negotiation")
+	if err := pushFirstCommit(t, destDirPath); err != nil {
+		return
+	}
+
+	var requests []*githttpxfer.UploadPackRequest
+	endToEndTestParams.ghx.Event.On(githttpxfer.BeforeUploadPack, func(ctx githttpxfer.Context) {
+		requests = append(requests, ctx.UploadPackRequest())
+	})
+
+	tests := []struct {
+		description string
+		version     string
+		command     string
+	}{
+		{
+			description: "it should parse the shallow clone with protocol v0",
+			version:     "0",
+			command:     "",
+		},
+		{
+			description: "it should parse the shallow clone with protocol v2",
+			version:     "2",
+			command:     "fetch",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+
+		requests = nil
+		cloneDirPath := path.Join(endToEndTestParams.workingDirPath, "test_negotiation_v"+tc.version)
+		if _, err := execCmd("", "git", "-c", "protocol.version="+tc.version, "clone", "--depth=1", endToEndTestParams.remoteRepoURL, cloneDirPath); err != nil {
+			t.Errorf("execute command error: %s", err.Error())
+			return
+		}
+
+		var fetch *githttpxfer.UploadPackRequest
+		for _, req := range requests {
+			if req.Command == tc.command {
+				fetch = req
+			}
+		}
+		if fetch == nil {
+			t.Errorf("the request of fetch is not found. result: %v", requests)
+			return
+		}
+		if len(fetch.Wants) == 0 || fetch.Depth != 1 || !fetch.Done {
+			t.Errorf("the request of fetch is not parsed. result: %+v", fetch)
+			return
+		}
+	}
+
+}
+
+func Test_End_To_End_it_should_run_git_with_the_command_factory(t *testing.T) {
+
+	var mu sync.Mutex
+	subcommands := map[string]bool{}
+	option := githttpxfer.WithCommandFactory(func(absRepoPath, subcommand string, args ...string) *exec.Cmd {
+		mu.Lock()
+		defer mu.Unlock()
+		subcommands[subcommand] = true
+		return exec.Command("nice", append([]string{"-n", "10", "/usr/bin/git", subcommand}, args...)...)
+	})
+
+	if err := setupEndToEndTest(t, option); err != nil {
+		return
+	}
+	defer teardownEndToEndTest()
+
+	destDirPath := path.Join(endToEndTestParams.workingDirPath, "test_command_factory")
+	if err := pushFirstCommit(t, destDirPath); err != nil {
+		return
+	}
+
+	res, err := http.Get(endToEndTestParams.remoteRepoURL + "/info/refs")
+	if err != nil {
+		t.Errorf("http.Get: %s", err.Error())
+		return
+	}
+	res.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, subcommand := range []string{"upload-pack", "receive-pack", "update-server-info"} {
+		if !subcommands[subcommand] {
+			t.Errorf("%s is not run by the command factory. result: %v", subcommand, subcommands)
+		}
+	}
+
+}
+
+func Test_End_To_End_it_should_serve_the_partial_clone(t *testing.T) {
+
+	tests := []struct {
+		description string
+		option      githttpxfer.Option
+		filtered    bool
+	}{
+		{
+			description: "it should serve the partial clone",
+			option: githttpxfer.WithUploadPackConfig(githttpxfer.UploadPackConfig{
+				AllowFilter:        true,
+				AllowAnySHA1InWant: true,
+			}),
+			filtered: true,
+		},
+		{
+			description: "it should serve the partial clone for the repository",
+			option: githttpxfer.WithUploadPackConfigFunc(func(repoPath string) githttpxfer.UploadPackConfig {
+				return githttpxfer.UploadPackConfig{
+					AllowFilter:        repoPath == "/"+endToEndTestParams.repoName,
+					AllowAnySHA1InWant: repoPath == "/"+endToEndTestParams.repoName,
+				}
+			}),
+			filtered: true,
+		},
+		{
+			description: "it should ignore the filter by default",
+			option:      githttpxfer.WithUploadPackConfig(githttpxfer.UploadPackConfig{}),
+			filtered:    false,
+		},
+	}
+
+	for i, tc := range tests {
+		t.Log(tc.description)
+
+		if err := setupEndToEndTest(t, tc.option); err != nil {
+			return
+		}
+		ok := testPartialClone(t, i, tc.filtered)
+		teardownEndToEndTest()
+		if !ok {
+			return
+		}
+	}
+
+}
+
+func testPartialClone(t *testing.T, i int, filtered bool) bool {
+
+	srcDirPath := path.Join(endToEndTestParams.workingDirPath, "test_partial_clone_src")
+	if _, err := execCmd("", "git", "clone", endToEndTestParams.remoteRepoURL, srcDirPath); err != nil {
+		t.Errorf("execute command error: %s", err.Error())
+		return false
+	}
+	if err := ioutil.WriteFile(path.Join(srcDirPath, "large.bin"), []byte("large content"), 0644); err != nil {
+		t.Errorf("ioutil.WriteFile error: %s", err.Error())
+		return false
+	}
+	for _, args := range [][]string{{"add", "large.bin"}, {"commit", "-m", "add large.bin"}, {"push", "origin", "HEAD:master"}} {
+		if output, err := execCmd(srcDirPath, "git", args...); err != nil {
+			t.Errorf("execute command error: %s %s", err.Error(), output)
+			return false
+		}
+	}
+
+	for _, version := range []string{"0", "2"} {
+		destDirPath := path.Join(endToEndTestParams.workingDirPath, fmt.Sprintf("test_partial_clone_%d_v%s", i, version))
+		if output, err := execCmd("", "git", "-c", "protocol.version="+version, "clone", "--no-checkout", "--filter=blob:none", endToEndTestParams.remoteRepoURL, destDirPath); err != nil {
+			t.Errorf("execute command error: %s %s", err.Error(), output)
+			return false
+		}
+
+		missing, err := execCmd(destDirPath, "git", "rev-list", "--objects", "--missing=print", "HEAD")
+		if err != nil {
+			t.Errorf("execute command error: %s %s", err.Error(), missing)
+			return false
+		}
+		if strings.Contains(string(missing), "?") != filtered {
+			t.Errorf("the blobs are not filtered as expected with protocol v%s. result: %s", version, missing)
+			return false
+		}
+
+		// The checkout fetches the missing blob lazily.
+		if output, err := execCmd(destDirPath, "git", "-c", "protocol.version="+version, "checkout", "master"); err != nil {
+			t.Errorf("execute command error: %s %s", err.Error(), output)
+			return false
+		}
+		content, err := ioutil.ReadFile(path.Join(destDirPath, "large.bin"))
+		if err != nil || string(content) != "large content" {
+			t.Errorf("large.bin is not checked out with protocol v%s. result: %s", version, content)
+			return false
+		}
+	}
+	return true
+}
+
+func Test_End_To_End_it_should_serve_the_clone_from_the_pack_cache(t *testing.T) {
+
+	cacheDir, err := ioutil.TempDir("", "githttpxfer")
+	if err != nil {
+		t.Errorf("Create Temp Dir error: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(cacheDir)
+
+	cache, err := githttpxfer.NewPackCache(cacheDir, 10*1024*1024, 0)
+	if err != nil {
+		t.Errorf("NewPackCache error: %s", err.Error())
+		return
+	}
+
+	var mu sync.Mutex
+	runs := 0
+	factory := githttpxfer.DefaultCommandFactory("/usr/bin/git")
+	option := githttpxfer.WithCommandFactory(func(absRepoPath, subcommand string, args ...string) *exec.Cmd {
+		if subcommand == "upload-pack" && args[len(args)-2] != "--advertise-refs" {
+			mu.Lock()
+			runs++
+			mu.Unlock()
+		}
+		return factory(absRepoPath, subcommand, args...)
+	})
+
+	if err := setupEndToEndTest(t, option, githttpxfer.WithPackCache(cache)); err != nil {
+		return
+	}
+	defer teardownEndToEndTest()
+
+	destDirPath := path.Join(endToEndTestParams.workingDirPath, "test_pack_cache")
+	if err := pushFirstCommit(t, destDirPath); err != nil {
+		return
+	}
+
+	// The clone with the protocol v2 runs upload-pack for ls-refs as well, which is not cached.
+	tests := []struct {
+		description  string
+		push         bool
+		expectedRuns int
+	}{
+		{
+			description:  "it should run upload-pack for the first clone",
+			expectedRuns: 2,
+		},
+		{
+			description:  "it should serve the second clone from the cache",
+			expectedRuns: 1,
+		},
+		{
+			description:  "it should run upload-pack after the push",
+			push:         true,
+			expectedRuns: 2,
+		},
+	}
+
+	for i, tc := range tests {
+		t.Log(tc.description)
+
+		if tc.push {
+			if _, err := execCmd(destDirPath, "git", "commit", "--allow-empty", "-m", "second commit"); err != nil {
+				t.Errorf("execute command error: %s", err.Error())
+				return
+			}
+			if _, err := execCmd(destDirPath, "git", "push", "origin", "master"); err != nil {
+				t.Errorf("execute command error: %s", err.Error())
+				return
+			}
+		}
+
+		mu.Lock()
+		runs = 0
+		mu.Unlock()
+
+		cloneDirPath := path.Join(endToEndTestParams.workingDirPath, fmt.Sprintf("test_pack_cache_%d", i))
+		if output, err := execCmd("", "git", "clone", endToEndTestParams.remoteRepoURL, cloneDirPath); err != nil {
+			t.Errorf("execute command error: %s %s", err.Error(), output)
+			return
+		}
+		if _, err := execCmd(cloneDirPath, "git", "fsck"); err != nil {
+			t.Errorf("execute command error: %s", err.Error())
+			return
+		}
+
+		mu.Lock()
+		if runs != tc.expectedRuns {
+			t.Errorf("upload-pack runs is not %d . result: %d", tc.expectedRuns, runs)
+		}
+		mu.Unlock()
+	}
+
+	if cache.Size() == 0 {
+		t.Error("pack cache is empty.")
+	}
+
+}
+
+func Test_End_To_End_it_should_coalesce_the_identical_upload_pack_requests(t *testing.T) {
+
+	var mu sync.Mutex
+	runs := 0
+	option := githttpxfer.WithCommandFactory(func(absRepoPath, subcommand string, args ...string) *exec.Cmd {
+		if subcommand != "upload-pack" || args[len(args)-2] == "--advertise-refs" {
+			return exec.Command("/usr/bin/git", append([]string{subcommand}, args...)...)
+		}
+		mu.Lock()
+		runs++
+		mu.Unlock()
+		// Wait for the other clients to join.
+		return exec.Command("sh", append([]string{"-c", `sleep 1; exec /usr/bin/git "$@"`, "sh", subcommand}, args...)...)
+	})
+
+	if err := setupEndToEndTest(t, option, githttpxfer.WithUploadPackCoalescing("")); err != nil {
+		return
+	}
+	defer teardownEndToEndTest()
+
+	destDirPath := path.Join(endToEndTestParams.workingDirPath, "test_coalesce")
+	if err := pushFirstCommit(t, destDirPath); err != nil {
+		return
+	}
+
+	mu.Lock()
+	runs = 0
+	mu.Unlock()
+
+	clients := 3
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		cloneDirPath := path.Join(endToEndTestParams.workingDirPath, fmt.Sprintf("test_coalesce_%d", i))
+		go func() {
+			output, err := execCmd("", "git", "-c", "protocol.version=0", "clone", endToEndTestParams.remoteRepoURL, cloneDirPath)
+			if err == nil {
+				output, err = execCmd(cloneDirPath, "git", "fsck")
+			}
+			if err != nil {
+				err = fmt.Errorf("%s %s", err.Error(), output)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < clients; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("execute command error: %s", err.Error())
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if runs != 1 {
+		t.Errorf("upload-pack runs is not 1 . result: %d", runs)
+	}
+
+}
+
+func Test_End_To_End_it_should_serve_the_bundle_uri(t *testing.T) {
+
+	if err := setupEndToEndTest(t, githttpxfer.WithBundleURI(true)); err != nil {
+		return
+	}
+	defer teardownEndToEndTest()
+
+	destDirPath := path.Join(endToEndTestParams.workingDirPath, "test_bundle_uri")
+	if err := pushFirstCommit(t, destDirPath); err != nil {
+		return
+	}
+
+	// The bundle is created in the background after the push.
+	var advertisement string
+	for i := 0; i < 50; i++ {
+		var err error
+		if advertisement, err = requestInfoRefsWithProtocolV2(); err != nil {
+			t.Errorf("info/refs error: %s", err.Error())
+			return
+		}
+		if strings.Contains(advertisement, pktLine("bundle-uri\n")) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !strings.Contains(advertisement, pktLine("bundle-uri\n")) {
+		t.Errorf("advertisement does not contain bundle-uri. result: %s", advertisement)
+		return
+	}
+
+	bundleList, err := requestUploadPackWithProtocolV2(pktLine("command=bundle-uri\n") + "0001" + "0000")
+	if err != nil {
+		t.Errorf("bundle-uri error: %s", err.Error())
+		return
+	}
+	m := regexp.MustCompile(`bundle\.latest\.uri=(\S+)`).FindStringSubmatch(bundleList)
+	if m == nil || !strings.Contains(bundleList, pktLine("bundle.version=1\n")) || !strings.Contains(bundleList, pktLine("bundle.mode=all\n")) {
+		t.Errorf("bundle list is not valid. result: %s", bundleList)
+		return
+	}
+	bundleURI := m[1]
+
+	res, err := http.Get(bundleURI)
+	if err != nil {
+		t.Errorf("http.Get: %s", err.Error())
+		return
+	}
+	bundle, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(string(bundle), "# v2 git bundle\n") {
+		t.Errorf("bundle is not served. status: %d", res.StatusCode)
+		return
+	}
+
+	if _, err := execCmd(destDirPath, "git", "commit", "--allow-empty", "-m", "second commit"); err != nil {
+		t.Errorf("execute command error: %s", err.Error())
+		return
+	}
+	if _, err := execCmd(destDirPath, "git", "push", "origin", "master"); err != nil {
+		t.Errorf("execute command error: %s", err.Error())
+		return
+	}
+
+	// The clone gets the first commit from the bundle even if the bundle is behind.
+	cloneDirPath := path.Join(endToEndTestParams.workingDirPath, "test_bundle_uri_clone")
+	if output, err := execCmd("", "git", "clone", "--bundle-uri="+bundleURI, endToEndTestParams.remoteRepoURL, cloneDirPath); err != nil || strings.Contains(string(output), "warning") {
+		t.Errorf("the clone with the bundle fails. error: %v, output: %s", err, output)
+		return
+	}
+	if output, err := execCmd(cloneDirPath, "git", "log", "--oneline", "-1", "--format=%s"); err != nil || strings.TrimSpace(string(output)) != "second commit" {
+		t.Errorf("the clone is not up to date. result: %s", output)
+		return
+	}
+
+}
+
+func Test_End_To_End_it_should_reject_the_request_body_that_exceeds_the_limit(t *testing.T) {
+
+	limits := githttpxfer.BodyLimits{
+		UploadPack:  githttpxfer.BodyLimit{Compressed: 64 * 1024, Decompressed: 64 * 1024},
+		ReceivePack: githttpxfer.BodyLimit{Compressed: 64 * 1024, Decompressed: 64 * 1024},
+	}
+	if err := setupEndToEndTest(t, githttpxfer.WithBodyLimitsFunc(func(repoPath string) githttpxfer.BodyLimits {
+		if repoPath == "/e2e_test.git" {
+			return limits
+		}
+		return githttpxfer.BodyLimits{}
+	})); err != nil {
+		return
+	}
+	defer teardownEndToEndTest()
+
+	destDirPath := path.Join(endToEndTestParams.workingDirPath, "test_body_limit")
+	if err := pushFirstCommit(t, destDirPath); err != nil {
+		return
+	}
+
+	large := make([]byte, 1024*1024)
+	rand.Read(large)
+	if err := ioutil.WriteFile(path.Join(destDirPath, "large.bin"), large, 0644); err != nil {
+		t.Errorf("write file error: %s", err.Error())
+		return
+	}
+	if output, err := execCmd(destDirPath, "git", "add", "large.bin"); err != nil {
+		t.Errorf("execute command error: %s %s", err.Error(), output)
+		return
+	}
+	if output, err := execCmd(destDirPath, "git", "commit", "-m", "large commit"); err != nil {
+		t.Errorf("execute command error: %s %s", err.Error(), output)
+		return
+	}
+
+	tests := []struct {
+		description string
+		args        []string
+	}{
+		{
+			description: "it should reject the large push sent in chunks",
+			args:        []string{"push", "origin", "master"},
+		},
+		{
+			description: "it should reject the large push with Content-Length",
+			args:        []string{"-c", "http.postBuffer=2097152", "push", "origin", "master"},
+		},
+	}
+	for _, tc := range tests {
+		t.Log(tc.description)
+		output, err := execCmd(destDirPath, "git", tc.args...)
+		if err == nil {
+			t.Errorf("git %s succeeded.", strings.Join(tc.args, " "))
+			return
+		}
+		if !strings.Contains(string(output), "exceeds the limit of 65536 bytes") {
+			t.Errorf("output does not contain the limit. result: %s", output)
+			return
+		}
+	}
+
+	output, err := execCmd(destDirPath, "git", "ls-remote", "origin", "master")
+	if err != nil {
+		t.Errorf("execute command error: %s %s", err.Error(), output)
+		return
+	}
+	head, _ := execCmd(destDirPath, "git", "rev-parse", "HEAD")
+	if strings.Contains(string(output), strings.TrimSpace(string(head))) {
+		t.Errorf("the large push updated the ref. result: %s", output)
+		return
+	}
+
+	limits.ReceivePack = githttpxfer.BodyLimit{}
+	if output, err := execCmd(destDirPath, "git", "push", "origin", "master"); err != nil {
+		t.Errorf("the push without the limit failed. %s %s", err.Error(), output)
+		return
+	}
+
+	limits.UploadPack = githttpxfer.BodyLimit{Compressed: 16}
+	cloneDirPath := path.Join(endToEndTestParams.workingDirPath, "test_body_limit_clone")
+	output, err = execCmd("", "git", "clone", endToEndTestParams.remoteRepoURL, cloneDirPath)
+	if err == nil || !strings.Contains(string(output), "exceeds the limit of 16 bytes") {
+		t.Errorf("the large fetch negotiation is not rejected. result: %s", output)
+	}
+}
+
+func Test_End_To_End_it_should_report_the_metrics_of_the_clone_and_push(t *testing.T) {
+
+	metrics := prometheus.New()
+	if err := setupEndToEndTest(t, githttpxfer.WithMetrics(metrics)); err != nil {
+		return
+	}
+	defer teardownEndToEndTest()
+
+	destDirPath := path.Join(endToEndTestParams.workingDirPath, "test_metrics")
+	if err := pushFirstCommit(t, destDirPath); err != nil {
+		return
+	}
+
+	rec := httptest.NewRecorder()
+	metrics.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/metrics", nil))
+	result := rec.Body.String()
+
+	tests := []struct {
+		description string
+		expected    string
+	}{
+		{description: "it should count the upload-pack that has exited", expected: `githttpxfer_service_finished_total{service="upload-pack",exit_code="0"}`},
+		{description: "it should count the receive-pack that has exited", expected: `githttpxfer_service_finished_total{service="receive-pack",exit_code="0"} 1`},
+		{description: "it should count the requests of the push", expected: `githttpxfer_requests_total{class="push"} 2`},
+		{description: "it should count the bytes of the push", expected: `githttpxfer_request_bytes_total{class="push"}`},
+	}
+	for _, tc := range tests {
+		t.Log(tc.description)
+		if !strings.Contains(result, tc.expected) {
+			t.Errorf("the metrics do not contain %q . result: %s", tc.expected, result)
+		}
+	}
+}
+
+func Test_End_To_End_it_should_create_the_repository_on_the_first_push(t *testing.T) {
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Log("git is not found. so skip git e2e test.")
+		return
+	}
+
+	gitRootPath, err := ioutil.TempDir("", "githttpxfer")
+	if err != nil {
+		t.Errorf("Create Temp Dir error: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(gitRootPath)
+
+	ghx, err := githttpxfer.New(gitRootPath, "/usr/bin/git", githttpxfer.WithPushToCreate(githttpxfer.PushToCreate{
+		Authorize: func(ctx githttpxfer.Context) error {
+			if !strings.HasPrefix(ctx.RepoPath(), "/team/") {
+				return &githttpxfer.RejectionError{Message: "you can not create " + ctx.RepoPath()}
+			}
+			return nil
+		},
+		DefaultBranch: "main",
+	}))
+	if err != nil {
+		t.Errorf("GitHTTPXfer instance could not be created. %s", err.Error())
+		return
+	}
+	ts := httptest.NewServer(ghx)
+	defer ts.Close()
+
+	workingDirPath := path.Join(gitRootPath, "work")
+	if _, err := execCmd("", "git", "init", workingDirPath); err != nil {
+		t.Errorf("execute command error: %s", err.Error())
+		return
+	}
+	if _, err := execCmd(workingDirPath, "git", "commit", "--allow-empty", "-m", "first commit"); err != nil {
+		t.Errorf("execute command error: %s", err.Error())
+		return
+	}
+
+	if output, err := execCmd(workingDirPath, "git", "push", ts.URL+"/team/new.git", "HEAD:refs/heads/main"); err != nil {
+		t.Errorf("the push to create is failed. result: %s", output)
+		return
+	}
+	absRepoPath, _ := ghx.Git.GetAbsolutePath("/team/new.git")
+	if output, err := execCmd(absRepoPath, "git", "symbolic-ref", "HEAD"); err != nil || string(output) != "refs/heads/main\n" {
+		t.Errorf("HEAD is not refs/heads/main . result: %s", output)
+	}
+	if _, err := execCmd(absRepoPath, "git", "rev-parse", "--verify", "refs/heads/main"); err != nil {
+		t.Error("the pushed branch does not exist.")
+	}
+
+	if output, err := execCmd(workingDirPath, "git", "push", ts.URL+"/other/new.git", "HEAD:refs/heads/main"); err == nil {
+		t.Errorf("the push that is not authorized succeeds. result: %s", output)
+	}
+	if ghx.Git.Exists("/other/new.git") {
+		t.Error("the repository that is not authorized is created.")
+	}
 }
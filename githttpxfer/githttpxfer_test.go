@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os/exec"
+	"strings"
 	"testing"
 )
 
@@ -69,6 +70,70 @@ func Test_GitHTTPXfer_GitHTTPXferOption(t *testing.T) {
 
 }
 
+func Test_GitHTTPXfer_URL(t *testing.T) {
+
+	tests := []struct {
+		description string
+		opts        []Option
+		tls         bool
+		proto       string
+		expected    string
+	}{
+		{
+			description: "it should return the url of the request",
+			expected:    "http://example.com/foo.git/info/lfs",
+		},
+		{
+			description: "it should return https if the request is tls",
+			tls:         true,
+			expected:    "https://example.com/foo.git/info/lfs",
+		},
+		{
+			description: "it should ignore X-Forwarded-Proto by default",
+			proto:       "https",
+			expected:    "http://example.com/foo.git/info/lfs",
+		},
+		{
+			description: "it should return the scheme of X-Forwarded-Proto",
+			opts:        []Option{WithForwardedProto()},
+			proto:       "https, http",
+			expected:    "https://example.com/foo.git/info/lfs",
+		},
+		{
+			description: "it should ignore the invalid X-Forwarded-Proto",
+			opts:        []Option{WithForwardedProto()},
+			proto:       "ftp",
+			expected:    "http://example.com/foo.git/info/lfs",
+		},
+		{
+			description: "it should return the url of the base url",
+			opts:        []Option{WithBaseURL("https://git.example.com/prefix/")},
+			proto:       "http",
+			expected:    "https://git.example.com/prefix/foo.git/info/lfs",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		ghx, err := New("/data/git", "/usr/bin/git", tc.opts...)
+		if err != nil {
+			t.Errorf("GitHTTPXfer instance could not be created. %s", err.Error())
+			continue
+		}
+		url := "http://example.com/foo.git/info/lfs"
+		if tc.tls {
+			url = "https://example.com/foo.git/info/lfs"
+		}
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		if tc.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tc.proto)
+		}
+		if result := ghx.URL(r, "/foo.git/info/lfs"); tc.expected != result {
+			t.Errorf("url is not %s . result: %s", tc.expected, result)
+		}
+	}
+}
+
 func Test_GitHTTPXfer_MatchRouting_should_not_match(t *testing.T) {
 	t.Log("it should not match if http method is different")
 	var err error
@@ -188,3 +253,68 @@ func Test_GitHTTPXfer_MatchRouting_should_match(t *testing.T) {
 		}
 	}
 }
+
+func Test_GitHTTPXfer_commandEnv_should_merge_the_config_of_upload_pack(t *testing.T) {
+
+	// The config of the hooks that the LFS locking sets on the environment.
+	lfsEnv := []string{"HOME=/root", "GIT_CONFIG_PARAMETERS='core.hooksPath=/var/lib/lfs-hooks'"}
+
+	tests := []struct {
+		description string
+		rpc         string
+		env         []string
+		config      UploadPackConfig
+		expected    string
+	}{
+		{
+			description: "it should add the config of upload-pack after the config of the environment",
+			rpc:         uploadPack,
+			env:         lfsEnv,
+			config:      UploadPackConfig{AllowFilter: true},
+			expected:    "GIT_CONFIG_PARAMETERS='core.hooksPath=/var/lib/lfs-hooks' 'uploadpack.allowFilter=true'",
+		},
+		{
+			description: "it should keep the config of the environment for receive-pack",
+			rpc:         receivePack,
+			env:         lfsEnv,
+			config:      UploadPackConfig{AllowFilter: true},
+			expected:    "GIT_CONFIG_PARAMETERS='core.hooksPath=/var/lib/lfs-hooks'",
+		},
+		{
+			description: "it should keep the config of the environment without the config of upload-pack",
+			rpc:         uploadPack,
+			env:         lfsEnv,
+			config:      UploadPackConfig{},
+			expected:    "GIT_CONFIG_PARAMETERS='core.hooksPath=/var/lib/lfs-hooks'",
+		},
+		{
+			description: "it should set the config of upload-pack alone",
+			rpc:         uploadPack,
+			env:         []string{"HOME=/root"},
+			config:      UploadPackConfig{AllowAnySHA1InWant: true},
+			expected:    "GIT_CONFIG_PARAMETERS='uploadpack.allowAnySHA1InWant=true'",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		ghx, err := New("/data/git", "/usr/bin/git", WithUploadPackConfig(tc.config))
+		if err != nil {
+			t.Errorf("GitHTTPXfer instance could not be created. %s", err.Error())
+			return
+		}
+		ctx := NewContext(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "http://example.com/foo/git-"+tc.rpc, nil), "foo", "git-"+tc.rpc)
+		ctx.SetEnv(tc.env)
+
+		// exec.Cmd uses the last value of the duplicated variable.
+		result := ""
+		for _, e := range ghx.commandEnv(ctx, tc.rpc) {
+			if strings.HasPrefix(e, "GIT_CONFIG_PARAMETERS=") {
+				result = e
+			}
+		}
+		if result != tc.expected {
+			t.Errorf("GIT_CONFIG_PARAMETERS is not %s . result: %s", tc.expected, result)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package githttpxfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+)
+
+// BodyLimit is the maximum size of the request body in bytes. Zero means no limit.
+type BodyLimit struct {
+	// Compressed limits the body as it is sent, which is gzip compressed if Content-Encoding is gzip.
+	Compressed int64
+	// Decompressed limits the body that is passed to git.
+	Decompressed int64
+	// Buffered limits the beginning of the body that is kept in memory to parse, such as the negotiation of upload-pack
+	// or the commands of receive-pack. It is 10 MiB if zero, like GIT_HTTP_MAX_REQUEST_BUFFER of git-http-backend.
+	Buffered int64
+}
+
+// defaultBufferedLimit is the default of BodyLimit.Buffered.
+const defaultBufferedLimit = 10 << 20
+
+// BodyLimits holds the limit of the request body for each service.
+type BodyLimits struct {
+	UploadPack  BodyLimit
+	ReceivePack BodyLimit
+}
+
+func (ghx *GitHTTPXfer) bodyLimit(ctx Context, rpc string) BodyLimit {
+	limits := ghx.options.bodyLimits
+	if ghx.options.bodyLimitsFunc != nil {
+		limits = ghx.options.bodyLimitsFunc(ctx.RepoPath())
+	}
+	if rpc == receivePack {
+		return limits.ReceivePack
+	}
+	return limits.UploadPack
+}
+
+// requestBody reads the request body, decompressing it if needed, within the limit.
+type requestBody struct {
+	io.Reader
+	compressed   *limitedReader
+	decompressed *limitedReader
+	gzip         io.Closer
+	// contentLength is -1 if the body is sent in chunks.
+	contentLength int64
+}
+
+func getRequestBody(req *http.Request, limit BodyLimit) (*requestBody, error) {
+	body := &requestBody{
+		compressed:    &limitedReader{r: req.Body, limit: limit.Compressed},
+		contentLength: req.ContentLength,
+	}
+	body.Reader = body.compressed
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gr, err := gzip.NewReader(body.compressed)
+		if err != nil {
+			if tooLarge := body.tooLarge(); tooLarge != nil {
+				return nil, tooLarge
+			}
+			return nil, err
+		}
+		body.gzip = gr
+		body.decompressed = &limitedReader{r: gr, limit: limit.Decompressed, decompressed: true}
+		body.Reader = body.decompressed
+	} else if limit.Decompressed > 0 {
+		body.decompressed = &limitedReader{r: body.compressed, limit: limit.Decompressed, decompressed: true}
+		body.Reader = body.decompressed
+	}
+	return body, nil
+}
+
+func (b *requestBody) Close() error {
+	if b.gzip != nil {
+		return b.gzip.Close()
+	}
+	return nil
+}
+
+// tooLarge returns the error if the body has exceeded the limit, or Content-Length exceeds it.
+// It is checked after parsing the beginning of the body, so that the error can be rendered as the client expects.
+func (b *requestBody) tooLarge() *BodyTooLargeError {
+	if limit := b.compressed.limit; limit > 0 && b.contentLength > limit {
+		return &BodyTooLargeError{Limit: limit}
+	}
+	if b.compressed.err != nil {
+		return b.compressed.err
+	}
+	if b.decompressed != nil {
+		return b.decompressed.err
+	}
+	return nil
+}
+
+// limitedReader fails once more than limit bytes are read.
+// Unlike io.LimitedReader, the excess is an error, not the end of the body.
+type limitedReader struct {
+	r            io.Reader
+	limit        int64
+	n            int64
+	decompressed bool
+	err          *BodyTooLargeError
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.err != nil {
+		return 0, l.err
+	}
+	if l.limit <= 0 {
+		return l.r.Read(p)
+	}
+	if max := l.limit - l.n + 1; int64(len(p)) > max {
+		p = p[:max]
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.limit {
+		l.err = &BodyTooLargeError{Limit: l.limit, Decompressed: l.decompressed}
+		return n - int(l.n-l.limit), l.err
+	}
+	return n, err
+}
+
+// parseBuffer keeps the beginning of the request body that is parsed, and fails once it exceeds the limit.
+type parseBuffer struct {
+	bytes.Buffer
+	limit int64
+	err   *BufferTooLargeError
+}
+
+func newParseBuffer(limit int64) *parseBuffer {
+	if limit <= 0 {
+		limit = defaultBufferedLimit
+	}
+	return &parseBuffer{limit: limit}
+}
+
+func (b *parseBuffer) Write(p []byte) (int, error) {
+	if b.err == nil && int64(b.Len()+len(p)) > b.limit {
+		b.err = &BufferTooLargeError{Limit: b.limit}
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.Buffer.Write(p)
+}
+
+// renderBodyTooLarge renders the error as the result of the service, so that git shows the message.
+// err is *BodyTooLargeError or *BufferTooLargeError.
+func (ghx *GitHTTPXfer) renderBodyTooLarge(ctx Context, rpc string, err error) {
+	ctx.Logger().Warn("the request body is too large", "error", err)
+	ghx.ReportError(ctx, ErrorKindBodyTooLarge, err)
+	sideband := false
+	if rpr := ctx.ReceivePackRequest(); rpc == receivePack && rpr != nil {
+		sideband = rpr.usesSideband()
+	}
+	RenderGitError(ctx.Response().Writer, rpc, err.Error(), sideband)
+}
@@ -0,0 +1,169 @@
+package githttpxfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_GetRequestBody_should_limit_the_body(t *testing.T) {
+
+	zeros := make([]byte, 1024*1024)
+	compressed := &bytes.Buffer{}
+	gw := gzip.NewWriter(compressed)
+	gw.Write(zeros)
+	gw.Close()
+
+	tests := []struct {
+		description string
+		body        []byte
+		gzip        bool
+		chunked     bool
+		limit       BodyLimit
+		expected    *BodyTooLargeError
+	}{
+		{
+			description: "it should read the body within the limits",
+			body:        compressed.Bytes(),
+			gzip:        true,
+			limit:       BodyLimit{Compressed: int64(compressed.Len()), Decompressed: int64(len(zeros))},
+		},
+		{
+			description: "it should read the body without the limits",
+			body:        zeros,
+		},
+		{
+			description: "it should reject the decompressed body",
+			body:        compressed.Bytes(),
+			gzip:        true,
+			limit:       BodyLimit{Decompressed: 1024},
+			expected:    &BodyTooLargeError{Limit: 1024, Decompressed: true},
+		},
+		{
+			description: "it should reject the compressed body",
+			body:        compressed.Bytes(),
+			gzip:        true,
+			chunked:     true,
+			limit:       BodyLimit{Compressed: 100},
+			expected:    &BodyTooLargeError{Limit: 100},
+		},
+		{
+			description: "it should reject the body by Content-Length",
+			body:        zeros,
+			limit:       BodyLimit{Compressed: 100},
+			expected:    &BodyTooLargeError{Limit: 100},
+		},
+		{
+			description: "it should reject the body sent in chunks",
+			body:        zeros,
+			chunked:     true,
+			limit:       BodyLimit{Decompressed: 100},
+			expected:    &BodyTooLargeError{Limit: 100, Decompressed: true},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		req := httptest.NewRequest("POST", "http://example.com/base/foo/git-upload-pack", bytes.NewReader(tc.body))
+		if tc.gzip {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		if tc.chunked {
+			req.ContentLength = -1
+		}
+		body, err := getRequestBody(req, tc.limit)
+		if err != nil {
+			t.Errorf("error is not nil. result: %s", err.Error())
+			continue
+		}
+		read, err := ioutil.ReadAll(body)
+		tooLarge := body.tooLarge()
+		if tc.expected == nil {
+			if err != nil || tooLarge != nil || !bytes.Equal(read, zeros) {
+				t.Errorf("the body is not read. error: %v, tooLarge: %v", err, tooLarge)
+			}
+			continue
+		}
+		if tooLarge == nil || *tooLarge != *tc.expected {
+			t.Errorf("tooLarge is not %v . result: %v", tc.expected, tooLarge)
+			continue
+		}
+		// Content-Length is checked after reading the beginning, so the body itself is read.
+		if tc.chunked && err == nil {
+			t.Errorf("the body is read over the limit. result: %d bytes", len(read))
+		}
+	}
+}
+
+func Test_ParseRequest_should_limit_the_buffer(t *testing.T) {
+
+	wants := &bytes.Buffer{}
+	for i := 0; i < 100; i++ {
+		wants.WriteString(pktLine("want " + newID + "\n"))
+	}
+	commands := &bytes.Buffer{}
+	for i := 0; i < 100; i++ {
+		commands.WriteString(pktLine(oldID + " " + newID + " refs/heads/master\n"))
+	}
+
+	tests := []struct {
+		description string
+		parse       func(limit int64) error
+		limit       int64
+		tooLarge    bool
+	}{
+		{
+			description: "it should parse the negotiation within the limit",
+			parse: func(limit int64) error {
+				_, err := parseUploadPackRequest(strings.NewReader(wants.String()+"0000"+pktLine("done\n")), limit)
+				return err
+			},
+			limit: 10000,
+		},
+		{
+			description: "it should reject the negotiation over the limit",
+			parse: func(limit int64) error {
+				_, err := parseUploadPackRequest(strings.NewReader(wants.String()+"0000"+pktLine("done\n")), limit)
+				return err
+			},
+			limit:    1000,
+			tooLarge: true,
+		},
+		{
+			description: "it should parse the commands within the limit",
+			parse: func(limit int64) error {
+				_, err := parseReceivePackRequest(strings.NewReader(commands.String()+"0000PACK"), limit)
+				return err
+			},
+			limit: 20000,
+		},
+		{
+			description: "it should reject the commands over the limit",
+			parse: func(limit int64) error {
+				_, err := parseReceivePackRequest(strings.NewReader(commands.String()+"0000PACK"), limit)
+				return err
+			},
+			limit:    1000,
+			tooLarge: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		err := tc.parse(tc.limit)
+		tooLarge, ok := err.(*BufferTooLargeError)
+		if ok != tc.tooLarge {
+			t.Errorf("error is not BufferTooLargeError as %t . result: %v", tc.tooLarge, err)
+			continue
+		}
+		if !ok && err != nil {
+			t.Errorf("error is not nil. result: %s", err.Error())
+		}
+		if ok && tooLarge.Limit != tc.limit {
+			t.Errorf("limit is not %d . result: %d", tc.limit, tooLarge.Limit)
+		}
+	}
+}
@@ -1,13 +1,121 @@
 package githttpxfer
 
-import "log"
+import (
+	gocontext "context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+)
 
+// Logger is the leveled logger. keysAndValues are the alternating keys and values of the fields.
 type Logger interface {
-	Error(args ...interface{})
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+	// With returns the logger that adds the fields to every message.
+	With(keysAndValues ...interface{}) Logger
 }
 
-type defaultLogger struct {}
+// defaultLogger writes the messages except Debug with the standard logger.
+type defaultLogger struct {
+	fields []interface{}
+}
+
+func (l *defaultLogger) print(level, msg string, keysAndValues []interface{}) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteString(" ")
+	b.WriteString(msg)
+	fields := append(l.fields[:len(l.fields):len(l.fields)], keysAndValues...)
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 < len(fields) {
+			fmt.Fprintf(&b, " %v=%v", fields[i], fields[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v", fields[i])
+		}
+	}
+	log.Print(b.String())
+}
+
+func (*defaultLogger) Debug(msg string, keysAndValues ...interface{}) {}
+
+func (l *defaultLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.print("INFO", msg, keysAndValues)
+}
+
+func (l *defaultLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.print("WARN", msg, keysAndValues)
+}
+
+func (l *defaultLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.print("ERROR", msg, keysAndValues)
+}
+
+func (l *defaultLogger) With(keysAndValues ...interface{}) Logger {
+	return &defaultLogger{fields: append(l.fields[:len(l.fields):len(l.fields)], keysAndValues...)}
+}
+
+// NewSlogLogger returns the Logger that writes with log/slog.
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return &slogLogger{logger}
+}
+
+type slogLogger struct {
+	logger *slog.Logger
+}
 
-func (*defaultLogger) Error(args ...interface{}) {
-	log.Print(args...)
-}
\ No newline at end of file
+func (l *slogLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.logger.Log(gocontext.Background(), slog.LevelDebug, msg, keysAndValues...)
+}
+
+func (l *slogLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.logger.Log(gocontext.Background(), slog.LevelInfo, msg, keysAndValues...)
+}
+
+func (l *slogLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.logger.Log(gocontext.Background(), slog.LevelWarn, msg, keysAndValues...)
+}
+
+func (l *slogLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.logger.Log(gocontext.Background(), slog.LevelError, msg, keysAndValues...)
+}
+
+func (l *slogLogger) With(keysAndValues ...interface{}) Logger {
+	return &slogLogger{l.logger.With(keysAndValues...)}
+}
+
+// requestLogger returns the logger with the fields of the request.
+// The request ID is taken from X-Request-Id, or generated if the header is missing.
+func requestLogger(logger Logger, req *http.Request, repoPath string) Logger {
+	fields := []interface{}{"repo", repoPath}
+	if service := requestService(req); service != "" {
+		fields = append(fields, "service", service)
+	}
+	return logger.With(append(fields, "remote_addr", req.RemoteAddr, "request_id", requestID(req))...)
+}
+
+func requestService(req *http.Request) string {
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/git-upload-pack"):
+		return uploadPack
+	case strings.HasSuffix(req.URL.Path, "/git-receive-pack"):
+		return receivePack
+	case strings.HasSuffix(req.URL.Path, "/info/refs"):
+		return getServiceType(req)
+	}
+	return ""
+}
+
+func requestID(req *http.Request) string {
+	if id := req.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
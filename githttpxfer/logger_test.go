@@ -0,0 +1,115 @@
+package githttpxfer
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testLogger keeps the output of the slog logger.
+type testLogger struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *testLogger) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *testLogger) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+func (l *testLogger) slog() Logger {
+	return NewSlogLogger(slog.New(slog.NewTextHandler(l, &slog.HandlerOptions{Level: slog.LevelDebug})))
+}
+
+func Test_SlogLogger_should_write_the_levels_and_the_fields(t *testing.T) {
+
+	tests := []struct {
+		description string
+		log         func(logger Logger)
+		expected    string
+	}{
+		{description: "it should write debug", log: func(logger Logger) { logger.Debug("queued", "depth", 1) }, expected: "level=DEBUG msg=queued depth=1"},
+		{description: "it should write info", log: func(logger Logger) { logger.Info("started") }, expected: "level=INFO msg=started"},
+		{description: "it should write warn", log: func(logger Logger) { logger.Warn("refused", "limit", "global") }, expected: "level=WARN msg=refused limit=global"},
+		{description: "it should write error", log: func(logger Logger) { logger.Error("failed", "error", "exit status 1") }, expected: `level=ERROR msg=failed error="exit status 1"`},
+		{description: "it should write the fields of With", log: func(logger Logger) { logger.With("repo", "/foo.git").Info("started", "service", uploadPack) }, expected: "level=INFO msg=started repo=/foo.git service=upload-pack"},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		logger := &testLogger{}
+		tc.log(logger.slog())
+		if result := logger.String(); !strings.Contains(result, tc.expected) {
+			t.Errorf("the log does not contain %q . result: %s", tc.expected, result)
+		}
+	}
+}
+
+func Test_requestLogger_should_have_the_fields_of_the_request(t *testing.T) {
+
+	tests := []struct {
+		description string
+		method      string
+		url         string
+		requestID   string
+		expected    []string
+	}{
+		{description: "it should have the service of upload-pack", method: http.MethodPost, url: "/foo.git/git-upload-pack", requestID: "abc", expected: []string{"repo=/foo.git", "service=upload-pack", "remote_addr=192.0.2.1:1234", "request_id=abc"}},
+		{description: "it should have the service of the advertisement", method: http.MethodGet, url: "/foo.git/info/refs?service=git-receive-pack", requestID: "abc", expected: []string{"service=receive-pack"}},
+		{description: "it should not have the service of the static file", method: http.MethodGet, url: "/foo.git/HEAD", requestID: "abc", expected: []string{"repo=/foo.git", "request_id=abc"}},
+		{description: "it should generate the request ID", method: http.MethodGet, url: "/foo.git/HEAD", expected: []string{"request_id="}},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		logger := &testLogger{}
+		req := httptest.NewRequest(tc.method, "http://example.com"+tc.url, nil)
+		if tc.requestID != "" {
+			req.Header.Set("X-Request-Id", tc.requestID)
+		}
+		requestLogger(logger.slog(), req, "/foo.git").Info("served")
+		result := logger.String()
+		for _, expected := range tc.expected {
+			if !strings.Contains(result, expected) {
+				t.Errorf("the log does not contain %q . result: %s", expected, result)
+			}
+		}
+		if tc.requestID == "" && strings.Contains(result, "request_id= ") {
+			t.Errorf("the request ID is not generated. result: %s", result)
+		}
+	}
+}
+
+func Test_ServeHTTP_should_set_the_logger_of_the_request(t *testing.T) {
+
+	ghx, err := New("/data/git", "/usr/bin/git")
+	if err != nil {
+		t.Errorf("An instance could not be created. %s", err.Error())
+		return
+	}
+	logger := &testLogger{}
+	ghx.SetLogger(logger.slog())
+	ghx.Event.On(AfterMatchRouting, func(ctx Context) {
+		ctx.Logger().Info("routed")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/test.git/info/refs?service=git-upload-pack", nil)
+	req.Header.Set("X-Request-Id", "req-1")
+	ghx.ServeHTTP(httptest.NewRecorder(), req)
+
+	expected := "msg=routed repo=/test.git service=upload-pack remote_addr=192.0.2.1:1234 request_id=req-1"
+	if result := logger.String(); !strings.Contains(result, expected) {
+		t.Errorf("the log does not contain %q . result: %s", expected, result)
+	}
+}
@@ -0,0 +1,99 @@
+package githttpxfer
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os/exec"
+	"sync/atomic"
+	"time"
+)
+
+// The kinds of the errors that are passed to Metrics.Error.
+const (
+	ErrorKindBadRequest   = "bad_request"
+	ErrorKindBodyTooLarge = "body_too_large"
+	ErrorKindRejected     = "rejected"
+	ErrorKindListener     = "listener"
+	ErrorKindRateLimited  = "rate_limited"
+	ErrorKindNotAdmitted  = "not_admitted"
+	ErrorKindTimeout      = "timeout"
+	ErrorKindService      = "service"
+	ErrorKindResolve      = "resolve"
+	ErrorKindUnsafePath   = "unsafe_path"
+)
+
+// Metrics is called at the key points of the requests. It must be safe for the concurrent use.
+type Metrics interface {
+	// RequestRouted is called when the request has matched a route.
+	RequestRouted(ctx Context)
+	// ServiceStarted is called before the service such as "upload-pack" runs.
+	ServiceStarted(ctx Context, service string)
+	// ServiceFinished is called after the service has run.
+	// exitCode is 0 on success, the exit code of git if it has exited with an error, or -1 otherwise.
+	ServiceFinished(ctx Context, service string, exitCode int, elapsed time.Duration)
+	// BytesTransferred is called after the request with the bytes read from the request body and written to the response.
+	BytesTransferred(ctx Context, read, written int64)
+	// QueueWaited is called after the request has waited for a git process, whether it has been admitted or not.
+	QueueWaited(ctx Context, service string, wait time.Duration, admitted bool)
+	// QueueDepth is called with the number of the waiting requests whenever it changes.
+	QueueDepth(depth int)
+	// Error is called when the request fails, with the kind such as ErrorKindTimeout.
+	Error(ctx Context, kind string)
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) RequestRouted(ctx Context)                                                        {}
+func (nopMetrics) ServiceStarted(ctx Context, service string)                                       {}
+func (nopMetrics) ServiceFinished(ctx Context, service string, exitCode int, elapsed time.Duration) {}
+func (nopMetrics) BytesTransferred(ctx Context, read, written int64)                                {}
+func (nopMetrics) QueueWaited(ctx Context, service string, wait time.Duration, admitted bool)       {}
+func (nopMetrics) QueueDepth(depth int)                                                             {}
+func (nopMetrics) Error(ctx Context, kind string)                                                   {}
+
+// Metrics returns the metrics that the addon handlers report to.
+func (ghx *GitHTTPXfer) Metrics() Metrics {
+	return ghx.metrics
+}
+
+// ExitCode returns the exit code of the git command that has returned err, or -1 if it has not exited by itself.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// countingBody counts the bytes read from the request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+	return n, err
+}
+
+// countingResponseWriter counts the bytes written to the response.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	atomic.AddInt64(&w.n, int64(n))
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the original writer.
+func (w *countingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,134 @@
+package githttpxfer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingMetrics records the calls of Metrics.
+type recordingMetrics struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (m *recordingMetrics) record(format string, args ...interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.calls = append(m.calls, fmt.Sprintf(format, args...))
+}
+
+func (m *recordingMetrics) String() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return strings.Join(m.calls, "\n")
+}
+
+func (m *recordingMetrics) RequestRouted(ctx Context) {
+	m.record("routed %s", ctx.RepoPath())
+}
+
+func (m *recordingMetrics) ServiceStarted(ctx Context, service string) {
+	m.record("started %s", service)
+}
+
+func (m *recordingMetrics) ServiceFinished(ctx Context, service string, exitCode int, elapsed time.Duration) {
+	m.record("finished %s %d", service, exitCode)
+}
+
+func (m *recordingMetrics) BytesTransferred(ctx Context, read, written int64) {
+	m.record("transferred %d %t", read, written > 0)
+}
+
+func (m *recordingMetrics) QueueWaited(ctx Context, service string, wait time.Duration, admitted bool) {
+	m.record("waited %s %t", service, admitted)
+}
+
+func (m *recordingMetrics) QueueDepth(depth int) {
+	m.record("depth %d", depth)
+}
+
+func (m *recordingMetrics) Error(ctx Context, kind string) {
+	m.record("error %s", kind)
+}
+
+func Test_ExitCode(t *testing.T) {
+
+	exitErr := exec.Command("sh", "-c", "exit 3").Run()
+
+	tests := []struct {
+		description string
+		err         error
+		expected    int
+	}{
+		{description: "it should be 0 without the error", err: nil, expected: 0},
+		{description: "it should be the exit code of the command", err: exitErr, expected: 3},
+		{description: "it should be the exit code of the wrapped error", err: fmt.Errorf("failed. %w", exitErr), expected: 3},
+		{description: "it should be -1 for the other errors", err: errors.New("failed to start"), expected: -1},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		if code := ExitCode(tc.err); code != tc.expected {
+			t.Errorf("exit code is not %d . result: %d", tc.expected, code)
+		}
+	}
+}
+
+func Test_ServeHTTP_should_report_the_metrics(t *testing.T) {
+
+	metrics := &recordingMetrics{}
+	ghx, err := New("/data/git", "/usr/bin/git",
+		WithMetrics(metrics),
+		WithRateLimits(RateLimits{Fetch: RateLimit{Rate: 0.1, Burst: 1}}),
+	)
+	if err != nil {
+		t.Errorf("An instance could not be created. %s", err.Error())
+		return
+	}
+
+	tests := []struct {
+		description string
+		method      string
+		url         string
+		body        string
+		expected    string
+	}{
+		{
+			description: "it should report the bytes of the advertisement",
+			method:      http.MethodGet,
+			url:         "/test.git/info/refs?service=git-upload-pack",
+			expected:    "routed /test.git\ntransferred 0 true",
+		},
+		{
+			description: "it should report the request that is rate limited",
+			method:      http.MethodGet,
+			url:         "/test.git/info/refs?service=git-upload-pack",
+			expected:    "routed /test.git\nerror rate_limited\ntransferred 0 true",
+		},
+		{
+			description: "it should report the request that cannot be parsed",
+			method:      http.MethodPost,
+			url:         "/example.git/git-receive-pack",
+			body:        "zzzz",
+			expected:    "routed /example.git\nerror bad_request\ntransferred 4 true",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		metrics.calls = nil
+		req := httptest.NewRequest(tc.method, "http://example.com"+tc.url, strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/x-git-receive-pack-request")
+		ghx.ServeHTTP(httptest.NewRecorder(), req)
+		if result := metrics.String(); result != tc.expected {
+			t.Errorf("the metrics are not %q . result: %q", tc.expected, result)
+		}
+	}
+}
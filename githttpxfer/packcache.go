@@ -0,0 +1,266 @@
+package githttpxfer
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const packCacheFileSuffix = ".pack-cache"
+
+// PackCache keeps the responses of upload-pack for the clones on the disk.
+// The least recently used responses are evicted when the total size exceeds maxSize,
+// and the response larger than maxEntrySize is not kept.
+type PackCache struct {
+	dir          string
+	maxSize      int64
+	maxEntrySize int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type packCacheEntry struct {
+	key      string
+	repoPath string
+	size     int64
+}
+
+// NewPackCache returns the cache in dir. The entries that dir has already are removed,
+// because the repositories of them are not known.
+func NewPackCache(dir string, maxSize, maxEntrySize int64) (*PackCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(path.Join(dir, "*"+packCacheFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			return nil, err
+		}
+	}
+	if maxEntrySize <= 0 || maxEntrySize > maxSize {
+		maxEntrySize = maxSize
+	}
+	return &PackCache{
+		dir:          dir,
+		maxSize:      maxSize,
+		maxEntrySize: maxEntrySize,
+		lru:          list.New(),
+		entries:      map[string]*list.Element{},
+	}, nil
+}
+
+func (c *PackCache) filePath(key string) string {
+	return path.Join(c.dir, key+packCacheFileSuffix)
+}
+
+// get opens the response of key. The file can be read even if the entry is evicted meanwhile.
+func (c *PackCache) get(key string) (*os.File, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	f, err := os.Open(c.filePath(key))
+	if err != nil {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return f, true
+}
+
+// newEntry returns the writer of the response of key. The response is kept when it is committed.
+func (c *PackCache) newEntry(repoPath, key string) *packCacheEntryWriter {
+	f, err := ioutil.TempFile(c.dir, "tmp-")
+	return &packCacheEntryWriter{cache: c, repoPath: repoPath, key: key, file: f, err: err}
+}
+
+func (c *PackCache) put(e *packCacheEntry, tmpFilePath string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[e.key]; ok {
+		// The same response was kept by another request.
+		return os.Remove(tmpFilePath)
+	}
+	if err := os.Rename(tmpFilePath, c.filePath(e.key)); err != nil {
+		os.Remove(tmpFilePath)
+		return err
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += e.size
+
+	for c.size > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+	return nil
+}
+
+// Invalidate removes the responses of the repository. It is called after receive-pack.
+func (c *PackCache) Invalidate(repoPath string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*packCacheEntry).repoPath == repoPath {
+			c.remove(elem)
+		}
+		elem = next
+	}
+}
+
+// Size returns the total size of the responses.
+func (c *PackCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
+
+func (c *PackCache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*packCacheEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size
+	os.Remove(c.filePath(e.key))
+}
+
+// packCacheEntryWriter never fails to write, so that the response to the client goes on
+// even if the response can not be kept.
+type packCacheEntryWriter struct {
+	cache    *PackCache
+	repoPath string
+	key      string
+	file     *os.File
+	size     int64
+	err      error
+}
+
+func (w *packCacheEntryWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return len(p), nil
+	}
+	if w.size+int64(len(p)) > w.cache.maxEntrySize {
+		w.err = fmt.Errorf("the response exceeds %d bytes", w.cache.maxEntrySize)
+		return len(p), nil
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	w.err = err
+	return len(p), nil
+}
+
+func (w *packCacheEntryWriter) commit() error {
+	if w.err != nil {
+		w.discard()
+		return w.err
+	}
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	return w.cache.put(&packCacheEntry{key: w.key, repoPath: w.repoPath, size: w.size}, w.file.Name())
+}
+
+func (w *packCacheEntryWriter) discard() {
+	if w.file != nil {
+		w.file.Close()
+		os.Remove(w.file.Name())
+	}
+}
+
+// packCacheKey returns the hash of the repository, its refs and the request.
+// The refs are the advertisement of the protocol v0, so ctx.Env() must not have GIT_PROTOCOL yet.
+// The advertisement runs git, so it waits for Admit. The request has been refused if errNotAdmitted is returned.
+func (ghx *GitHTTPXfer) packCacheKey(ctx Context, request []byte) (string, error) {
+	release, ok := ghx.Admit(ctx, uploadPack)
+	if !ok {
+		return "", errNotAdmitted
+	}
+	defer release()
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", ctx.RepoPath(), ghx.gitProtocol(ctx, uploadPack), strings.Join(ghx.uploadPackConfig(ctx).gitConfig(), " "))
+	if err := ghx.Backend.AdvertiseRefs(ctx, uploadPack, h); err != nil {
+		return "", err
+	}
+	h.Write(request)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// serviceRPCUploadWithPackCache serves the clone from the cache, or runs upload-pack and keeps the response.
+// The request over limit bytes is neither cached nor shared.
+func (ghx *GitHTTPXfer) serviceRPCUploadWithPackCache(ctx Context, upr *UploadPackRequest, body io.Reader, limit int64) {
+	cache := ghx.options.packCache
+
+	// The body of the clone ends with the negotiation, so the rest is small if any.
+	request, complete, err := readUploadPackRequest(upr, body, limit)
+	var tooLarge *BodyTooLargeError
+	if errors.As(err, &tooLarge) {
+		ghx.renderBodyTooLarge(ctx, uploadPack, tooLarge)
+		return
+	}
+	if err != nil {
+		ctx.Logger().Error("failed to read the request body", "error", err)
+		RenderInternalServerError(ctx.Response().Writer)
+		return
+	}
+	if !complete {
+		ctx.Logger().Debug("the request is too large to cache", "limit", limit)
+		ghx.serviceRPC(ctx, uploadPack, io.MultiReader(bytes.NewReader(request), body), nil)
+		return
+	}
+
+	key, err := ghx.packCacheKey(ctx, request)
+	if err == errNotAdmitted {
+		return
+	}
+	if err != nil {
+		ctx.Logger().Error("failed to make the key of the pack cache", "error", err)
+		ghx.runUploadPack(ctx, request, nil)
+		return
+	}
+
+	if f, ok := cache.get(key); ok {
+		defer f.Close()
+		start := time.Now()
+		w := &rpcResponseWriter{res: ctx.Response(), rpc: uploadPack}
+		n, err := io.Copy(w, f)
+		if err != nil {
+			ctx.Logger().Error("failed to write the pack cache to response", "error", err)
+		}
+		w.writeHeader()
+		ctx.SetResult(&Result{Service: uploadPack, ExitCode: ExitCode(err), BytesIn: int64(len(request)), BytesOut: n, Duration: time.Since(start), Cached: true, Err: err})
+		ghx.Event.notify(AfterUploadPack, ctx)
+		return
+	}
+
+	entry := cache.newEntry(ctx.RepoPath(), key)
+	err = ghx.runUploadPack(ctx, request, func(w io.Writer, stdout io.Reader) error {
+		_, err := io.Copy(io.MultiWriter(w, entry), stdout)
+		return err
+	})
+	if err != nil {
+		entry.discard()
+		return
+	}
+	entry.commit()
+}
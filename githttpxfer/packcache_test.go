@@ -0,0 +1,134 @@
+package githttpxfer
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func putPackCache(cache *PackCache, repoPath, key, content string) {
+	entry := cache.newEntry(repoPath, key)
+	entry.Write([]byte(content))
+	entry.commit()
+}
+
+func getPackCache(cache *PackCache, key string) (string, bool) {
+	f, ok := cache.get(key)
+	if !ok {
+		return "", false
+	}
+	defer f.Close()
+	content, _ := ioutil.ReadAll(f)
+	return string(content), true
+}
+
+func Test_PackCache_should_evict_least_recently_used(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "githttpxfer")
+	if err != nil {
+		t.Errorf("Create Temp Dir error: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewPackCache(dir, 10, 0)
+	if err != nil {
+		t.Errorf("NewPackCache error: %s", err.Error())
+		return
+	}
+
+	putPackCache(cache, "/foo.git", "a", "aaaa")
+	putPackCache(cache, "/foo.git", "b", "bbbb")
+	if content, ok := getPackCache(cache, "a"); !ok || content != "aaaa" {
+		t.Errorf("a is not aaaa . result: %s", content)
+	}
+
+	putPackCache(cache, "/foo.git", "c", "cccc")
+	if _, ok := getPackCache(cache, "b"); ok {
+		t.Error("b is not evicted.")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := getPackCache(cache, key); !ok {
+			t.Errorf("%s is evicted.", key)
+		}
+	}
+	if cache.Size() != 8 {
+		t.Errorf("size is not 8 . result: %d", cache.Size())
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 2 {
+		t.Errorf("the number of files is not 2 . result: %d", len(files))
+	}
+}
+
+func Test_PackCache_should_not_keep_large_entry(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "githttpxfer")
+	if err != nil {
+		t.Errorf("Create Temp Dir error: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewPackCache(dir, 100, 4)
+	if err != nil {
+		t.Errorf("NewPackCache error: %s", err.Error())
+		return
+	}
+
+	entry := cache.newEntry("/foo.git", "a")
+	if n, err := entry.Write([]byte(strings.Repeat("a", 5))); n != 5 || err != nil {
+		t.Errorf("write fails. n: %d, error: %v", n, err)
+	}
+	if err := entry.commit(); err == nil {
+		t.Error("large entry is committed.")
+	}
+	if _, ok := getPackCache(cache, "a"); ok {
+		t.Error("large entry is kept.")
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("the number of files is not 0 . result: %d", len(files))
+	}
+}
+
+func Test_PackCache_should_invalidate_repository(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "githttpxfer")
+	if err != nil {
+		t.Errorf("Create Temp Dir error: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	cache, err := NewPackCache(dir, 100, 0)
+	if err != nil {
+		t.Errorf("NewPackCache error: %s", err.Error())
+		return
+	}
+
+	putPackCache(cache, "/foo.git", "a", "aaaa")
+	putPackCache(cache, "/bar.git", "b", "bbbb")
+	cache.Invalidate("/foo.git")
+
+	if _, ok := getPackCache(cache, "a"); ok {
+		t.Error("the entry of foo.git is not invalidated.")
+	}
+	if _, ok := getPackCache(cache, "b"); !ok {
+		t.Error("the entry of bar.git is invalidated.")
+	}
+
+	// The entries of the previous run are removed.
+	cache, err = NewPackCache(dir, 100, 0)
+	if err != nil {
+		t.Errorf("NewPackCache error: %s", err.Error())
+		return
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("the number of files is not 0 . result: %d", len(files))
+	}
+}
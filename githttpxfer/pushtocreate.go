@@ -0,0 +1,67 @@
+package githttpxfer
+
+import (
+	"net/http"
+)
+
+// PushToCreate creates the repository that does not exist when it is pushed for the first time.
+type PushToCreate struct {
+	// Authorize decides whether the request may create the repository at Context.RepoPath.
+	// The repository is created if it returns nil. RejectionError chooses the status of the refusal.
+	// No repository is created if Authorize is nil.
+	Authorize func(ctx Context) error
+	// TemplateDir is the template directory of the new repository. The default template of git is used if it is empty.
+	TemplateDir string
+	// DefaultBranch is the branch that HEAD of the new repository points to. The default of git is used if it is empty.
+	DefaultBranch string
+}
+
+// RepositoryCreator is the Backend that can create the repositories for PushToCreate.
+type RepositoryCreator interface {
+	// CreateRepository creates the bare repository at Context.RepoPath.
+	CreateRepository(ctx Context, templateDir, defaultBranch string) error
+}
+
+// isFirstPush reports whether the request is the ref advertisement that starts a push.
+func (ghx *GitHTTPXfer) isFirstPush(ctx Context) bool {
+	req := ctx.Request()
+	return req.Method == http.MethodGet &&
+		ctx.FilePath() == "info/refs" &&
+		getServiceType(req) == receivePack &&
+		ghx.Git.HasAccess(req, receivePack, false)
+}
+
+// createRepository creates the repository of the first push.
+// ok is false if the request has been stopped and rendered.
+func (ghx *GitHTTPXfer) createRepository(ctx Context) (created bool, ok bool) {
+	config := ghx.options.pushToCreate
+	creator, can := ghx.Backend.(RepositoryCreator)
+	if !can || config.Authorize == nil {
+		return false, true
+	}
+
+	err := config.Authorize(ctx)
+	if message, rejected := ctx.Rejected(); rejected && err == nil {
+		err = &RejectionError{Message: message}
+	}
+	if err != nil {
+		ghx.renderStop(ctx, err, "", false, "failed to authorize the creation of the repository")
+		return false, false
+	}
+
+	// The concurrent pushes to the same new repository create it once.
+	ghx.createMu.Lock()
+	defer ghx.createMu.Unlock()
+	if ghx.Backend.Exists(ctx.RepoPath()) {
+		return true, true
+	}
+	if err := creator.CreateRepository(ctx, config.TemplateDir, config.DefaultBranch); err != nil {
+		ctx.Logger().Error("failed to create the repository", "error", err)
+		ghx.ReportError(ctx, ErrorKindService, err)
+		RenderInternalServerError(ctx.Response().Writer)
+		return false, false
+	}
+	ctx.Logger().Info("the repository is created")
+	ghx.Event.notify(RepositoryCreated, ctx)
+	return true, true
+}
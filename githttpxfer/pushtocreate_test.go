@@ -0,0 +1,125 @@
+package githttpxfer
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_ServeHTTP_should_create_the_repository_on_the_first_push(t *testing.T) {
+
+	gitRootPath, err := ioutil.TempDir("", "githttpxfer")
+	if err != nil {
+		t.Errorf("Create Temp Dir error: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(gitRootPath)
+
+	templateDir := filepath.Join(gitRootPath, ".template")
+	if err := os.MkdirAll(templateDir, 0755); err != nil {
+		t.Errorf("Mkdir error: %s", err.Error())
+		return
+	}
+	if err := ioutil.WriteFile(filepath.Join(templateDir, "description"), []byte("created by the push\n"), 0644); err != nil {
+		t.Errorf("WriteFile error: %s", err.Error())
+		return
+	}
+
+	var created []string
+	ghx, err := New(gitRootPath, "/usr/bin/git", WithPushToCreate(PushToCreate{
+		Authorize: func(ctx Context) error {
+			if !strings.HasPrefix(ctx.RepoPath(), "/team/") {
+				return &RejectionError{Message: "you can not create " + ctx.RepoPath()}
+			}
+			return nil
+		},
+		TemplateDir:   templateDir,
+		DefaultBranch: "main",
+	}))
+	if err != nil {
+		t.Errorf("An instance could not be created. %s", err.Error())
+		return
+	}
+	ghx.Event.On(RepositoryCreated, func(ctx Context) { created = append(created, ctx.RepoPath()) })
+
+	tests := []struct {
+		description string
+		method      string
+		url         string
+		expected    int
+		repoPath    string
+		created     bool
+	}{
+		{description: "it should create the repository on the advertisement of receive-pack", method: http.MethodGet, url: "/team/new.git/info/refs?service=git-receive-pack", expected: http.StatusOK, repoPath: "/team/new.git", created: true},
+		{description: "it should advertise the repository that has been created", method: http.MethodGet, url: "/team/new.git/info/refs?service=git-receive-pack", expected: http.StatusOK, repoPath: "/team/new.git", created: true},
+		{description: "it should not create the repository that is not authorized", method: http.MethodGet, url: "/other/new.git/info/refs?service=git-receive-pack", expected: http.StatusForbidden, repoPath: "/other/new.git"},
+		{description: "it should not create the repository on the advertisement of upload-pack", method: http.MethodGet, url: "/team/fetch.git/info/refs?service=git-upload-pack", expected: http.StatusNotFound, repoPath: "/team/fetch.git"},
+		{description: "it should not create the repository on receive-pack", method: http.MethodPost, url: "/team/post.git/git-receive-pack", expected: http.StatusNotFound, repoPath: "/team/post.git"},
+		{description: "it should not create the repository on the dumb protocol", method: http.MethodGet, url: "/team/dumb.git/info/refs", expected: http.StatusNotFound, repoPath: "/team/dumb.git"},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(tc.method, "http://example.com"+tc.url, strings.NewReader("0000"))
+		req.Header.Set("Content-Type", "application/x-git-receive-pack-request")
+		ghx.ServeHTTP(rec, req)
+		if rec.Code != tc.expected {
+			t.Errorf("StatusCode is not %d . result: %d", tc.expected, rec.Code)
+		}
+		if exists := ghx.Git.Exists(tc.repoPath); exists != tc.created {
+			t.Errorf("the repository is not created as %t . result: %t", tc.created, exists)
+		}
+	}
+
+	if len(created) != 1 || created[0] != "/team/new.git" {
+		t.Errorf("RepositoryCreated is not emitted once for /team/new.git . result: %v", created)
+	}
+	absRepoPath, _ := ghx.Git.GetAbsolutePath("/team/new.git")
+	if head, _ := ioutil.ReadFile(filepath.Join(absRepoPath, "HEAD")); string(head) != "ref: refs/heads/main\n" {
+		t.Errorf("HEAD is not the default branch. result: %s", head)
+	}
+	if description, _ := ioutil.ReadFile(filepath.Join(absRepoPath, "description")); string(description) != "created by the push\n" {
+		t.Errorf("the template is not used. result: %s", description)
+	}
+}
+
+func Test_ServeHTTP_should_not_create_the_repository_without_the_authorization(t *testing.T) {
+
+	gitRootPath, err := ioutil.TempDir("", "githttpxfer")
+	if err != nil {
+		t.Errorf("Create Temp Dir error: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(gitRootPath)
+
+	tests := []struct {
+		description string
+		opts        []Option
+	}{
+		{description: "it should not create the repository without the option"},
+		{description: "it should not create the repository without Authorize", opts: []Option{WithPushToCreate(PushToCreate{})}},
+		{description: "it should not create the repository with receive-pack disabled", opts: []Option{DisableReceivePack(), WithPushToCreate(PushToCreate{Authorize: func(ctx Context) error { return nil }})}},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		ghx, err := New(gitRootPath, "/usr/bin/git", tc.opts...)
+		if err != nil {
+			t.Errorf("An instance could not be created. %s", err.Error())
+			return
+		}
+		rec := httptest.NewRecorder()
+		ghx.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com/new.git/info/refs?service=git-receive-pack", nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("StatusCode is not %d . result: %d", http.StatusNotFound, rec.Code)
+		}
+		if ghx.Git.Exists("/new.git") {
+			t.Error("the repository is created.")
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package githttpxfer
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The classes of the requests that have their own budgets.
+const (
+	RateLimitFetch = "fetch"
+	RateLimitPush  = "push"
+	RateLimitDumb  = "dumb"
+)
+
+// RateLimit is the token bucket that refills Rate tokens per second up to Burst.
+// Each request takes a token. Zero Rate means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimits holds the budget of each class of the requests for each identity.
+type RateLimits struct {
+	Fetch RateLimit
+	Push  RateLimit
+	Dumb  RateLimit
+
+	// Key returns the identity that the budget belongs to. It is RateLimitByRemoteIP if nil.
+	Key func(ctx Context) string
+	// Classify returns the class of the request, or "" for no limit. It is ClassifyRequest if nil.
+	Classify func(ctx Context) string
+}
+
+func (l RateLimits) limit(class string) RateLimit {
+	switch class {
+	case RateLimitFetch:
+		return l.Fetch
+	case RateLimitPush:
+		return l.Push
+	case RateLimitDumb:
+		return l.Dumb
+	}
+	return RateLimit{}
+}
+
+// RateLimitByRemoteIP is the identity of the client address.
+func RateLimitByRemoteIP(ctx Context) string {
+	addr := ctx.Request().RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// RateLimitByUser is the identity of the user of the basic authentication, or of the client address for the anonymous user.
+func RateLimitByUser(ctx Context) string {
+	if username, _, ok := ctx.Request().BasicAuth(); ok {
+		return "user:" + username
+	}
+	return "ip:" + RateLimitByRemoteIP(ctx)
+}
+
+// RateLimitByRepo is the identity of the repository, which all the clients share.
+func RateLimitByRepo(ctx Context) string {
+	return ctx.RepoPath()
+}
+
+// ClassifyRequest classifies the requests of the smart protocol as fetch or push, and the static files of the repository as dumb.
+// The requests of the addon handlers are not limited.
+func ClassifyRequest(ctx Context) string {
+	req := ctx.Request()
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/git-upload-pack"):
+		return RateLimitFetch
+	case strings.HasSuffix(req.URL.Path, "/git-receive-pack"):
+		return RateLimitPush
+	case strings.HasSuffix(req.URL.Path, "/info/refs"):
+		switch getServiceType(req) {
+		case uploadPack:
+			return RateLimitFetch
+		case receivePack:
+			return RateLimitPush
+		}
+		return RateLimitDumb
+	}
+	for _, pattern := range dumbPatterns {
+		if pattern(req.URL) != nil {
+			return RateLimitDumb
+		}
+	}
+	return ""
+}
+
+// dumbPatterns are the static files of the repository.
+var dumbPatterns = []Pattern{getHead, getInfoFile, getLooseObject, getPackFile, getIdxFile, getBundleFile}
+
+// rateLimitSweepInterval is how often the full buckets are dropped.
+const rateLimitSweepInterval = time.Minute
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	if limits.Key == nil {
+		limits.Key = RateLimitByRemoteIP
+	}
+	if limits.Classify == nil {
+		limits.Classify = ClassifyRequest
+	}
+	return &rateLimiter{limits: limits, buckets: map[string]*tokenBucket{}, now: time.Now}
+}
+
+type rateLimiter struct {
+	limits RateLimits
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type tokenBucket struct {
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+}
+
+// take takes a token of the identity, or returns the time until the next token.
+func (l *rateLimiter) take(class, key string) (RateLimit, time.Duration, bool) {
+	limit := l.limits.limit(class)
+	if limit.Rate <= 0 {
+		return limit, 0, true
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	bucketKey := class + "\x00" + key
+	b, ok := l.buckets[bucketKey]
+	if !ok {
+		b = &tokenBucket{limit: limit, tokens: float64(limit.Burst), last: now}
+		l.buckets[bucketKey] = b
+	}
+	b.refill(now)
+	if b.tokens < 1 {
+		return limit, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return limit, 0, true
+}
+
+// sweep drops the buckets that have been refilled, which are the same as the new ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.refill(now); b.tokens >= float64(b.limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// allow reports whether the request is within the budget, and renders "429 Too Many Requests" if not.
+func (l *rateLimiter) allow(ctx Context) bool {
+	class := l.limits.Classify(ctx)
+	if class == "" {
+		return true
+	}
+	limit, wait, ok := l.take(class, l.limits.Key(ctx))
+	if ok {
+		return true
+	}
+	ctx.Logger().Warn("the request is rate limited", "class", class, "retry_after", wait)
+	header := ctx.Response().Header()
+	header.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	header.Set("RateLimit-Remaining", "0")
+	header.Set("RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+	RenderRetryAfter(ctx.Response().Writer, http.StatusTooManyRequests, wait)
+	return false
+}
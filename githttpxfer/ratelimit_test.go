@@ -0,0 +1,110 @@
+package githttpxfer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_RateLimiter_should_take_the_tokens(t *testing.T) {
+
+	now := time.Unix(0, 0)
+	l := newRateLimiter(RateLimits{Fetch: RateLimit{Rate: 1, Burst: 2}, Push: RateLimit{Rate: 0.5}})
+	l.now = func() time.Time { return now }
+
+	tests := []struct {
+		description  string
+		elapsed      time.Duration
+		class        string
+		key          string
+		expected     bool
+		expectedWait time.Duration
+	}{
+		{description: "it should take the burst", class: RateLimitFetch, key: "a", expected: true},
+		{description: "it should take the burst", class: RateLimitFetch, key: "a", expected: true},
+		{description: "it should wait for the next token", class: RateLimitFetch, key: "a", expected: false, expectedWait: time.Second},
+		{description: "it should have the budget for each key", class: RateLimitFetch, key: "b", expected: true},
+		{description: "it should have the budget for each class", class: RateLimitPush, key: "a", expected: true},
+		{description: "it should not limit the class without the rate", class: RateLimitDumb, key: "a", expected: true},
+		{description: "it should wait for the rest of the token", elapsed: 500 * time.Millisecond, class: RateLimitFetch, key: "a", expected: false, expectedWait: 500 * time.Millisecond},
+		{description: "it should refill the token", elapsed: 500 * time.Millisecond, class: RateLimitFetch, key: "a", expected: true},
+		{description: "it should refill by the rate of the class", class: RateLimitPush, key: "a", expected: false, expectedWait: time.Second},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		now = now.Add(tc.elapsed)
+		_, wait, ok := l.take(tc.class, tc.key)
+		if ok != tc.expected || wait != tc.expectedWait {
+			t.Errorf("take is not %t and %s . result: %t and %s", tc.expected, tc.expectedWait, ok, wait)
+		}
+	}
+
+	now = now.Add(time.Hour)
+	l.take(RateLimitFetch, "a")
+	if len(l.buckets) != 1 {
+		t.Errorf("the full buckets are not dropped. result: %d", len(l.buckets))
+	}
+}
+
+func Test_ClassifyRequest(t *testing.T) {
+
+	tests := []struct {
+		description string
+		method      string
+		url         string
+		expected    string
+	}{
+		{description: "it should classify upload-pack as fetch", method: http.MethodPost, url: "/base/foo/git-upload-pack", expected: RateLimitFetch},
+		{description: "it should classify receive-pack as push", method: http.MethodPost, url: "/base/foo/git-receive-pack", expected: RateLimitPush},
+		{description: "it should classify the advertisement of upload-pack as fetch", method: http.MethodGet, url: "/base/foo/info/refs?service=git-upload-pack", expected: RateLimitFetch},
+		{description: "it should classify the advertisement of receive-pack as push", method: http.MethodGet, url: "/base/foo/info/refs?service=git-receive-pack", expected: RateLimitPush},
+		{description: "it should classify info/refs without service as dumb", method: http.MethodGet, url: "/base/foo/info/refs", expected: RateLimitDumb},
+		{description: "it should classify the loose object as dumb", method: http.MethodGet, url: "/base/foo/objects/3b/18e512dba79e4c8300dd08aeb37f8e728b8dad", expected: RateLimitDumb},
+		{description: "it should classify HEAD as dumb", method: http.MethodGet, url: "/base/foo/HEAD", expected: RateLimitDumb},
+		{description: "it should not classify the addon handler", method: http.MethodGet, url: "/base/foo/info/lfs/objects/0000000000000000000000000000000000000000000000000000000000000000", expected: ""},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		ctx := NewContext(httptest.NewRecorder(), httptest.NewRequest(tc.method, "http://example.com"+tc.url, nil), "/base/foo", "")
+		if class := ClassifyRequest(ctx); class != tc.expected {
+			t.Errorf("class is not %s . result: %s", tc.expected, class)
+		}
+	}
+}
+
+func Test_ServeHTTP_should_render_too_many_requests(t *testing.T) {
+
+	ghx, err := New("/data/git", "/usr/bin/git", WithRateLimits(RateLimits{Fetch: RateLimit{Rate: 0.1, Burst: 1}}))
+	if err != nil {
+		t.Errorf("An instance could not be created. %s", err.Error())
+		return
+	}
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/test.git/info/refs?service=git-upload-pack", nil)
+		req.RemoteAddr = remoteAddr
+		ghx.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := request("192.0.2.1:1234"); rec.Code == http.StatusTooManyRequests {
+		t.Error("the first request is limited.")
+		return
+	}
+	if rec := request("192.0.2.2:1234"); rec.Code == http.StatusTooManyRequests {
+		t.Error("the request of another client is limited.")
+		return
+	}
+	rec := request("192.0.2.1:5678")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("StatusCode is not %d . result: %d", http.StatusTooManyRequests, rec.Code)
+		return
+	}
+	if rec.Header().Get("Retry-After") != "10" || rec.Header().Get("RateLimit-Limit") != "1" || rec.Header().Get("RateLimit-Reset") != "10" {
+		t.Errorf("the retry headers are not valid. result: %v", rec.Header())
+	}
+}
@@ -0,0 +1,353 @@
+package githttpxfer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/nulab/go-git-http-xfer/pktline"
+)
+
+// RefUpdateCommand is one ref update of a push.
+type RefUpdateCommand struct {
+	OldID   string
+	NewID   string
+	RefName string
+
+	rejected bool
+	reason   string
+}
+
+// Reject refuses only this ref update. The other ref updates of the push go on.
+func (c *RefUpdateCommand) Reject(reason string) {
+	c.rejected = true
+	c.reason = reason
+}
+
+func (c *RefUpdateCommand) Rejected() (reason string, rejected bool) {
+	return c.reason, c.rejected
+}
+
+func (c *RefUpdateCommand) IsCreate() bool {
+	return isZeroID(c.OldID)
+}
+
+func (c *RefUpdateCommand) IsDelete() bool {
+	return isZeroID(c.NewID)
+}
+
+func isZeroID(id string) bool {
+	return strings.Trim(id, "0") == ""
+}
+
+// ReceivePackRequest is the front of the receive-pack request that precedes the packfile.
+type ReceivePackRequest struct {
+	Shallows     []string
+	Commands     []*RefUpdateCommand
+	Capabilities []string
+	PushOptions  []string
+
+	pushCert bool
+	consumed []byte
+}
+
+func (r *ReceivePackRequest) HasCapability(name string) bool {
+	return hasCapability(r.Capabilities, name)
+}
+
+func (r *ReceivePackRequest) usesSideband() bool {
+	return r.HasCapability("side-band-64k") || r.HasCapability("side-band")
+}
+
+func (r *ReceivePackRequest) usesReportStatus() bool {
+	return r.HasCapability("report-status") || r.HasCapability("report-status-v2")
+}
+
+func (r *ReceivePackRequest) rejectedCommands() []*RefUpdateCommand {
+	rejected := []*RefUpdateCommand{}
+	for _, c := range r.Commands {
+		if _, ok := c.Rejected(); ok {
+			rejected = append(rejected, c)
+		}
+	}
+	return rejected
+}
+
+// hasCapability matches "name" and "name=value".
+func hasCapability(capabilities []string, name string) bool {
+	for _, c := range capabilities {
+		if c == name || strings.HasPrefix(c, name+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseReceivePackRequest reads the shallow lines, the commands and the push options.
+// The packfile is left in body. The commands over limit bytes fail with BufferTooLargeError.
+func parseReceivePackRequest(body io.Reader, limit int64) (*ReceivePackRequest, error) {
+	consumed := newParseBuffer(limit)
+	r := pktline.NewReader(io.TeeReader(body, consumed))
+	req := &ReceivePackRequest{}
+
+	first := true
+	inPushCert := false
+	for {
+		t, line, err := r.ReadLine()
+		if err == io.EOF && first {
+			// The client sent nothing to update.
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if t == pktline.Flush {
+			break
+		}
+		if t != pktline.Data {
+			return nil, fmt.Errorf("unexpected %s packet in commands", t)
+		}
+
+		if first {
+			if i := strings.IndexByte(line, 0); i >= 0 {
+				req.Capabilities = strings.Fields(line[i+1:])
+				line = line[:i]
+			}
+		}
+
+		switch {
+		case strings.HasPrefix(line, "shallow "):
+			req.Shallows = append(req.Shallows, strings.TrimPrefix(line, "shallow "))
+			continue
+		case line == "push-cert":
+			req.pushCert = true
+			inPushCert = true
+		case line == "push-cert-end":
+			inPushCert = false
+		case inPushCert:
+			// The certificate has the commands after its header.
+			if command, ok := parseRefUpdateCommand(line); ok {
+				req.Commands = append(req.Commands, command)
+			}
+		default:
+			command, ok := parseRefUpdateCommand(line)
+			if !ok {
+				return nil, fmt.Errorf("invalid command: %q", line)
+			}
+			req.Commands = append(req.Commands, command)
+		}
+		first = false
+	}
+
+	if len(req.Commands) > 0 && req.HasCapability("push-options") {
+		for {
+			t, line, err := r.ReadLine()
+			if err != nil {
+				return nil, err
+			}
+			if t == pktline.Flush {
+				break
+			}
+			req.PushOptions = append(req.PushOptions, line)
+		}
+	}
+
+	req.consumed = consumed.Bytes()
+	return req, nil
+}
+
+func parseRefUpdateCommand(line string) (*RefUpdateCommand, bool) {
+	fields := strings.SplitN(line, " ", 3)
+	if len(fields) != 3 || !isHexID(fields[0]) || !isHexID(fields[1]) || fields[2] == "" {
+		return nil, false
+	}
+	return &RefUpdateCommand{OldID: fields[0], NewID: fields[1], RefName: fields[2]}, true
+}
+
+func isHexID(id string) bool {
+	if len(id) != 40 && len(id) != 64 {
+		return false
+	}
+	for _, c := range id {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// encode returns the front of the request to pass to git.
+// The consumed bytes are replayed as is unless some commands are rejected.
+func (r *ReceivePackRequest) encode() []byte {
+	rejected := r.rejectedCommands()
+	if len(rejected) == 0 {
+		return r.consumed
+	}
+
+	buf := &bytes.Buffer{}
+	w := pktline.NewWriter(buf)
+	for _, s := range r.Shallows {
+		w.WriteLine("shallow " + s)
+	}
+	first := true
+	for _, c := range r.Commands {
+		if _, ok := c.Rejected(); ok {
+			continue
+		}
+		line := c.OldID + " " + c.NewID + " " + c.RefName
+		if first {
+			line += "\x00" + strings.Join(r.Capabilities, " ")
+			first = false
+		}
+		w.WriteLine(line)
+	}
+	w.WriteFlush()
+	if r.HasCapability("push-options") {
+		for _, o := range r.PushOptions {
+			w.WriteLine(o)
+		}
+		w.WriteFlush()
+	}
+	return buf.Bytes()
+}
+
+// rejectAtomically rejects all the commands of the atomic push once any of them is rejected,
+// since the atomic push must update all the refs or none of them.
+func (r *ReceivePackRequest) rejectAtomically() {
+	if !r.HasCapability("atomic") || len(r.rejectedCommands()) == 0 {
+		return
+	}
+	for _, c := range r.Commands {
+		if _, ok := c.Rejected(); !ok {
+			c.Reject("atomic push failure")
+		}
+	}
+}
+
+// canRejectCommands reports whether the ref updates can be rejected one by one.
+// Without the report-status, the client could not know which ref updates are rejected,
+// and the signed push certificate can not be rewritten.
+func (r *ReceivePackRequest) canRejectCommands() bool {
+	return r.usesReportStatus() && !r.pushCert
+}
+
+func (r *ReceivePackRequest) sidebandMaxDataSize() int {
+	if r.HasCapability("side-band-64k") {
+		return pktline.Sideband64kMaxDataSize
+	}
+	return pktline.SidebandMaxDataSize
+}
+
+// writeReport writes the report-status of the rejected commands when git is not run at all.
+func (r *ReceivePackRequest) writeReport(w io.Writer) error {
+	report := &bytes.Buffer{}
+	rw := pktline.NewWriter(report)
+	rw.WriteLine("unpack ok")
+	for _, c := range r.rejectedCommands() {
+		reason, _ := c.Rejected()
+		rw.WriteLine("ng " + c.RefName + " " + reason)
+	}
+	rw.WriteFlush()
+
+	if !r.usesSideband() {
+		_, err := w.Write(report.Bytes())
+		return err
+	}
+	pw := pktline.NewWriter(w)
+	if _, err := pktline.NewSidebandWriter(pw, pktline.BandData, r.sidebandMaxDataSize()).Write(report.Bytes()); err != nil {
+		return err
+	}
+	return pw.WriteFlush()
+}
+
+// copyReport copies the output of git to w, adding the "ng" lines of the rejected commands to the report-status.
+func (r *ReceivePackRequest) copyReport(w io.Writer, stdout io.Reader) error {
+	rejected := r.rejectedCommands()
+	if len(rejected) == 0 || !r.usesReportStatus() {
+		_, err := io.Copy(w, stdout)
+		return err
+	}
+
+	ngLines := &bytes.Buffer{}
+	nw := pktline.NewWriter(ngLines)
+	for _, c := range rejected {
+		reason, _ := c.Rejected()
+		nw.WriteLine("ng " + c.RefName + " " + reason)
+	}
+
+	pr := pktline.NewReader(stdout)
+	pw := pktline.NewWriter(w)
+
+	if !r.usesSideband() {
+		if err := copyUntilFlush(pw, pr); err != nil {
+			return err
+		}
+		if _, err := w.Write(ngLines.Bytes()); err != nil {
+			return err
+		}
+		if err := pw.WriteFlush(); err != nil {
+			return err
+		}
+		_, err := io.Copy(w, stdout)
+		return err
+	}
+
+	// The report-status is the data band. Progress and errors are forwarded at once.
+	report := &bytes.Buffer{}
+	for {
+		t, payload, err := pr.ReadPacket()
+		if err != nil {
+			return err
+		}
+		if t == pktline.Flush {
+			break
+		}
+		if len(payload) > 0 && pktline.Band(payload[0]) == pktline.BandData {
+			report.Write(payload[1:])
+			continue
+		}
+		if err := pw.WritePacket(payload); err != nil {
+			return err
+		}
+	}
+
+	injected := &bytes.Buffer{}
+	if err := copyUntilFlush(pktline.NewWriter(injected), pktline.NewReader(report)); err != nil {
+		return err
+	}
+	injected.Write(ngLines.Bytes())
+	pktline.NewWriter(injected).WriteFlush()
+
+	if _, err := pktline.NewSidebandWriter(pw, pktline.BandData, r.sidebandMaxDataSize()).Write(injected.Bytes()); err != nil {
+		return err
+	}
+	if err := pw.WriteFlush(); err != nil {
+		return err
+	}
+	_, err := io.Copy(w, stdout)
+	return err
+}
+
+// copyUntilFlush copies the packets until the flush packet. The flush packet is not copied.
+func copyUntilFlush(w *pktline.Writer, r *pktline.Reader) error {
+	for {
+		t, payload, err := r.ReadPacket()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case pktline.Flush:
+			return nil
+		case pktline.Data:
+			err = w.WritePacket(payload)
+		case pktline.Delim:
+			err = w.WriteDelim()
+		case pktline.ResponseEnd:
+			err = w.WriteResponseEnd()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
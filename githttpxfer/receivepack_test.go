@@ -0,0 +1,270 @@
+package githttpxfer
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/nulab/go-git-http-xfer/pktline"
+)
+
+const (
+	zeroID = "0000000000000000000000000000000000000000"
+	oldID  = "1111111111111111111111111111111111111111"
+	newID  = "2222222222222222222222222222222222222222"
+)
+
+func pktLine(s string) string {
+	return fmt.Sprintf("%04x%s", len(s)+4, s)
+}
+
+func Test_ParseReceivePackRequest_should_parse_commands(t *testing.T) {
+
+	body := pktLine("shallow "+oldID+"\n") +
+		pktLine(oldID+" "+newID+" refs/heads/master\x00report-status side-band-64k push-options agent=git/2.39.5\n") +
+		pktLine(zeroID+" "+newID+" refs/heads/feature\n") +
+		"0000" +
+		pktLine("ci.skip\n") +
+		"0000" +
+		"PACK"
+
+	r := strings.NewReader(body)
+	req, err := parseReceivePackRequest(r, 0)
+	if err != nil {
+		t.Errorf("error is %s", err.Error())
+		return
+	}
+
+	if len(req.Shallows) != 1 || req.Shallows[0] != oldID {
+		t.Errorf("shallows are not [%s] . result: %v", oldID, req.Shallows)
+	}
+
+	if len(req.Commands) != 2 {
+		t.Errorf("the number of commands is not 2 . result: %d", len(req.Commands))
+		return
+	}
+
+	master, feature := req.Commands[0], req.Commands[1]
+	if master.OldID != oldID || master.NewID != newID || master.RefName != "refs/heads/master" {
+		t.Errorf("command is not parsed. result: %+v", master)
+	}
+	if !feature.IsCreate() || feature.IsDelete() {
+		t.Errorf("command is not create. result: %+v", feature)
+	}
+
+	for _, c := range []string{"report-status", "side-band-64k", "push-options", "agent"} {
+		if !req.HasCapability(c) {
+			t.Errorf("capability %s is not found. result: %v", c, req.Capabilities)
+		}
+	}
+
+	if len(req.PushOptions) != 1 || req.PushOptions[0] != "ci.skip" {
+		t.Errorf("push options are not [ci.skip] . result: %v", req.PushOptions)
+	}
+
+	rest, _ := ioutil.ReadAll(r)
+	if string(rest) != "PACK" {
+		t.Errorf("the rest is not 'PACK' . result: %q", rest)
+	}
+
+	if string(req.encode()) != strings.TrimSuffix(body, "PACK") {
+		t.Errorf("encoded request is not the consumed bytes. result: %q", req.encode())
+	}
+}
+
+func Test_ParseReceivePackRequest_should_parse_push_cert(t *testing.T) {
+
+	body := pktLine("push-cert\x00report-status push-cert=1234\n") +
+		pktLine("certificate version 0.1\n") +
+		pktLine("pusher John Smith <js@example.com> 1500000000 +0900\n") +
+		pktLine("\n") +
+		pktLine(oldID+" "+newID+" refs/heads/master\n") +
+		pktLine("-----BEGIN PGP SIGNATURE-----\n") +
+		pktLine("-----END PGP SIGNATURE-----\n") +
+		pktLine("push-cert-end\n") +
+		"0000"
+
+	req, err := parseReceivePackRequest(strings.NewReader(body), 0)
+	if err != nil {
+		t.Errorf("error is %s", err.Error())
+		return
+	}
+
+	if len(req.Commands) != 1 || req.Commands[0].RefName != "refs/heads/master" {
+		t.Errorf("commands are not parsed. result: %v", req.Commands)
+	}
+
+	req.Commands[0].Reject("protected")
+	if req.canRejectCommands() {
+		t.Error("commands of push certificate can be rejected one by one.")
+	}
+}
+
+func Test_ParseReceivePackRequest_should_return_error(t *testing.T) {
+
+	tests := []struct {
+		description string
+		body        string
+	}{
+		{
+			description: "it should return error if command is invalid",
+			body:        pktLine("foo bar refs/heads/master\n") + "0000",
+		},
+		{
+			description: "it should return error if flush is missing",
+			body:        pktLine(oldID + " " + newID + " refs/heads/master\n"),
+		},
+		{
+			description: "it should return error if length is invalid",
+			body:        "zzzz",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		if _, err := parseReceivePackRequest(strings.NewReader(tc.body), 0); err == nil {
+			t.Error("error is nil.")
+		}
+	}
+}
+
+func Test_ReceivePackRequest_encode_should_remove_rejected_commands(t *testing.T) {
+
+	body := pktLine(oldID+" "+newID+" refs/heads/master\x00report-status\n") +
+		pktLine(zeroID+" "+newID+" refs/heads/feature\n") +
+		"0000"
+
+	req, err := parseReceivePackRequest(strings.NewReader(body), 0)
+	if err != nil {
+		t.Errorf("error is %s", err.Error())
+		return
+	}
+
+	req.Commands[0].Reject("protected")
+
+	expected := pktLine(zeroID+" "+newID+" refs/heads/feature\x00report-status\n") + "0000"
+	if encoded := string(req.encode()); encoded != expected {
+		t.Errorf("encoded request is not %q . result: %q", expected, encoded)
+	}
+}
+
+func Test_ReceivePackRequest_copyReport_should_add_rejected_commands(t *testing.T) {
+
+	tests := []struct {
+		description  string
+		capabilities string
+		stdout       func() string
+		expected     func() string
+	}{
+		{
+			description:  "it should add ng line to report-status",
+			capabilities: "report-status",
+			stdout: func() string {
+				return pktLine("unpack ok\n") + pktLine("ok refs/heads/feature\n") + "0000"
+			},
+			expected: func() string {
+				return pktLine("unpack ok\n") + pktLine("ok refs/heads/feature\n") + pktLine("ng refs/heads/master protected\n") + "0000"
+			},
+		},
+		{
+			description:  "it should add ng line to report-status in side-band",
+			capabilities: "report-status side-band-64k",
+			stdout: func() string {
+				buf := &bytes.Buffer{}
+				w := pktline.NewWriter(buf)
+				w.WriteBand(pktline.BandProgress, []byte("Resolving deltas\n"))
+				w.WriteBand(pktline.BandData, []byte(pktLine("unpack ok\n")+pktLine("ok refs/heads/feature\n")+"0000"))
+				w.WriteFlush()
+				return buf.String()
+			},
+			expected: func() string {
+				buf := &bytes.Buffer{}
+				w := pktline.NewWriter(buf)
+				w.WriteBand(pktline.BandProgress, []byte("Resolving deltas\n"))
+				w.WriteBand(pktline.BandData, []byte(pktLine("unpack ok\n")+pktLine("ok refs/heads/feature\n")+pktLine("ng refs/heads/master protected\n")+"0000"))
+				w.WriteFlush()
+				return buf.String()
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+
+		body := pktLine(oldID+" "+newID+" refs/heads/master\x00"+tc.capabilities+"\n") +
+			pktLine(zeroID+" "+newID+" refs/heads/feature\n") +
+			"0000"
+
+		req, err := parseReceivePackRequest(strings.NewReader(body), 0)
+		if err != nil {
+			t.Errorf("error is %s", err.Error())
+			return
+		}
+		req.Commands[0].Reject("protected")
+
+		buf := &bytes.Buffer{}
+		if err := req.copyReport(buf, strings.NewReader(tc.stdout())); err != nil {
+			t.Errorf("error is %s", err.Error())
+			return
+		}
+		if buf.String() != tc.expected() {
+			t.Errorf("report is not %q . result: %q", tc.expected(), buf.String())
+		}
+	}
+}
+
+func Test_ReceivePackRequest_writeReport_should_write_rejected_commands(t *testing.T) {
+
+	body := pktLine(oldID+" "+newID+" refs/heads/master\x00report-status\n") + "0000"
+
+	req, err := parseReceivePackRequest(strings.NewReader(body), 0)
+	if err != nil {
+		t.Errorf("error is %s", err.Error())
+		return
+	}
+	req.Commands[0].Reject("protected")
+
+	buf := &bytes.Buffer{}
+	if err := req.writeReport(buf); err != nil {
+		t.Errorf("error is %s", err.Error())
+		return
+	}
+
+	expected := pktLine("unpack ok\n") + pktLine("ng refs/heads/master protected\n") + "0000"
+	if buf.String() != expected {
+		t.Errorf("report is not %q . result: %q", expected, buf.String())
+	}
+}
+
+func Test_ReceivePackRequest_rejectAtomically_should_reject_all_commands(t *testing.T) {
+
+	tests := []struct {
+		description string
+		capability  string
+		expected    []string
+	}{
+		{description: "it should reject all commands of the atomic push", capability: "report-status atomic", expected: []string{"atomic push failure", "protected"}},
+		{description: "it should reject the commands one by one without atomic", capability: "report-status", expected: []string{"", "protected"}},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		body := pktLine(oldID+" "+newID+" refs/heads/master\x00"+tc.capability+"\n") +
+			pktLine(oldID+" "+newID+" refs/heads/release\n") +
+			"0000"
+		req, err := parseReceivePackRequest(strings.NewReader(body), 0)
+		if err != nil {
+			t.Errorf("error is %s", err.Error())
+			continue
+		}
+		req.Commands[1].Reject("protected")
+		req.rejectAtomically()
+		for i, c := range req.Commands {
+			if reason, _ := c.Rejected(); reason != tc.expected[i] {
+				t.Errorf("reason of %s is not %s . result: %s", c.RefName, tc.expected[i], reason)
+			}
+		}
+	}
+}
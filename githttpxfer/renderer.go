@@ -1,7 +1,12 @@
 package githttpxfer
 
 import (
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nulab/go-git-http-xfer/pktline"
 )
 
 func RenderMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
@@ -21,6 +26,12 @@ func RenderNotFound(w http.ResponseWriter) {
 	w.Write([]byte(http.StatusText(http.StatusNotFound)))
 }
 
+func RenderBadRequest(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write([]byte(http.StatusText(http.StatusBadRequest)))
+}
+
 func RenderNoAccess(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "text/plain")
 	w.WriteHeader(http.StatusForbidden)
@@ -32,3 +43,26 @@ func RenderInternalServerError(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusInternalServerError)
 	w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
 }
+
+// RenderRetryAfter renders the status with Retry-After in seconds, rounded up.
+func RenderRetryAfter(w http.ResponseWriter, status int, retryAfter time.Duration) {
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(status)
+	w.Write([]byte(http.StatusText(status)))
+}
+
+// RenderGitError renders the message so that the git client shows it as "remote error".
+// The message is sent with the "ERR" packet, or with the side-band channel 3 if the client requested the side-band.
+func RenderGitError(w http.ResponseWriter, rpc string, message string, sideband bool) {
+	w.Header().Set("Content-Type", fmt.Sprintf("application/x-git-%s-result", rpc))
+	w.WriteHeader(http.StatusOK)
+	pw := pktline.NewWriter(w)
+	if sideband {
+		pw.WriteBand(pktline.BandError, []byte(message+"\n"))
+		pw.WriteFlush()
+		return
+	}
+	pw.WriteError(message)
+}
@@ -63,3 +63,45 @@ func Test_InternalServerError_should_render_InternalServerError(t *testing.T) {
 		t.Errorf("Content-Type is not 'text/plain' . result: %s", contentType)
 	}
 }
+
+func Test_GitError_should_render_error_packet(t *testing.T) {
+
+	tests := []struct {
+		description  string
+		rpc          string
+		sideband     bool
+		expectedBody string
+	}{
+		{
+			description:  "it should render ERR packet",
+			rpc:          "upload-pack",
+			sideband:     false,
+			expectedBody: "0017ERR quota exceeded\n",
+		},
+		{
+			description:  "it should render side-band channel 3",
+			rpc:          "receive-pack",
+			sideband:     true,
+			expectedBody: "0014\x03quota exceeded\n0000",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		w := httptest.NewRecorder()
+		RenderGitError(w, tc.rpc, "quota exceeded", tc.sideband)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("StatusCode is not %d . result: %d", http.StatusOK, w.Code)
+		}
+
+		expectedContentType := "application/x-git-" + tc.rpc + "-result"
+		if contentType := w.Header().Get("Content-Type"); contentType != expectedContentType {
+			t.Errorf("Content-Type is not '%s' . result: %s", expectedContentType, contentType)
+		}
+
+		if body := w.Body.String(); body != tc.expectedBody {
+			t.Errorf("body is not %q . result: %q", tc.expectedBody, body)
+		}
+	}
+}
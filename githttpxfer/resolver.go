@@ -0,0 +1,96 @@
+package githttpxfer
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RepoResolver resolves the repository path of the URL to the location of the repository in the storage.
+// It must be safe for the concurrent use.
+type RepoResolver interface {
+	// Resolve returns the absolute path of the repository, or RepositoryNotFoundError if there is no such repository.
+	Resolve(repoPath string) (string, error)
+}
+
+// RepoResolverFunc is the function that works as RepoResolver, such as the lookup of a database.
+type RepoResolverFunc func(repoPath string) (string, error)
+
+func (f RepoResolverFunc) Resolve(repoPath string) (string, error) {
+	return f(repoPath)
+}
+
+// NewRootResolver returns the default resolver that joins the repository path to rootPath.
+// The repository must lie inside rootPath after the symlinks are resolved.
+func NewRootResolver(rootPath string) RepoResolver {
+	return &rootResolver{rootPath}
+}
+
+type rootResolver struct {
+	rootPath string
+}
+
+func (r *rootResolver) Resolve(repoPath string) (string, error) {
+	if strings.Trim(repoPath, "/") == "" {
+		// The root itself is not a repository.
+		return "", &RepositoryNotFoundError{RepoPath: repoPath}
+	}
+	return SecureJoin(r.rootPath, repoPath)
+}
+
+// shardReplicas is the number of the points of each root on the hash ring.
+const shardReplicas = 128
+
+// ShardedResolver spreads the repositories across several roots with the consistent hashing.
+// Adding a root moves only the share of the repositories that the new root takes over.
+type ShardedResolver struct {
+	points []uint64
+	roots  map[uint64]string
+}
+
+// NewShardedResolver returns the resolver that places each repository under one of roots.
+// The repository must lie inside its root after the symlinks are resolved.
+func NewShardedResolver(roots ...string) *ShardedResolver {
+	r := &ShardedResolver{roots: map[uint64]string{}}
+	for _, root := range roots {
+		for i := 0; i < shardReplicas; i++ {
+			point := shardHash(root + "#" + strconv.Itoa(i))
+			if _, ok := r.roots[point]; ok {
+				continue
+			}
+			r.roots[point] = root
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Root returns the root that the repository is placed under.
+func (r *ShardedResolver) Root(repoPath string) (string, bool) {
+	if len(r.points) == 0 {
+		return "", false
+	}
+	key := shardHash(strings.Trim(path.Clean("/"+repoPath), "/"))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= key })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.roots[r.points[i]], true
+}
+
+func (r *ShardedResolver) Resolve(repoPath string) (string, error) {
+	root, ok := r.Root(repoPath)
+	if !ok || strings.Trim(repoPath, "/") == "" {
+		return "", &RepositoryNotFoundError{RepoPath: repoPath}
+	}
+	return SecureJoin(root, repoPath)
+}
+
+func shardHash(key string) uint64 {
+	sum := sha1.Sum([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
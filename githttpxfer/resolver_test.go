@@ -0,0 +1,131 @@
+package githttpxfer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_ShardedResolver_should_spread_the_repositories(t *testing.T) {
+
+	roots := []string{"/disk1", "/disk2", "/disk3"}
+	resolver := NewShardedResolver(roots...)
+
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		repoPath := fmt.Sprintf("/org%d/project%d.git", i%17, i)
+		absRepoPath, err := resolver.Resolve(repoPath)
+		if err != nil {
+			t.Errorf("the repository is not resolved. error: %s", err.Error())
+			return
+		}
+		root, _ := resolver.Root(repoPath)
+		if absRepoPath != root+repoPath {
+			t.Errorf("path is not %s . result: %s", root+repoPath, absRepoPath)
+		}
+		counts[root]++
+	}
+	for _, root := range roots {
+		if counts[root] < 600 {
+			t.Errorf("the repositories are not spread to %s . result: %v", root, counts)
+		}
+	}
+}
+
+func Test_ShardedResolver_should_resolve_the_same_repository_to_the_same_root(t *testing.T) {
+
+	resolver := NewShardedResolver("/disk1", "/disk2", "/disk3")
+
+	tests := []struct {
+		description string
+		repoPath    string
+	}{
+		{description: "it should ignore the leading slash", repoPath: "org/project.git"},
+		{description: "it should ignore the trailing slash", repoPath: "/org/project.git/"},
+		{description: "it should ignore the duplicate slashes", repoPath: "/org//project.git"},
+	}
+
+	expected, _ := resolver.Root("/org/project.git")
+	for _, tc := range tests {
+		t.Log(tc.description)
+		if root, _ := resolver.Root(tc.repoPath); root != expected {
+			t.Errorf("root is not %s . result: %s", expected, root)
+		}
+	}
+}
+
+func Test_ShardedResolver_should_move_a_few_repositories_when_a_root_is_added(t *testing.T) {
+
+	before := NewShardedResolver("/disk1", "/disk2", "/disk3")
+	after := NewShardedResolver("/disk1", "/disk2", "/disk3", "/disk4")
+
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		repoPath := fmt.Sprintf("/repo%d.git", i)
+		from, _ := before.Root(repoPath)
+		to, _ := after.Root(repoPath)
+		if from != to {
+			if to != "/disk4" {
+				t.Errorf("the repository is moved to the old root. from: %s, to: %s", from, to)
+				return
+			}
+			moved++
+		}
+	}
+	if moved > 1200 {
+		t.Errorf("too many repositories are moved. result: %d", moved)
+	}
+}
+
+func Test_ShardedResolver_should_not_resolve_without_the_roots(t *testing.T) {
+
+	_, err := NewShardedResolver().Resolve("/foo.git")
+	var notFound *RepositoryNotFoundError
+	if !errors.As(err, &notFound) {
+		t.Errorf("error is not RepositoryNotFoundError . result: %v", err)
+	}
+}
+
+func Test_ServeHTTP_should_resolve_the_repository_with_the_resolver(t *testing.T) {
+
+	ghx, err := New("/data/git", "/usr/bin/git", WithRepoResolver(RepoResolverFunc(func(repoPath string) (string, error) {
+		switch repoPath {
+		case "/alias.git":
+			return "/data/git/test.git", nil
+		case "/broken.git":
+			return "", errors.New("the database is down")
+		}
+		return "", &RepositoryNotFoundError{RepoPath: repoPath}
+	})))
+	if err != nil {
+		t.Errorf("An instance could not be created. %s", err.Error())
+		return
+	}
+
+	tests := []struct {
+		description  string
+		url          string
+		expected     int
+		expectedBody string
+	}{
+		{description: "it should serve the repository at the resolved location", url: "/alias.git/info/refs?service=git-upload-pack", expected: http.StatusOK, expectedBody: "# service=git-upload-pack"},
+		{description: "it should serve the file at the resolved location", url: "/alias.git/HEAD", expected: http.StatusOK, expectedBody: "ref: refs/heads/"},
+		{description: "it should render not found for the repository that is not found", url: "/test.git/info/refs?service=git-upload-pack", expected: http.StatusNotFound},
+		{description: "it should render internal server error for the failure of the resolver", url: "/broken.git/HEAD", expected: http.StatusInternalServerError},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		rec := httptest.NewRecorder()
+		ghx.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com"+tc.url, nil))
+		if rec.Code != tc.expected {
+			t.Errorf("StatusCode is not %d . result: %d", tc.expected, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), tc.expectedBody) {
+			t.Errorf("Body does not contain %q . result: %s", tc.expectedBody, rec.Body.String())
+		}
+	}
+}
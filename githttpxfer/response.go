@@ -4,8 +4,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"strconv"
 	"time"
+
+	"github.com/nulab/go-git-http-xfer/pktline"
 )
 
 type Response struct {
@@ -60,13 +61,20 @@ func (r *Response) Copy(stdout io.Reader) (int64, error) {
 	return io.Copy(r.Writer, stdout)
 }
 
-const endEdge = "0000"
+func (r *Response) PktWriter() *pktline.Writer {
+	return pktline.NewWriter(r.Writer)
+}
 
 func (r *Response) PktFlush() (int, error) {
-	return r.Write([]byte(endEdge))
+	if err := r.PktWriter().WriteFlush(); err != nil {
+		return 0, err
+	}
+	return pktline.LenSize, nil
 }
 
 func (r *Response) PktWrite(str string) (int, error) {
-	s := fmt.Sprintf("%04s", strconv.FormatInt(int64(len(str)+4), 16))
-	return r.Write([]byte(s + str))
+	if err := r.PktWriter().WriteString(str); err != nil {
+		return 0, err
+	}
+	return pktline.LenSize + len(str), nil
 }
@@ -0,0 +1,124 @@
+package githttpxfer
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MaxStderrExcerpt is the size of the end of the standard error that Result keeps.
+const MaxStderrExcerpt = 4 * 1024
+
+// Result is the outcome of the service, which the listeners of the After* events and OnError get with Context.Result.
+type Result struct {
+	Service string
+	// ExitCode is the exit code of git. See ExitCode.
+	ExitCode int
+	// Stderr is the end of the standard error of git.
+	Stderr string
+	// BytesIn is the bytes of the request given to the service, and BytesOut is the bytes of its output.
+	BytesIn  int64
+	BytesOut int64
+	Duration time.Duration
+	// Cached reports whether the output has been served from the pack cache without git.
+	Cached bool
+
+	// Err is the error of the service, or the cause of the failure of the request for OnError.
+	Err error
+	// ErrorKind is the kind of Err such as ErrorKindTimeout.
+	ErrorKind string
+}
+
+// RunService runs the service with the request r and the output w, and sets its Result on ctx.
+// The service is reported to the metrics.
+func (ghx *GitHTTPXfer) RunService(ctx Context, service string, r io.Reader, w io.Writer, run func(r io.Reader, w io.Writer) error) error {
+	result := &Result{Service: service}
+	ctx.SetResult(result)
+	in := &countingReader{r: r}
+	out := &countingWriter{w: w}
+
+	ghx.metrics.ServiceStarted(ctx, service)
+	start := time.Now()
+	err := run(in, out)
+	result.Duration = time.Since(start)
+	result.ExitCode = ExitCode(err)
+	result.BytesIn = atomic.LoadInt64(&in.n)
+	result.BytesOut = atomic.LoadInt64(&out.n)
+	result.Err = err
+	ghx.metrics.ServiceFinished(ctx, service, result.ExitCode, result.Duration)
+	return err
+}
+
+// ReportError reports the failure of the request to the metrics and the listeners of OnError.
+func (ghx *GitHTTPXfer) ReportError(ctx Context, kind string, err error) {
+	ghx.metrics.Error(ctx, kind)
+	result := ctx.Result()
+	if result == nil {
+		result = &Result{}
+		ctx.SetResult(result)
+	}
+	result.Err = err
+	result.ErrorKind = kind
+	ghx.Event.notify(OnError, ctx)
+}
+
+// errRateLimited is the cause of the request refused by the rate limits.
+var errRateLimited = errors.New("the request is rate limited")
+
+// serviceErrorKind returns the kind of the error of the service.
+func serviceErrorKind(err error) string {
+	var timeoutErr *TimeoutError
+	if errors.As(err, &timeoutErr) {
+		return ErrorKindTimeout
+	}
+	return ErrorKindService
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	if r.r == nil {
+		return 0, io.EOF
+	}
+	n, err := r.r.Read(p)
+	atomic.AddInt64(&r.n, int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	atomic.AddInt64(&w.n, int64(n))
+	return n, err
+}
+
+// StderrExcerpt keeps the end of the standard error of git for Result.Stderr.
+type StderrExcerpt struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (e *StderrExcerpt) Write(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.buf = append(e.buf, p...)
+	if over := len(e.buf) - MaxStderrExcerpt; over > 0 {
+		e.buf = append(e.buf[:0], e.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+func (e *StderrExcerpt) String() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return string(e.buf)
+}
@@ -13,6 +13,8 @@ func (r *router) Add(route *Route) {
 	r.routes = append(r.routes, route)
 }
 
+// Match returns the first route that matches the method and the URL.
+// The routes of the same pattern can be added for each method.
 func (r *router) Match(method string, u *url.URL) (match *Match, route *Route, err error) {
 	for _, v := range r.routes {
 		if m := v.Pattern(u); m != nil {
@@ -21,17 +23,20 @@ func (r *router) Match(method string, u *url.URL) (match *Match, route *Route, e
 					Method: method,
 					Path:   u.Path,
 				}
-				return
+				continue
 			}
 			match = m
 			route = v
+			err = nil
 			return
 		}
 	}
 
-	err = &URLNotFoundError{
-		Method: method,
-		Path:   u.Path,
+	if err == nil {
+		err = &URLNotFoundError{
+			Method: method,
+			Path:   u.Path,
+		}
 	}
 	return
 }
@@ -100,3 +100,21 @@ func Test_Router_Match_should_return_MethodNotAllowed_error(t *testing.T) {
 		return
 	}
 }
+
+func Test_Router_Match_should_match_route_of_same_pattern_for_each_method(t *testing.T) {
+	router := &router{}
+	pattern := func(u *url.URL) *Match {
+		return matchSuffix(u.Path, "/foo")
+	}
+	router.Add(&Route{http.MethodGet, pattern, func(ctx Context) {}})
+	router.Add(&Route{http.MethodPut, pattern, func(ctx Context) {}})
+
+	_, route, err := router.Match(http.MethodPut, &url.URL{Path: "/base/foo"})
+	if err != nil {
+		t.Errorf("error is %s", err.Error())
+		return
+	}
+	if http.MethodPut != route.Method {
+		t.Errorf("http method is not %s . result: %s", http.MethodPut, route.Method)
+	}
+}
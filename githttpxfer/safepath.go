@@ -0,0 +1,90 @@
+package githttpxfer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// encodedTraversals are the encodings of ".", "/", "\" and NUL that are left after the URL is decoded once.
+var encodedTraversals = []string{"%2e", "%2f", "%5c", "%00"}
+
+// CleanPath checks the path that comes from the URL, and returns it without the empty segments and the leading and trailing slashes.
+// It refuses the "." and ".." segments, the backslashes, the NUL bytes and the encoded traversal such as "%2e%2e".
+func CleanPath(p string) (string, error) {
+	if strings.ContainsAny(p, "\\\x00") {
+		return "", &UnsafePathError{Path: p, Reason: "the path has a backslash or a NUL byte"}
+	}
+	lower := strings.ToLower(p)
+	for _, encoded := range encodedTraversals {
+		if strings.Contains(lower, encoded) {
+			return "", &UnsafePathError{Path: p, Reason: "the path has the encoded " + encoded}
+		}
+	}
+	var segments []string
+	for _, segment := range strings.Split(p, "/") {
+		switch segment {
+		case "":
+			continue
+		case ".", "..":
+			return "", &UnsafePathError{Path: p, Reason: "the path has the segment " + segment}
+		}
+		segments = append(segments, segment)
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// SecureJoin joins the path that comes from the URL to root, and checks that the result lies inside root
+// after the symlinks are resolved. The path does not need to exist.
+func SecureJoin(root, p string) (string, error) {
+	rel, err := CleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	if rel == "" {
+		return "", &UnsafePathError{Path: p, Reason: "the path is empty"}
+	}
+	joined := filepath.Join(root, filepath.FromSlash(rel))
+
+	realRoot, err := evalExistingSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	realPath, err := evalExistingSymlinks(joined)
+	if err != nil {
+		return "", err
+	}
+	if !isInside(realRoot, realPath) {
+		return "", &UnsafePathError{Path: p, Reason: "the path resolves to " + realPath + " outside " + realRoot}
+	}
+	return joined, nil
+}
+
+// evalExistingSymlinks resolves the symlinks of the longest part of p that exists, and appends the rest.
+func evalExistingSymlinks(p string) (string, error) {
+	realPath, err := filepath.EvalSymlinks(p)
+	if err == nil {
+		return realPath, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	parent := filepath.Dir(p)
+	if parent == p {
+		return p, nil
+	}
+	realParent, err := evalExistingSymlinks(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(realParent, filepath.Base(p)), nil
+}
+
+// isInside reports whether p is below root.
+func isInside(root, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
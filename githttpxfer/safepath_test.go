@@ -0,0 +1,155 @@
+package githttpxfer
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_CleanPath_should_refuse_the_hostile_paths(t *testing.T) {
+
+	tests := []struct {
+		description string
+		path        string
+		expected    string
+		unsafe      bool
+	}{
+		{description: "it should clean the repository path", path: "/org/project.git", expected: "org/project.git"},
+		{description: "it should drop the empty segments", path: "//org//project.git/", expected: "org/project.git"},
+		{description: "it should accept the dots in the name", path: "/org/..project.git", expected: "org/..project.git"},
+		{description: "it should refuse the parent segment", path: "/org/../../etc", unsafe: true},
+		{description: "it should refuse the current segment", path: "/org/./project.git", unsafe: true},
+		{description: "it should refuse the trailing parent segment", path: "/project.git/..", unsafe: true},
+		{description: "it should refuse the double encoded dots", path: "/%2e%2e/etc", unsafe: true},
+		{description: "it should refuse the double encoded dots in upper case", path: "/%2E%2E/etc", unsafe: true},
+		{description: "it should refuse the double encoded slash", path: "/..%2fetc", unsafe: true},
+		{description: "it should refuse the double encoded backslash", path: "/..%5cetc", unsafe: true},
+		{description: "it should refuse the backslash", path: "/..\\etc", unsafe: true},
+		{description: "it should refuse the NUL byte", path: "/project.git\x00/HEAD", unsafe: true},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		result, err := CleanPath(tc.path)
+		var unsafePath *UnsafePathError
+		if errors.As(err, &unsafePath) != tc.unsafe {
+			t.Errorf("the path is not refused as %t . result: %v", tc.unsafe, err)
+			continue
+		}
+		if result != tc.expected {
+			t.Errorf("path is not %s . result: %s", tc.expected, result)
+		}
+	}
+}
+
+// hostileRoot creates the root of the repositories with the symlinks that escape from it.
+//
+//	root/real.git/HEAD
+//	root/real.git/objects/info/alternates -> outside/secret
+//	root/real.git/objects/info/inner -> ../../HEAD
+//	root/real.git/objects/info/dir/
+//	root/escape.git -> outside
+func hostileRoot(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "githttpxfer")
+	if err != nil {
+		t.Fatalf("Create Temp Dir error: %s", err.Error())
+	}
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	repo := filepath.Join(root, "real.git")
+	for _, d := range []string{outside, filepath.Join(repo, "objects", "info", "dir")} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			t.Fatalf("Mkdir error: %s", err.Error())
+		}
+	}
+	for _, f := range []string{filepath.Join(repo, "HEAD"), filepath.Join(outside, "HEAD"), filepath.Join(outside, "secret")} {
+		if err := ioutil.WriteFile(f, []byte("ref: refs/heads/master\n"), 0644); err != nil {
+			t.Fatalf("WriteFile error: %s", err.Error())
+		}
+	}
+	links := map[string]string{
+		filepath.Join(repo, "objects", "info", "alternates"): filepath.Join(outside, "secret"),
+		filepath.Join(repo, "objects", "info", "inner"):      "../../HEAD",
+		filepath.Join(root, "escape.git"):                    outside,
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatalf("Symlink error: %s", err.Error())
+		}
+	}
+	return root, func() { os.RemoveAll(dir) }
+}
+
+func Test_SecureJoin_should_refuse_the_symlinks_that_escape_from_the_root(t *testing.T) {
+
+	root, cleanup := hostileRoot(t)
+	defer cleanup()
+
+	tests := []struct {
+		description string
+		path        string
+		unsafe      bool
+	}{
+		{description: "it should join the repository", path: "/real.git"},
+		{description: "it should join the repository that does not exist", path: "/new/project.git"},
+		{description: "it should join the symlink inside the root", path: "/real.git/objects/info/inner"},
+		{description: "it should refuse the repository that is a symlink to the outside", path: "/escape.git", unsafe: true},
+		{description: "it should refuse the path below the symlink to the outside", path: "/escape.git/HEAD", unsafe: true},
+		{description: "it should refuse the file that is a symlink to the outside", path: "/real.git/objects/info/alternates", unsafe: true},
+		{description: "it should refuse the root itself", path: "/", unsafe: true},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		result, err := SecureJoin(root, tc.path)
+		var unsafePath *UnsafePathError
+		if errors.As(err, &unsafePath) != tc.unsafe {
+			t.Errorf("the path is not refused as %t . result: %v", tc.unsafe, err)
+			continue
+		}
+		if expected := filepath.Join(root, tc.path); !tc.unsafe && result != expected {
+			t.Errorf("path is not %s . result: %s", expected, result)
+		}
+	}
+}
+
+func Test_ServeHTTP_should_not_serve_the_files_outside_the_repository(t *testing.T) {
+
+	root, cleanup := hostileRoot(t)
+	defer cleanup()
+
+	ghx, err := New(root, "/usr/bin/git")
+	if err != nil {
+		t.Errorf("An instance could not be created. %s", err.Error())
+		return
+	}
+
+	tests := []struct {
+		description string
+		url         string
+		expected    int
+	}{
+		{description: "it should serve the file of the repository", url: "/real.git/HEAD", expected: http.StatusOK},
+		{description: "it should serve the symlink inside the repository", url: "/real.git/objects/info/inner", expected: http.StatusOK},
+		{description: "it should refuse the traversal of the repository path", url: "/real.git/../../outside/HEAD", expected: http.StatusBadRequest},
+		{description: "it should refuse the encoded traversal", url: "/real.git/%2e%2e/%2e%2e/outside/HEAD", expected: http.StatusBadRequest},
+		{description: "it should refuse the double encoded traversal", url: "/real.git/%252e%252e/%252e%252e/outside/HEAD", expected: http.StatusBadRequest},
+		{description: "it should refuse the traversal of the file path", url: "/real.git/objects/info/..", expected: http.StatusBadRequest},
+		{description: "it should not serve the repository that is a symlink to the outside", url: "/escape.git/HEAD", expected: http.StatusNotFound},
+		{description: "it should not serve the file that is a symlink to the outside", url: "/real.git/objects/info/alternates", expected: http.StatusNotFound},
+		{description: "it should not serve the directory", url: "/real.git/objects/info/dir", expected: http.StatusNotFound},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		rec := httptest.NewRecorder()
+		ghx.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://example.com"+tc.url, nil))
+		if rec.Code != tc.expected {
+			t.Errorf("StatusCode is not %d . result: %d", tc.expected, rec.Code)
+		}
+	}
+}
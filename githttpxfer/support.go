@@ -2,9 +2,8 @@ package githttpxfer
 
 import (
 	"net/http"
-	"os/exec"
+	"regexp"
 	"strings"
-	"syscall"
 )
 
 func getServiceType(req *http.Request) string {
@@ -15,11 +14,53 @@ func getServiceType(req *http.Request) string {
 	return strings.Replace(serviceType, "git-", "", 1)
 }
 
-func cleanUpProcessGroup(cmd *exec.Cmd) {
-	if cmd == nil {
-		return
+// gitProtocolRegexp accepts colon separated "key" or "key=value" parameters.
+var gitProtocolRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+(=[A-Za-z0-9._-]*)?(:[A-Za-z0-9._-]+(=[A-Za-z0-9._-]*)?)*$`)
+
+func getGitProtocol(req *http.Request) string {
+	protocol := req.Header.Get("Git-Protocol")
+	if !gitProtocolRegexp.MatchString(protocol) {
+		return ""
+	}
+	return protocol
+}
+
+// getScheme returns the scheme of X-Forwarded-Proto that the proxy in front of the server sets if forwarded is true,
+// or the one of the connection.
+func getScheme(req *http.Request, forwarded bool) string {
+	if forwarded {
+		proto := strings.TrimSpace(strings.Split(req.Header.Get("X-Forwarded-Proto"), ",")[0])
+		if proto == "http" || proto == "https" {
+			return proto
+		}
+	}
+	if req.TLS != nil {
+		return "https"
 	}
-	if process := cmd.Process; process != nil && process.Pid > 0 {
-		syscall.Kill(-process.Pid, syscall.SIGTERM)
+	return "http"
+}
+
+// GitConfigParameters returns the entry of GIT_CONFIG_PARAMETERS that has the config after the one of env.
+// git passes the config of "git -c name=value" to its subprocesses by this variable,
+// so the config works whatever CommandFactory runs git.
+func GitConfigParameters(env []string, config []string) string {
+	params := []string{}
+	for _, e := range env {
+		if strings.HasPrefix(e, "GIT_CONFIG_PARAMETERS=") {
+			params = []string{strings.TrimPrefix(e, "GIT_CONFIG_PARAMETERS=")}
+		}
+	}
+	for _, c := range config {
+		params = append(params, "'"+strings.Replace(c, "'", `'\''`, -1)+"'")
+	}
+	return "GIT_CONFIG_PARAMETERS=" + strings.Join(params, " ")
+}
+
+func hasProtocolVersion2(protocol string) bool {
+	for _, param := range strings.Split(protocol, ":") {
+		if param == "version=2" {
+			return true
+		}
 	}
+	return false
 }
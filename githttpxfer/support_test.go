@@ -42,3 +42,116 @@ func Test_GetServiceType(t *testing.T) {
 		}
 	}
 }
+
+func Test_GetGitProtocol(t *testing.T) {
+
+	tests := []struct {
+		description string
+		header      string
+		expected    string
+	}{
+		{
+			description: "it should return version=2",
+			header:      "version=2",
+			expected:    "version=2",
+		},
+		{
+			description: "it should return multiple parameters",
+			header:      "version=2:object-format=sha256",
+			expected:    "version=2:object-format=sha256",
+		},
+		{
+			description: "it should return empty if header is empty",
+			header:      "",
+			expected:    "",
+		},
+		{
+			description: "it should return empty if header has invalid characters",
+			header:      "version=2 foo;bar",
+			expected:    "",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/base/foo/info/refs?service=git-upload-pack", nil)
+		r.Header.Set("Git-Protocol", tc.header)
+
+		if protocol := getGitProtocol(r); tc.expected != protocol {
+			t.Errorf("git protocol is not %s . result: %s", tc.expected, protocol)
+		}
+	}
+}
+
+func Test_HasProtocolVersion2(t *testing.T) {
+
+	tests := []struct {
+		description string
+		protocol    string
+		expected    bool
+	}{
+		{
+			description: "it should return true if version=2",
+			protocol:    "version=2",
+			expected:    true,
+		},
+		{
+			description: "it should return true if version=2 is one of parameters",
+			protocol:    "object-format=sha1:version=2",
+			expected:    true,
+		},
+		{
+			description: "it should return false if version=1",
+			protocol:    "version=1",
+			expected:    false,
+		},
+		{
+			description: "it should return false if empty",
+			protocol:    "",
+			expected:    false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		if v2 := hasProtocolVersion2(tc.protocol); tc.expected != v2 {
+			t.Errorf("result is not %t . protocol: %s", tc.expected, tc.protocol)
+		}
+	}
+}
+
+func Test_GitConfigParameters(t *testing.T) {
+
+	tests := []struct {
+		description string
+		env         []string
+		config      []string
+		expected    string
+	}{
+		{
+			description: "it should quote the config",
+			env:         []string{"HOME=/root"},
+			config:      []string{"uploadpack.allowFilter=true", "uploadpack.allowAnySHA1InWant=true"},
+			expected:    "GIT_CONFIG_PARAMETERS='uploadpack.allowFilter=true' 'uploadpack.allowAnySHA1InWant=true'",
+		},
+		{
+			description: "it should keep the config of env",
+			env:         []string{"GIT_CONFIG_PARAMETERS='core.bigFileThreshold=1m'"},
+			config:      []string{"uploadpack.allowFilter=true"},
+			expected:    "GIT_CONFIG_PARAMETERS='core.bigFileThreshold=1m' 'uploadpack.allowFilter=true'",
+		},
+		{
+			description: "it should escape the single quote",
+			env:         nil,
+			config:      []string{"foo.bar=it's"},
+			expected:    `GIT_CONFIG_PARAMETERS='foo.bar=it'\''s'`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		if result := GitConfigParameters(tc.env, tc.config); tc.expected != result {
+			t.Errorf("parameters is not %s . result: %s", tc.expected, result)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package githttpxfer
+
+import (
+	gocontext "context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Timeouts stops the git process that runs too long. Zero means no limit.
+type Timeouts struct {
+	// Total limits the whole run of the process.
+	Total time.Duration
+	// Idle limits the time in which neither the request body is read nor the output is written.
+	Idle time.Duration
+}
+
+// ServiceTimeouts holds the timeouts of each service.
+// The timeouts of the service apply to its advertisement as well.
+type ServiceTimeouts struct {
+	UploadPack  Timeouts
+	ReceivePack Timeouts
+	// Archive is for git archive of the archive handler.
+	Archive Timeouts
+	// KillGrace is the time between SIGTERM and SIGKILL. It is 5 seconds if zero.
+	KillGrace time.Duration
+}
+
+func (t ServiceTimeouts) of(service string) Timeouts {
+	switch service {
+	case receivePack:
+		return t.ReceivePack
+	case archive:
+		return t.Archive
+	}
+	return t.UploadPack
+}
+
+const defaultKillGrace = 5 * time.Second
+
+// TimeoutError is the error of the git process that has been stopped by the timeout.
+type TimeoutError struct {
+	Service  string
+	RepoPath string
+	Idle     bool
+	Timeout  time.Duration
+	// Phase is what the process was doing, such as "reading the request body".
+	Phase string
+}
+
+func (e *TimeoutError) Error() string {
+	kind := "total"
+	if e.Idle {
+		kind = "idle"
+	}
+	return fmt.Sprintf("%s of %s was stopped by the %s timeout of %s while %s", e.Service, e.RepoPath, kind, e.Timeout, e.Phase)
+}
+
+const (
+	phaseReadingBody   = "reading the request body"
+	phaseWritingOutput = "writing the output"
+	phaseWaitingExit   = "waiting for the exit"
+)
+
+// watchdog terminates the process group that the command leads when the request is done or the timeout expires.
+// The process group gets SIGTERM, and SIGKILL if it is still running after the grace period.
+type watchdog struct {
+	cmd      *exec.Cmd
+	rw       http.ResponseWriter
+	service  string
+	repoPath string
+	timeouts Timeouts
+	grace    time.Duration
+
+	mu         sync.Mutex
+	phase      string
+	lastActive time.Time
+	err        *TimeoutError
+
+	exited   chan struct{}
+	stopOnce sync.Once
+}
+
+func (g *git) newWatchdog(ctx Context, cmd *exec.Cmd, service string) *watchdog {
+	grace := g.timeouts.KillGrace
+	if grace <= 0 {
+		grace = defaultKillGrace
+	}
+	w := &watchdog{
+		cmd:      cmd,
+		rw:       ctx.Response().Writer,
+		service:  service,
+		repoPath: ctx.RepoPath(),
+		timeouts: g.timeouts.of(service),
+		grace:    grace,
+		phase:    phaseWritingOutput,
+		exited:   make(chan struct{}),
+	}
+	return w
+}
+
+// start watches the command after it has started.
+func (w *watchdog) start(ctx Context) {
+	w.touch()
+	go w.watch(ctx.Request().Context())
+}
+
+func (w *watchdog) watch(ctx gocontext.Context) {
+	var total, idle <-chan time.Time
+	if w.timeouts.Total > 0 {
+		timer := time.NewTimer(w.timeouts.Total)
+		defer timer.Stop()
+		total = timer.C
+	}
+	var idleTimer *time.Timer
+	if w.timeouts.Idle > 0 {
+		idleTimer = time.NewTimer(w.timeouts.Idle)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	for {
+		select {
+		case <-w.exited:
+			return
+		case <-ctx.Done():
+			w.terminate()
+			return
+		case <-total:
+			w.expire(false, w.timeouts.Total)
+			return
+		case <-idle:
+			w.mu.Lock()
+			rest := w.timeouts.Idle - time.Since(w.lastActive)
+			w.mu.Unlock()
+			if rest > 0 {
+				idleTimer.Reset(rest)
+				continue
+			}
+			w.expire(true, w.timeouts.Idle)
+			return
+		}
+	}
+}
+
+func (w *watchdog) expire(idle bool, timeout time.Duration) {
+	w.mu.Lock()
+	w.err = &TimeoutError{Service: w.service, RepoPath: w.repoPath, Idle: idle, Timeout: timeout, Phase: w.phase}
+	w.mu.Unlock()
+
+	// The copy may be blocked by the client rather than by git.
+	rc := http.NewResponseController(w.rw)
+	rc.SetReadDeadline(time.Now())
+	rc.SetWriteDeadline(time.Now())
+	w.terminate()
+}
+
+func (w *watchdog) terminate() {
+	process := w.cmd.Process
+	if process == nil || process.Pid <= 0 {
+		return
+	}
+	signal(process, syscall.SIGTERM)
+	timer := time.NewTimer(w.grace)
+	defer timer.Stop()
+	select {
+	case <-w.exited:
+	case <-timer.C:
+		signal(process, syscall.SIGKILL)
+	}
+}
+
+// signal sends sig to the process group that the process leads as the session or the group leader,
+// or to the process alone if it has joined a group of another process.
+func signal(process *os.Process, sig syscall.Signal) {
+	if pgid, err := syscall.Getpgid(process.Pid); err == nil && pgid == process.Pid {
+		syscall.Kill(-process.Pid, sig)
+		return
+	}
+	process.Signal(sig)
+}
+
+// touch records the progress of the input or output.
+func (w *watchdog) touch() {
+	w.mu.Lock()
+	w.lastActive = time.Now()
+	w.mu.Unlock()
+}
+
+func (w *watchdog) setPhase(phase string) {
+	w.mu.Lock()
+	w.phase = phase
+	w.lastActive = time.Now()
+	w.mu.Unlock()
+}
+
+// stop is called after the command has exited.
+func (w *watchdog) stop() {
+	w.stopOnce.Do(func() { close(w.exited) })
+}
+
+// Err returns the TimeoutError if the timeout has expired.
+func (w *watchdog) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		return nil
+	}
+	return w.err
+}
+
+func (w *watchdog) reader(r io.Reader) io.Reader {
+	return &watchedReader{r, w}
+}
+
+func (w *watchdog) writer(wr io.Writer) io.Writer {
+	return &watchedWriter{wr, w}
+}
+
+type watchedReader struct {
+	r io.Reader
+	w *watchdog
+}
+
+func (r *watchedReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.w.touch()
+	}
+	return n, err
+}
+
+type watchedWriter struct {
+	wr io.Writer
+	w  *watchdog
+}
+
+func (w *watchedWriter) Write(p []byte) (int, error) {
+	n, err := w.wr.Write(p)
+	if n > 0 {
+		w.w.touch()
+	}
+	return n, err
+}
@@ -0,0 +1,132 @@
+package githttpxfer
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// hangingCommandFactory runs the command that ignores SIGTERM and never writes, like a hung git.
+func hangingCommandFactory(absRepoPath, subcommand string, args ...string) *exec.Cmd {
+	return exec.Command("sh", "-c", "trap '' TERM; sleep 30")
+}
+
+// sessionCommandFactory runs the hanging command in its own session, like a launcher such as setsid or nsjail.
+func sessionCommandFactory(absRepoPath, subcommand string, args ...string) *exec.Cmd {
+	cmd := hangingCommandFactory(absRepoPath, subcommand, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	return cmd
+}
+
+func Test_Git_serviceRPC_should_stop_the_process_by_the_timeouts(t *testing.T) {
+
+	gitRootPath, err := ioutil.TempDir("", "githttpxfer")
+	if err != nil {
+		t.Errorf("Create Temp Dir error: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(gitRootPath)
+	os.Mkdir(gitRootPath+"/foo", 0755)
+
+	tests := []struct {
+		description string
+		factory     CommandFactory
+		timeouts    Timeouts
+		expected    TimeoutError
+	}{
+		{
+			description: "it should stop the process by the idle timeout",
+			factory:     hangingCommandFactory,
+			timeouts:    Timeouts{Idle: 200 * time.Millisecond},
+			expected:    TimeoutError{Service: uploadPack, RepoPath: "foo", Idle: true, Timeout: 200 * time.Millisecond, Phase: phaseWritingOutput},
+		},
+		{
+			description: "it should stop the process by the total timeout",
+			factory:     hangingCommandFactory,
+			timeouts:    Timeouts{Total: 200 * time.Millisecond, Idle: time.Minute},
+			expected:    TimeoutError{Service: uploadPack, RepoPath: "foo", Timeout: 200 * time.Millisecond, Phase: phaseWritingOutput},
+		},
+		{
+			description: "it should stop the process in the session of the command factory",
+			factory:     sessionCommandFactory,
+			timeouts:    Timeouts{Total: 200 * time.Millisecond},
+			expected:    TimeoutError{Service: uploadPack, RepoPath: "foo", Timeout: 200 * time.Millisecond, Phase: phaseWritingOutput},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		git := newGit(gitRootPath, "/usr/bin/git", true, true)
+		git.commandFactory = tc.factory
+		git.timeouts = ServiceTimeouts{UploadPack: tc.timeouts, KillGrace: 100 * time.Millisecond}
+
+		ctx := NewContext(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "http://example.com/foo/git-upload-pack", nil), "foo", "git-upload-pack")
+		start := time.Now()
+		err := git.serviceRPC(ctx, uploadPack, strings.NewReader("0000"), &bytes.Buffer{})
+		if timeoutErr, ok := err.(*TimeoutError); !ok || *timeoutErr != tc.expected {
+			t.Errorf("error is not %v . result: %v", tc.expected, err)
+			continue
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("the process is not killed after the grace period. elapsed: %s", elapsed)
+		}
+	}
+}
+
+func Test_ServeHTTP_should_stop_receive_pack_when_the_client_stalls(t *testing.T) {
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Log("git is not found. so skip the timeout test.")
+		return
+	}
+
+	gitRootPath, err := ioutil.TempDir("", "githttpxfer")
+	if err != nil {
+		t.Errorf("Create Temp Dir error: %s", err.Error())
+		return
+	}
+	defer os.RemoveAll(gitRootPath)
+	if output, err := exec.Command("git", "init", "--bare", gitRootPath+"/foo.git").CombinedOutput(); err != nil {
+		t.Errorf("execute command error: %s %s", err.Error(), output)
+		return
+	}
+
+	ghx, err := New(gitRootPath, "/usr/bin/git", WithTimeouts(ServiceTimeouts{ReceivePack: Timeouts{Idle: 300 * time.Millisecond}}))
+	if err != nil {
+		t.Errorf("An instance could not be created. %s", err.Error())
+		return
+	}
+	logger := &testLogger{}
+	ghx.SetLogger(logger.slog())
+	ts := httptest.NewServer(ghx)
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Errorf("dial error: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+
+	// The commands are sent, and the packfile never comes.
+	commands := pktLine("0000000000000000000000000000000000000000 1111111111111111111111111111111111111111 refs/heads/master\x00report-status\n") + "0000"
+	fmt.Fprintf(conn, "POST /foo.git/git-receive-pack HTTP/1.1\r\nHost: example.com\r\nContent-Type: application/x-git-receive-pack-request\r\nTransfer-Encoding: chunked\r\n\r\n")
+	fmt.Fprintf(conn, "%x\r\n%s\r\n", len(commands), commands)
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	ioutil.ReadAll(conn)
+
+	expected := "receive-pack of /foo.git was stopped by the idle timeout of 300ms while reading the request body"
+	if !strings.Contains(logger.String(), expected) {
+		t.Errorf("the log does not contain %q . result: %s", expected, logger.String())
+	}
+}
@@ -0,0 +1,168 @@
+package githttpxfer
+
+import (
+	gocontext "context"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Tracer starts the spans. Its methods have the same shape as those of OpenTelemetry,
+// so that a Tracer of OpenTelemetry can be adapted with a few lines.
+// The ctx of the first span is the one that Propagator has returned, so the trace context of the client
+// is found by the Tracer only if the Propagator stores it where the Tracer looks, such as the propagator of OpenTelemetry.
+type Tracer interface {
+	// Start starts the span as the child of the span in ctx, and returns ctx with the new span.
+	Start(ctx gocontext.Context, name string, attrs ...Attribute) (gocontext.Context, Span)
+}
+
+// Span is the span started by Tracer.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// Attribute is the key-value pair of the span.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// The keys of the attributes of the spans.
+const (
+	AttributeRepo          = "githttpxfer.repo"
+	AttributeService       = "githttpxfer.service"
+	AttributeGitSubcommand = "githttpxfer.git.subcommand"
+	AttributeHTTPMethod    = "http.request.method"
+	AttributeURLPath       = "url.path"
+)
+
+// Propagator extracts the trace context of the client from the request headers.
+// It returns the parent ctx of the spans that Tracer starts.
+type Propagator interface {
+	Extract(ctx gocontext.Context, header http.Header) gocontext.Context
+}
+
+// SpanContext is the span of the client that is propagated by the request headers.
+type SpanContext struct {
+	TraceID    [16]byte
+	SpanID     [8]byte
+	TraceFlags byte
+	TraceState string
+}
+
+// IsValid reports whether the IDs are not zero.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != [16]byte{} && sc.SpanID != [8]byte{}
+}
+
+// Sampled reports whether the client has sampled the trace.
+func (sc SpanContext) Sampled() bool {
+	return sc.TraceFlags&0x01 != 0
+}
+
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns ctx with the span of the client.
+func ContextWithSpanContext(ctx gocontext.Context, sc SpanContext) gocontext.Context {
+	return gocontext.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span of the client that TraceContextPropagator has extracted.
+func SpanContextFromContext(ctx gocontext.Context) (SpanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc, ok
+}
+
+// TraceContextPropagator extracts the "traceparent" and "tracestate" headers of W3C Trace Context.
+// The span of the client is stored for SpanContextFromContext, which the tracers of the other libraries do not read.
+// Use WithPropagator with the propagator of the library of the Tracer instead, such as that of OpenTelemetry.
+type TraceContextPropagator struct{}
+
+func (TraceContextPropagator) Extract(ctx gocontext.Context, header http.Header) gocontext.Context {
+	sc, ok := parseTraceparent(header.Get("traceparent"))
+	if !ok {
+		return ctx
+	}
+	sc.TraceState = header.Get("tracestate")
+	return ContextWithSpanContext(ctx, sc)
+}
+
+// parseTraceparent parses "version-traceid-spanid-flags". The later versions may append the fields.
+func parseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+	fields := strings.Split(strings.TrimSpace(value), "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || fields[0] == "ff" || (fields[0] == "00" && len(fields) != 4) {
+		return sc, false
+	}
+	if !decodeHex(sc.TraceID[:], fields[1]) || !decodeHex(sc.SpanID[:], fields[2]) {
+		return sc, false
+	}
+	var flags [1]byte
+	if !decodeHex(flags[:], fields[3]) {
+		return sc, false
+	}
+	sc.TraceFlags = flags[0]
+	return sc, sc.IsValid()
+}
+
+// decodeHex decodes the lowercase hex of exactly len(dst) bytes.
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != hex.EncodedLen(len(dst)) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttributes(attrs ...Attribute) {}
+func (nopSpan) RecordError(err error)            {}
+func (nopSpan) End()                             {}
+
+// startSpan starts the span in the request context if the tracer is set, and returns the request with the new span.
+func startSpan(tracer Tracer, r *http.Request, name string, attrs ...Attribute) (*http.Request, Span) {
+	if tracer == nil {
+		return r, nopSpan{}
+	}
+	spanCtx, span := tracer.Start(r.Context(), name, attrs...)
+	return r.WithContext(spanCtx), span
+}
+
+// traceContext starts the span in the request of ctx.
+// It returns ctx with the request of the new span for the child spans, and the function that ends the span.
+// The request of ctx itself is left as it is, since the caller and the listeners may still use it.
+func traceContext(tracer Tracer, ctx Context, name string, attrs ...Attribute) (Context, func(err error)) {
+	if tracer == nil {
+		return ctx, func(error) {}
+	}
+	r, span := startSpan(tracer, ctx.Request(), name, append([]Attribute{{AttributeRepo, ctx.RepoPath()}}, attrs...)...)
+	return &spanContext{Context: ctx, request: r}, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}
+}
+
+// spanContext is the Context with the request of the span. The other state is shared with the Context.
+type spanContext struct {
+	Context
+	request *http.Request
+}
+
+func (c *spanContext) Request() *http.Request {
+	return c.request
+}
+
+func (c *spanContext) SetRequest(r *http.Request) {
+	c.request = r
+}
+
+// StartSpan starts the span of the addon handler in the request of ctx, such as the run of git.
+// It returns ctx with the new span for the child spans, and the function that ends it with the error if any.
+func (ghx *GitHTTPXfer) StartSpan(ctx Context, name string, attrs ...Attribute) (Context, func(err error)) {
+	return traceContext(ghx.options.tracer, ctx, name, attrs...)
+}
@@ -0,0 +1,188 @@
+package githttpxfer
+
+import (
+	gocontext "context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingTracer records the ended spans as "parent > name".
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []string
+	attrs map[string][]Attribute
+}
+
+type recordingSpanKey struct{}
+
+type recordingSpan struct {
+	tracer *recordingTracer
+	name   string
+	parent string
+	attrs  []Attribute
+}
+
+func (tr *recordingTracer) Start(ctx gocontext.Context, name string, attrs ...Attribute) (gocontext.Context, Span) {
+	parent, _ := ctx.Value(recordingSpanKey{}).(string)
+	if parent == "" {
+		if sc, ok := SpanContextFromContext(ctx); ok {
+			parent = "remote " + sc.TraceState
+		}
+	}
+	return gocontext.WithValue(ctx, recordingSpanKey{}, name), &recordingSpan{tracer: tr, name: name, parent: parent, attrs: attrs}
+}
+
+func (s *recordingSpan) SetAttributes(attrs ...Attribute) {
+	s.attrs = append(s.attrs, attrs...)
+}
+
+func (s *recordingSpan) RecordError(err error) {}
+
+func (s *recordingSpan) End() {
+	s.tracer.mu.Lock()
+	defer s.tracer.mu.Unlock()
+	s.tracer.spans = append(s.tracer.spans, s.parent+" > "+s.name)
+	if s.tracer.attrs == nil {
+		s.tracer.attrs = map[string][]Attribute{}
+	}
+	s.tracer.attrs[s.name] = s.attrs
+}
+
+func (tr *recordingTracer) String() string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return strings.Join(tr.spans, "\n")
+}
+
+func Test_parseTraceparent(t *testing.T) {
+
+	tests := []struct {
+		description string
+		value       string
+		expected    bool
+		sampled     bool
+	}{
+		{description: "it should parse the sampled trace", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", expected: true, sampled: true},
+		{description: "it should parse the trace that is not sampled", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", expected: true},
+		{description: "it should parse the later version with the extra field", value: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", expected: true, sampled: true},
+		{description: "it should not parse the extra field of version 00", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", expected: false},
+		{description: "it should not parse the invalid version", value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", expected: false},
+		{description: "it should not parse the zero trace ID", value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01", expected: false},
+		{description: "it should not parse the uppercase hex", value: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", expected: false},
+		{description: "it should not parse the short span ID", value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa-01", expected: false},
+		{description: "it should not parse the empty header", value: "", expected: false},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		sc, ok := parseTraceparent(tc.value)
+		if ok != tc.expected {
+			t.Errorf("the result is not %t . result: %t", tc.expected, ok)
+			continue
+		}
+		if ok && sc.Sampled() != tc.sampled {
+			t.Errorf("sampled is not %t . result: %t", tc.sampled, sc.Sampled())
+		}
+	}
+}
+
+func Test_ServeHTTP_should_trace_the_request(t *testing.T) {
+
+	tracer := &recordingTracer{}
+	ghx, err := New("/data/git", "/usr/bin/git", WithTracer(tracer))
+	if err != nil {
+		t.Errorf("An instance could not be created. %s", err.Error())
+		return
+	}
+
+	tests := []struct {
+		description string
+		method      string
+		url         string
+		contentType string
+		body        string
+		expected    string
+	}{
+		{
+			description: "it should trace the advertisement",
+			method:      http.MethodGet,
+			url:         "/test.git/info/refs?service=git-upload-pack",
+			expected: strings.Join([]string{
+				"githttpxfer.ServeHTTP > githttpxfer.matchRouting",
+				"githttpxfer.ServeHTTP > githttpxfer.Exists",
+				"githttpxfer.ServeHTTP > githttpxfer.GitCommand",
+				"remote vendor=1 > githttpxfer.ServeHTTP",
+			}, "\n"),
+		},
+		{
+			description: "it should trace the copies of upload-pack",
+			method:      http.MethodPost,
+			url:         "/test.git/git-upload-pack",
+			contentType: "application/x-git-upload-pack-request",
+			body:        "0000",
+			expected: strings.Join([]string{
+				"githttpxfer.ServeHTTP > githttpxfer.matchRouting",
+				"githttpxfer.ServeHTTP > githttpxfer.Exists",
+				"githttpxfer.GitCommand > githttpxfer.copyRequestBody",
+				"githttpxfer.GitCommand > githttpxfer.copyOutput",
+				"githttpxfer.ServeHTTP > githttpxfer.GitCommand",
+				"remote vendor=1 > githttpxfer.ServeHTTP",
+			}, "\n"),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		tracer.spans = nil
+		req := httptest.NewRequest(tc.method, "http://example.com"+tc.url, strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", tc.contentType)
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		req.Header.Set("tracestate", "vendor=1")
+		ghx.ServeHTTP(httptest.NewRecorder(), req)
+		if result := tracer.String(); result != tc.expected {
+			t.Errorf("the spans are not %q . result: %q", tc.expected, result)
+		}
+	}
+
+	expected := []Attribute{{AttributeRepo, "/test.git"}, {AttributeGitSubcommand, uploadPack}, {AttributeService, uploadPack}}
+	attrs := tracer.attrs["githttpxfer.GitCommand"]
+	if len(attrs) != len(expected) {
+		t.Errorf("the attributes are not %v . result: %v", expected, attrs)
+		return
+	}
+	for i := range expected {
+		if attrs[i] != expected[i] {
+			t.Errorf("the attributes are not %v . result: %v", expected, attrs)
+			return
+		}
+	}
+}
+
+func Test_traceContext_should_leave_the_request_of_the_context(t *testing.T) {
+
+	tracer := &recordingTracer{}
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/foo/git-upload-pack", nil)
+	ctx := NewContext(httptest.NewRecorder(), req, "foo", "git-upload-pack")
+
+	spanCtx, end := traceContext(tracer, ctx, "parent")
+	if ctx.Request() != req {
+		t.Error("the request of the context is replaced by the span.")
+	}
+	if spanCtx.Request() == req {
+		t.Error("the request of the span is not derived.")
+	}
+	_, endChild := traceContext(tracer, spanCtx, "child")
+	endChild(nil)
+	end(nil)
+	if ctx.Request() != req {
+		t.Error("the request of the context is replaced after the span.")
+	}
+
+	expected := "parent > child\n > parent"
+	if result := tracer.String(); result != expected {
+		t.Errorf("the spans are not %q . result: %q", expected, result)
+	}
+}
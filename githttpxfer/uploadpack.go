@@ -0,0 +1,212 @@
+package githttpxfer
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nulab/go-git-http-xfer/pktline"
+)
+
+// UploadPackConfig turns on the capabilities of upload-pack that are off by default.
+// AllowFilter serves the partial clone such as "git clone --filter=blob:none",
+// and AllowAnySHA1InWant lets the partial clone fetch the missing objects lazily.
+//
+// The config is given to git as GIT_CONFIG_PARAMETERS, which is how "git -c" passes it on,
+// rather than as "-c" arguments, since CommandFactory gets the subcommand first and "-c" must precede it.
+// It is appended to the GIT_CONFIG_PARAMETERS of Context.Env such as the hooks of the LFS locking.
+// The keys of the coalescing and the pack cache have the config itself, not the environment.
+type UploadPackConfig struct {
+	AllowFilter        bool
+	AllowAnySHA1InWant bool
+	AllowRefInWant     bool
+}
+
+// gitConfig returns the config of git as "name=value".
+func (c UploadPackConfig) gitConfig() []string {
+	config := []string{}
+	if c.AllowFilter {
+		config = append(config, "uploadpack.allowFilter=true")
+	}
+	if c.AllowAnySHA1InWant {
+		config = append(config, "uploadpack.allowAnySHA1InWant=true")
+	}
+	if c.AllowRefInWant {
+		config = append(config, "uploadpack.allowRefInWant=true")
+	}
+	return config
+}
+
+// UploadPackRequest is the negotiation of the upload-pack request.
+// Command is "fetch" or "ls-refs" with the protocol v2, and it is empty with the protocol v0.
+type UploadPackRequest struct {
+	Command        string
+	Capabilities   []string
+	Wants          []string
+	WantRefs       []string
+	Haves          []string
+	Shallows       []string
+	Depth          int
+	DeepenSince    time.Time
+	DeepenNot      []string
+	DeepenRelative bool
+	Filter         string
+	Done           bool
+	RefPrefixes    []string
+
+	consumed []byte
+}
+
+func (req *UploadPackRequest) HasCapability(name string) bool {
+	return hasCapability(req.Capabilities, name)
+}
+
+// IsProtocolV2 reports whether the request is the protocol v2 command.
+func (req *UploadPackRequest) IsProtocolV2() bool {
+	return req.Command != ""
+}
+
+// IsClone reports whether the request asks for objects without any haves.
+func (req *UploadPackRequest) IsClone() bool {
+	return len(req.Wants)+len(req.WantRefs) > 0 && len(req.Haves) == 0 && len(req.Shallows) == 0 && req.Done
+}
+
+// parseUploadPackRequest reads the negotiation of the protocol v0 until "done" or the flush after haves,
+// or the command of the protocol v2 until the flush. The negotiation over limit bytes fails with BufferTooLargeError.
+func parseUploadPackRequest(body io.Reader, limit int64) (*UploadPackRequest, error) {
+	consumed := newParseBuffer(limit)
+	r := pktline.NewReader(io.TeeReader(body, consumed))
+	req := &UploadPackRequest{}
+
+	t, line, err := r.ReadLine()
+	if err == io.EOF {
+		return req, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(line, "command=") {
+		req.Command = strings.TrimPrefix(line, "command=")
+		err = req.parseV2(r)
+	} else {
+		err = req.parseV0(r, t, line)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req.consumed = consumed.Bytes()
+	return req, nil
+}
+
+func (req *UploadPackRequest) parseV0(r *pktline.Reader, t pktline.Type, line string) error {
+	flushes := 0
+	first := true
+	for {
+		if t == pktline.Flush {
+			flushes++
+			// The first flush ends the wants, the second one ends a round of haves.
+			if flushes == 2 {
+				return nil
+			}
+		} else if t != pktline.Data {
+			return fmt.Errorf("unexpected %s packet in negotiation", t)
+		} else {
+			if first && strings.HasPrefix(line, "want ") {
+				fields := strings.Fields(line)
+				if len(fields) > 2 {
+					req.Capabilities = fields[2:]
+					line = strings.Join(fields[:2], " ")
+				}
+				first = false
+			}
+			if line == "done" {
+				req.Done = true
+				return nil
+			}
+			if err := req.parseArgument(line); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		t, line, err = r.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (req *UploadPackRequest) parseV2(r *pktline.Reader) error {
+	inArguments := false
+	for {
+		t, line, err := r.ReadLine()
+		if err != nil {
+			return err
+		}
+		switch t {
+		case pktline.Flush:
+			return nil
+		case pktline.Delim:
+			inArguments = true
+			continue
+		case pktline.ResponseEnd:
+			return fmt.Errorf("unexpected %s packet in command", t)
+		}
+		if !inArguments {
+			req.Capabilities = append(req.Capabilities, line)
+			continue
+		}
+		if err := req.parseArgument(line); err != nil {
+			return err
+		}
+	}
+}
+
+func (req *UploadPackRequest) parseArgument(line string) error {
+	name, value := line, ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		name, value = line[:i], line[i+1:]
+	}
+
+	switch name {
+	case "want":
+		req.Wants = append(req.Wants, value)
+	case "want-ref":
+		req.WantRefs = append(req.WantRefs, value)
+	case "have":
+		req.Haves = append(req.Haves, value)
+	case "shallow":
+		req.Shallows = append(req.Shallows, value)
+	case "deepen":
+		depth, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid deepen: %q", value)
+		}
+		req.Depth = depth
+	case "deepen-since":
+		since, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid deepen-since: %q", value)
+		}
+		req.DeepenSince = time.Unix(since, 0)
+	case "deepen-not":
+		req.DeepenNot = append(req.DeepenNot, value)
+	case "deepen-relative":
+		req.DeepenRelative = true
+	case "filter":
+		req.Filter = value
+	case "done":
+		req.Done = true
+	case "ref-prefix":
+		req.RefPrefixes = append(req.RefPrefixes, value)
+	}
+	// The other arguments such as "thin-pack" or "peel" are left to git.
+	return nil
+}
@@ -0,0 +1,220 @@
+package githttpxfer
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func Test_ParseUploadPackRequest_should_parse_protocol_v0(t *testing.T) {
+
+	body := pktLine("want "+newID+" multi_ack_detailed side-band-64k thin-pack ofs-delta agent=git/2.39.5\n") +
+		pktLine("want "+oldID+"\n") +
+		pktLine("shallow "+zeroID+"\n") +
+		pktLine("deepen 1\n") +
+		pktLine("filter blob:none\n") +
+		"0000" +
+		pktLine("have "+oldID+"\n") +
+		pktLine("done\n")
+
+	r := strings.NewReader(body + "REST")
+	req, err := parseUploadPackRequest(r, 0)
+	if err != nil {
+		t.Errorf("error is %s", err.Error())
+		return
+	}
+
+	if req.IsProtocolV2() {
+		t.Error("request is protocol v2.")
+	}
+	if len(req.Wants) != 2 || req.Wants[0] != newID || req.Wants[1] != oldID {
+		t.Errorf("wants are not parsed. result: %v", req.Wants)
+	}
+	if len(req.Haves) != 1 || req.Haves[0] != oldID {
+		t.Errorf("haves are not parsed. result: %v", req.Haves)
+	}
+	if len(req.Shallows) != 1 || req.Shallows[0] != zeroID {
+		t.Errorf("shallows are not parsed. result: %v", req.Shallows)
+	}
+	if req.Depth != 1 {
+		t.Errorf("depth is not 1 . result: %d", req.Depth)
+	}
+	if req.Filter != "blob:none" {
+		t.Errorf("filter is not blob:none . result: %s", req.Filter)
+	}
+	if !req.Done {
+		t.Error("done is not parsed.")
+	}
+	if !req.HasCapability("side-band-64k") || !req.HasCapability("agent") {
+		t.Errorf("capabilities are not parsed. result: %v", req.Capabilities)
+	}
+	if string(req.consumed) != body {
+		t.Errorf("consumed bytes are not the negotiation. result: %q", req.consumed)
+	}
+	if rest, _ := ioutil.ReadAll(r); string(rest) != "REST" {
+		t.Errorf("the rest is not 'REST' . result: %q", rest)
+	}
+}
+
+func Test_ParseUploadPackRequest_should_stop_at_flush_after_haves(t *testing.T) {
+
+	body := pktLine("want "+newID+" side-band-64k\n") +
+		"0000" +
+		pktLine("have "+oldID+"\n") +
+		"0000"
+
+	req, err := parseUploadPackRequest(strings.NewReader(body), 0)
+	if err != nil {
+		t.Errorf("error is %s", err.Error())
+		return
+	}
+
+	if req.Done {
+		t.Error("done is parsed.")
+	}
+	if req.IsClone() {
+		t.Error("request is clone.")
+	}
+	if string(req.consumed) != body {
+		t.Errorf("consumed bytes are not the negotiation. result: %q", req.consumed)
+	}
+}
+
+func Test_ParseUploadPackRequest_should_parse_protocol_v2(t *testing.T) {
+
+	tests := []struct {
+		description string
+		body        string
+		check       func(req *UploadPackRequest) bool
+	}{
+		{
+			description: "it should parse fetch command",
+			body: pktLine("command=fetch\n") +
+				pktLine("agent=git/2.39.5\n") +
+				pktLine("object-format=sha1\n") +
+				"0001" +
+				pktLine("thin-pack\n") +
+				pktLine("ofs-delta\n") +
+				pktLine("deepen-since 1500000000\n") +
+				pktLine("deepen-not refs/heads/old\n") +
+				pktLine("deepen-relative\n") +
+				pktLine("want "+newID+"\n") +
+				pktLine("want-ref refs/heads/master\n") +
+				pktLine("filter blob:limit=1m\n") +
+				pktLine("done\n") +
+				"0000",
+			check: func(req *UploadPackRequest) bool {
+				return req.Command == "fetch" &&
+					req.HasCapability("object-format") &&
+					len(req.Wants) == 1 && req.Wants[0] == newID &&
+					len(req.WantRefs) == 1 && req.WantRefs[0] == "refs/heads/master" &&
+					req.DeepenSince.Unix() == 1500000000 &&
+					len(req.DeepenNot) == 1 && req.DeepenNot[0] == "refs/heads/old" &&
+					req.DeepenRelative &&
+					req.Filter == "blob:limit=1m" &&
+					req.IsClone()
+			},
+		},
+		{
+			description: "it should parse ls-refs command",
+			body: pktLine("command=ls-refs\n") +
+				"0001" +
+				pktLine("peel\n") +
+				pktLine("ref-prefix refs/heads/\n") +
+				pktLine("ref-prefix refs/tags/\n") +
+				"0000",
+			check: func(req *UploadPackRequest) bool {
+				return req.Command == "ls-refs" &&
+					len(req.RefPrefixes) == 2 && req.RefPrefixes[1] == "refs/tags/"
+			},
+		},
+		{
+			description: "it should parse command without arguments",
+			body:        pktLine("command=ls-refs\n") + "0000",
+			check: func(req *UploadPackRequest) bool {
+				return req.Command == "ls-refs" && req.IsProtocolV2()
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		req, err := parseUploadPackRequest(strings.NewReader(tc.body), 0)
+		if err != nil {
+			t.Errorf("error is %s", err.Error())
+			return
+		}
+		if !tc.check(req) {
+			t.Errorf("request is not parsed. result: %+v", req)
+		}
+		if string(req.consumed) != tc.body {
+			t.Errorf("consumed bytes are not the command. result: %q", req.consumed)
+		}
+	}
+}
+
+func Test_ParseUploadPackRequest_should_return_error(t *testing.T) {
+
+	tests := []struct {
+		description string
+		body        string
+	}{
+		{
+			description: "it should return error if deepen is not number",
+			body:        pktLine("want "+newID+"\n") + pktLine("deepen foo\n") + "0000",
+		},
+		{
+			description: "it should return error if command has no flush",
+			body:        pktLine("command=fetch\n") + "0001" + pktLine("want "+newID+"\n"),
+		},
+		{
+			description: "it should return error if length is invalid",
+			body:        "zzzz",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		if _, err := parseUploadPackRequest(strings.NewReader(tc.body), 0); err == nil {
+			t.Error("error is nil.")
+		}
+	}
+}
+
+func Test_ReadUploadPackRequest_should_limit_the_request(t *testing.T) {
+
+	negotiation := pktLine("want "+newID+"\n") + "0000" + pktLine("done\n")
+
+	tests := []struct {
+		description string
+		rest        string
+		limit       int64
+		complete    bool
+	}{
+		{description: "it should read the whole request within the limit", rest: "0000", limit: 1000, complete: true},
+		{description: "it should read the request of the exact limit", rest: "0000", limit: int64(len(negotiation) + 4), complete: true},
+		{description: "it should stop reading the request over the limit", rest: strings.Repeat("0000", 100), limit: 100},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		body := strings.NewReader(negotiation + tc.rest)
+		upr, err := parseUploadPackRequest(body, 0)
+		if err != nil {
+			t.Errorf("error is %s", err.Error())
+			continue
+		}
+		request, complete, err := readUploadPackRequest(upr, body, tc.limit)
+		if err != nil {
+			t.Errorf("error is %s", err.Error())
+			continue
+		}
+		if complete != tc.complete {
+			t.Errorf("complete is not %t . result: %t", tc.complete, complete)
+		}
+		rest, _ := ioutil.ReadAll(body)
+		if whole := string(request) + string(rest); whole != negotiation+tc.rest {
+			t.Errorf("request is not %q . result: %q", negotiation+tc.rest, whole)
+		}
+	}
+}
@@ -1,3 +1,3 @@
 module github.com/nulab/go-git-http-xfer
 
-go 1.16
+go 1.24.0
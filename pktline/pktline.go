@@ -0,0 +1,66 @@
+// Package pktline implements reading and writing of the pkt-line format
+// used by the git wire protocol.
+package pktline
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// LenSize is the size of the hex length prefix.
+	LenSize = 4
+	// MaxPacketSize is the maximum size of a packet including the length prefix.
+	MaxPacketSize = 65520
+	// MaxPayloadSize is the maximum size of a payload.
+	MaxPayloadSize = MaxPacketSize - LenSize
+)
+
+// Type is the kind of a packet.
+type Type int
+
+const (
+	// Data is a packet that carries a payload.
+	Data Type = iota
+	// Flush is "0000". It ends a message.
+	Flush
+	// Delim is "0001". It separates sections of a message in the protocol v2.
+	Delim
+	// ResponseEnd is "0002". It ends a response in the stateless protocol v2.
+	ResponseEnd
+)
+
+func (t Type) String() string {
+	switch t {
+	case Data:
+		return "data"
+	case Flush:
+		return "flush"
+	case Delim:
+		return "delim"
+	case ResponseEnd:
+		return "response-end"
+	}
+	return fmt.Sprintf("unknown(%d)", int(t))
+}
+
+var (
+	flushPkt       = []byte("0000")
+	delimPkt       = []byte("0001")
+	responseEndPkt = []byte("0002")
+	errPrefix      = []byte("ERR ")
+)
+
+var (
+	ErrInvalidLength = errors.New("pktline: invalid length")
+	ErrTooLarge      = errors.New("pktline: payload too large")
+)
+
+// ErrorPacket is an "ERR" packet sent by the other side.
+type ErrorPacket struct {
+	Message string
+}
+
+func (e *ErrorPacket) Error() string {
+	return "remote error: " + e.Message
+}
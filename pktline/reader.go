@@ -0,0 +1,71 @@
+package pktline
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+)
+
+// Reader reads packets from a stream.
+type Reader struct {
+	r   io.Reader
+	len [LenSize]byte
+	buf []byte
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// ReadPacket reads the next packet.
+// The payload is only valid until the next call of ReadPacket.
+// An "ERR" packet is returned as the Data packet with *ErrorPacket.
+// io.EOF is returned only if the stream ends on the packet boundary, and io.ErrUnexpectedEOF if it ends in the packet.
+// The other errors of the stream are returned as they are.
+func (r *Reader) ReadPacket() (Type, []byte, error) {
+	if _, err := io.ReadFull(r.r, r.len[:]); err != nil {
+		return Data, nil, err
+	}
+
+	n, err := strconv.ParseUint(string(r.len[:]), 16, 16)
+	if err != nil {
+		return Data, nil, ErrInvalidLength
+	}
+
+	switch n {
+	case 0:
+		return Flush, nil, nil
+	case 1:
+		return Delim, nil, nil
+	case 2:
+		return ResponseEnd, nil, nil
+	case 3:
+		return Data, nil, ErrInvalidLength
+	}
+	if n > MaxPacketSize {
+		return Data, nil, ErrTooLarge
+	}
+
+	size := int(n) - LenSize
+	if cap(r.buf) < size {
+		r.buf = make([]byte, size, MaxPayloadSize)
+	}
+	payload := r.buf[:size]
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Data, nil, err
+	}
+
+	if bytes.HasPrefix(payload, errPrefix) {
+		return Data, payload, &ErrorPacket{string(bytes.TrimSuffix(payload[len(errPrefix):], []byte("\n")))}
+	}
+	return Data, payload, nil
+}
+
+// ReadLine reads the next packet and returns its payload as a string without the trailing LF.
+func (r *Reader) ReadLine() (Type, string, error) {
+	t, payload, err := r.ReadPacket()
+	return t, string(bytes.TrimSuffix(payload, []byte("\n"))), err
+}
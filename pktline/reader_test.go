@@ -0,0 +1,152 @@
+package pktline
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func Test_Reader_ReadPacket_should_read_packets(t *testing.T) {
+
+	r := NewReader(strings.NewReader("000ahello\n" + "0000" + "0001" + "0002" + "0004" + "0008ERR!"))
+
+	tests := []struct {
+		description     string
+		expectedType    Type
+		expectedPayload string
+	}{
+		{
+			description:     "it should read data packet",
+			expectedType:    Data,
+			expectedPayload: "hello\n",
+		},
+		{
+			description:  "it should read flush packet",
+			expectedType: Flush,
+		},
+		{
+			description:  "it should read delim packet",
+			expectedType: Delim,
+		},
+		{
+			description:  "it should read response end packet",
+			expectedType: ResponseEnd,
+		},
+		{
+			description:     "it should read empty data packet",
+			expectedType:    Data,
+			expectedPayload: "",
+		},
+		{
+			description:     "it should read data packet that is not an error packet",
+			expectedType:    Data,
+			expectedPayload: "ERR!",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		typ, payload, err := r.ReadPacket()
+		if err != nil {
+			t.Errorf("error is %s", err.Error())
+			return
+		}
+		if typ != tc.expectedType {
+			t.Errorf("type is not %s . result: %s", tc.expectedType, typ)
+		}
+		if string(payload) != tc.expectedPayload {
+			t.Errorf("payload is not %q . result: %q", tc.expectedPayload, payload)
+		}
+	}
+
+	if _, _, err := r.ReadPacket(); err != io.EOF {
+		t.Errorf("error is not io.EOF . result: %v", err)
+	}
+}
+
+func Test_Reader_ReadPacket_should_return_error(t *testing.T) {
+
+	errRead := errors.New("read error")
+
+	tests := []struct {
+		description string
+		input       string
+		readErr     error
+		expected    error
+	}{
+		{
+			description: "it should return ErrInvalidLength if length is not hex",
+			input:       "zzzzhello",
+			expected:    ErrInvalidLength,
+		},
+		{
+			description: "it should return ErrInvalidLength if length is 0003",
+			input:       "0003",
+			expected:    ErrInvalidLength,
+		},
+		{
+			description: "it should return ErrTooLarge if length exceeds the maximum",
+			input:       "fff1",
+			expected:    ErrTooLarge,
+		},
+		{
+			description: "it should return io.ErrUnexpectedEOF if payload is short",
+			input:       "000ahel",
+			expected:    io.ErrUnexpectedEOF,
+		},
+		{
+			description: "it should return io.ErrUnexpectedEOF if length is short",
+			input:       "00",
+			expected:    io.ErrUnexpectedEOF,
+		},
+		{
+			description: "it should return the error of the stream if it fails in length",
+			input:       "00",
+			readErr:     errRead,
+			expected:    errRead,
+		},
+		{
+			description: "it should return the error of the stream if it fails in payload",
+			input:       "000ahel",
+			readErr:     errRead,
+			expected:    errRead,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		var r io.Reader = strings.NewReader(tc.input)
+		if tc.readErr != nil {
+			r = io.MultiReader(r, iotest.ErrReader(tc.readErr))
+		}
+		_, _, err := NewReader(r).ReadPacket()
+		if err != tc.expected {
+			t.Errorf("error is not %v . result: %v", tc.expected, err)
+		}
+	}
+}
+
+func Test_Reader_ReadPacket_should_return_ErrorPacket(t *testing.T) {
+	_, _, err := NewReader(strings.NewReader("0016ERR access denied\n")).ReadPacket()
+	e, ok := err.(*ErrorPacket)
+	if !ok {
+		t.Errorf("error is not ErrorPacket . result: %v", err)
+		return
+	}
+	if e.Message != "access denied" {
+		t.Errorf("message is not 'access denied' . result: %s", e.Message)
+	}
+}
+
+func Test_Reader_ReadLine_should_trim_LF(t *testing.T) {
+	_, line, err := NewReader(strings.NewReader("000ahello\n")).ReadLine()
+	if err != nil {
+		t.Errorf("error is %s", err.Error())
+		return
+	}
+	if line != "hello" {
+		t.Errorf("line is not 'hello' . result: %q", line)
+	}
+}
@@ -0,0 +1,119 @@
+package pktline
+
+import (
+	"fmt"
+	"io"
+)
+
+// Band is the side-band channel.
+type Band byte
+
+const (
+	// BandData carries the packfile or the report.
+	BandData Band = 1
+	// BandProgress carries progress messages shown to the user.
+	BandProgress Band = 2
+	// BandError carries a fatal error message. The git client dies after showing it.
+	BandError Band = 3
+)
+
+const (
+	// SidebandMaxDataSize is the maximum data size per packet with the "side-band" capability.
+	SidebandMaxDataSize = 1000 - LenSize - 1
+	// Sideband64kMaxDataSize is the maximum data size per packet with the "side-band-64k" capability.
+	Sideband64kMaxDataSize = MaxPayloadSize - 1
+)
+
+// WriteBand writes p as one packet on the band.
+func (w *Writer) WriteBand(band Band, p []byte) error {
+	if len(p) > Sideband64kMaxDataSize {
+		return ErrTooLarge
+	}
+	buf := make([]byte, 1+len(p))
+	buf[0] = byte(band)
+	copy(buf[1:], p)
+	return w.WritePacket(buf)
+}
+
+// SidebandWriter writes the data on a band, splitting it into packets of maxDataSize.
+type SidebandWriter struct {
+	w           *Writer
+	band        Band
+	maxDataSize int
+}
+
+func NewSidebandWriter(w *Writer, band Band, maxDataSize int) *SidebandWriter {
+	if maxDataSize <= 0 || maxDataSize > Sideband64kMaxDataSize {
+		maxDataSize = Sideband64kMaxDataSize
+	}
+	return &SidebandWriter{w, band, maxDataSize}
+}
+
+func (s *SidebandWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		size := len(p)
+		if size > s.maxDataSize {
+			size = s.maxDataSize
+		}
+		if err := s.w.WriteBand(s.band, p[:size]); err != nil {
+			return n, err
+		}
+		n += size
+		p = p[size:]
+	}
+	return n, nil
+}
+
+// Demuxer reads the data band of a side-band stream until the flush packet.
+// Progress messages are written to progress if it is not nil,
+// and a message on the error band is returned as *ErrorPacket.
+type Demuxer struct {
+	r        *Reader
+	progress io.Writer
+	pending  []byte
+	done     bool
+}
+
+func NewDemuxer(r *Reader, progress io.Writer) *Demuxer {
+	return &Demuxer{r: r, progress: progress}
+}
+
+func (d *Demuxer) Read(p []byte) (int, error) {
+	for len(d.pending) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		t, payload, err := d.r.ReadPacket()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if t == Flush {
+			d.done = true
+			continue
+		}
+		if t != Data || len(payload) == 0 {
+			return 0, fmt.Errorf("pktline: unexpected %s packet in side-band", t)
+		}
+		switch Band(payload[0]) {
+		case BandData:
+			d.pending = payload[1:]
+		case BandProgress:
+			if d.progress != nil {
+				if _, err := d.progress.Write(payload[1:]); err != nil {
+					return 0, err
+				}
+			}
+		case BandError:
+			return 0, &ErrorPacket{string(payload[1:])}
+		default:
+			return 0, fmt.Errorf("pktline: bad band #%d", payload[0])
+		}
+	}
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
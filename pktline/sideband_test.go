@@ -0,0 +1,70 @@
+package pktline
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func Test_SidebandWriter_should_split_data_into_packets(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sw := NewSidebandWriter(NewWriter(buf), BandData, 3)
+	n, err := sw.Write([]byte("abcdefg"))
+	if err != nil {
+		t.Errorf("error is %s", err.Error())
+		return
+	}
+	if n != 7 {
+		t.Errorf("written size is not 7 . result: %d", n)
+	}
+	expected := "0008\x01abc" + "0008\x01def" + "0006\x01g"
+	if buf.String() != expected {
+		t.Errorf("output is not %q . result: %q", expected, buf.String())
+	}
+}
+
+func Test_Demuxer_should_demultiplex_bands(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.WriteBand(BandData, []byte("PACK"))
+	w.WriteBand(BandProgress, []byte("Counting objects\n"))
+	w.WriteBand(BandData, []byte("DATA"))
+	w.WriteFlush()
+
+	progress := &bytes.Buffer{}
+	data, err := ioutil.ReadAll(NewDemuxer(NewReader(buf), progress))
+	if err != nil {
+		t.Errorf("error is %s", err.Error())
+		return
+	}
+	if string(data) != "PACKDATA" {
+		t.Errorf("data is not 'PACKDATA' . result: %q", data)
+	}
+	if progress.String() != "Counting objects\n" {
+		t.Errorf("progress is not 'Counting objects' . result: %q", progress.String())
+	}
+}
+
+func Test_Demuxer_should_return_ErrorPacket_on_error_band(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	w.WriteBand(BandError, []byte("quota exceeded"))
+
+	_, err := ioutil.ReadAll(NewDemuxer(NewReader(buf), nil))
+	e, ok := err.(*ErrorPacket)
+	if !ok {
+		t.Errorf("error is not ErrorPacket . result: %v", err)
+		return
+	}
+	if e.Message != "quota exceeded" {
+		t.Errorf("message is not 'quota exceeded' . result: %s", e.Message)
+	}
+}
+
+func Test_Demuxer_should_return_error_on_bad_band(t *testing.T) {
+	_, err := ioutil.ReadAll(NewDemuxer(NewReader(strings.NewReader("0006\x05a")), nil))
+	if err == nil {
+		t.Error("error is nil.")
+	}
+}
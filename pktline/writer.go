@@ -0,0 +1,56 @@
+package pktline
+
+import (
+	"fmt"
+	"io"
+)
+
+// Writer writes packets to a stream.
+type Writer struct {
+	w io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w}
+}
+
+// WritePacket writes p as one data packet.
+func (w *Writer) WritePacket(p []byte) error {
+	if len(p) > MaxPayloadSize {
+		return ErrTooLarge
+	}
+	pkt := make([]byte, LenSize+len(p))
+	copy(pkt, fmt.Sprintf("%04x", len(p)+LenSize))
+	copy(pkt[LenSize:], p)
+	_, err := w.w.Write(pkt)
+	return err
+}
+
+func (w *Writer) WriteString(s string) error {
+	return w.WritePacket([]byte(s))
+}
+
+// WriteLine writes s with a trailing LF.
+func (w *Writer) WriteLine(s string) error {
+	return w.WriteString(s + "\n")
+}
+
+func (w *Writer) WriteFlush() error {
+	_, err := w.w.Write(flushPkt)
+	return err
+}
+
+func (w *Writer) WriteDelim() error {
+	_, err := w.w.Write(delimPkt)
+	return err
+}
+
+func (w *Writer) WriteResponseEnd() error {
+	_, err := w.w.Write(responseEndPkt)
+	return err
+}
+
+// WriteError writes an "ERR" packet. The git client shows the message as the remote error and dies.
+func (w *Writer) WriteError(message string) error {
+	return w.WriteString(string(errPrefix) + message + "\n")
+}
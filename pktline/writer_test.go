@@ -0,0 +1,95 @@
+package pktline
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func Test_Writer_should_write_packets(t *testing.T) {
+
+	tests := []struct {
+		description string
+		write       func(w *Writer) error
+		expected    string
+	}{
+		{
+			description: "it should write data packet",
+			write:       func(w *Writer) error { return w.WriteString("hello\n") },
+			expected:    "000ahello\n",
+		},
+		{
+			description: "it should write line",
+			write:       func(w *Writer) error { return w.WriteLine("hello") },
+			expected:    "000ahello\n",
+		},
+		{
+			description: "it should write flush packet",
+			write:       func(w *Writer) error { return w.WriteFlush() },
+			expected:    "0000",
+		},
+		{
+			description: "it should write delim packet",
+			write:       func(w *Writer) error { return w.WriteDelim() },
+			expected:    "0001",
+		},
+		{
+			description: "it should write response end packet",
+			write:       func(w *Writer) error { return w.WriteResponseEnd() },
+			expected:    "0002",
+		},
+		{
+			description: "it should write error packet",
+			write:       func(w *Writer) error { return w.WriteError("access denied") },
+			expected:    "0016ERR access denied\n",
+		},
+		{
+			description: "it should write band packet",
+			write:       func(w *Writer) error { return w.WriteBand(BandProgress, []byte("hi")) },
+			expected:    "0007\x02hi",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Log(tc.description)
+		buf := &bytes.Buffer{}
+		if err := tc.write(NewWriter(buf)); err != nil {
+			t.Errorf("error is %s", err.Error())
+			return
+		}
+		if buf.String() != tc.expected {
+			t.Errorf("output is not %q . result: %q", tc.expected, buf.String())
+		}
+	}
+}
+
+func Test_Writer_WritePacket_should_return_ErrTooLarge(t *testing.T) {
+	w := NewWriter(&bytes.Buffer{})
+	if err := w.WritePacket(make([]byte, MaxPayloadSize+1)); err != ErrTooLarge {
+		t.Errorf("error is not ErrTooLarge . result: %v", err)
+	}
+	if err := w.WritePacket(make([]byte, MaxPayloadSize)); err != nil {
+		t.Errorf("error is %s", err.Error())
+	}
+}
+
+func Test_Writer_should_be_readable_by_Reader(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewWriter(buf)
+	payload := strings.Repeat("a", MaxPayloadSize)
+	w.WriteString(payload)
+	w.WriteFlush()
+
+	r := NewReader(buf)
+	typ, p, err := r.ReadPacket()
+	if err != nil {
+		t.Errorf("error is %s", err.Error())
+		return
+	}
+	if typ != Data || string(p) != payload {
+		t.Errorf("packet is not the written payload. type: %s, size: %d", typ, len(p))
+	}
+	if typ, _, _ := r.ReadPacket(); typ != Flush {
+		t.Errorf("type is not flush . result: %s", typ)
+	}
+}